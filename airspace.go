@@ -0,0 +1,669 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marni/goigc"
+)
+
+// Pressure altitudes in IGC files are relative to 1013.25 hPa. Limits
+// given above mean sea level are compared with them corrected to
+// airspaceQNH, flight levels with the uncorrected ones.
+var airspaceQNH = getEnvFloat("AIRSPACE_QNH", 1013.25)
+
+// Uploaded airspace files are written to airspaceDir, and every
+// airspaceReload the files are loaded again if they changed, so replicas
+// sharing the directory check tracks against the same airspaces
+var (
+	airspaceDir    = os.Getenv("AIRSPACE_DIR")
+	airspaceReload = getEnvDuration("AIRSPACE_RELOAD", time.Minute)
+)
+
+const (
+	feet       = 0.3048 // m
+	nauticalMi = 1.852  // km
+	metresHPa  = 8.3    // m of altitude per hPa near sea level
+	arcStep    = 5.0    // degrees between the points of arcs and circles
+)
+
+// altitudeLimit is the floor or ceiling of an airspace
+type altitudeLimit struct {
+	Metres      float64 // above mean sea level, or pressure altitude for flight levels
+	FlightLevel bool
+	AboveGround bool // Metres above ground, which can't be checked without terrain
+	Ground      bool // GND, SFC or 0 m above ground
+	Unlimited   bool
+	Text        string
+}
+
+// Airspace is one airspace of an OpenAir file, arcs and circles turned
+// into polygons
+type Airspace struct {
+	Class   string
+	Name    string
+	Lower   altitudeLimit
+	Upper   altitudeLimit
+	Polygon [][2]float64 // lat, lon
+
+	minLat, minLon, maxLat, maxLon float64
+	skipped                        error // why the airspace is left out of the file
+}
+
+// Violation is a stretch of a flight inside an airspace
+type Violation struct {
+	Airspace    string    `json:"airspace"`
+	Class       string    `json:"class"`
+	Lower       string    `json:"lower"`
+	Upper       string    `json:"upper"`
+	Entry       time.Time `json:"entry"`
+	Exit        time.Time `json:"exit"`
+	Lat         float64   `json:"lat"` // where the airspace was entered
+	Lon         float64   `json:"lon"`
+	Altitude    float64   `json:"altitude"`             // highest inside, m above mean sea level
+	Penetration float64   `json:"penetration"`          // deepest, m from the nearest limit or border
+	Unverified  bool      `json:"unverified,omitempty"` // a limit above ground was not checked
+}
+
+// Parses limits such as "GND", "FL95", "2500ft MSL", "1000ft AGL", "1500m"
+// or "UNL"
+func parseAltitude(text string) (altitudeLimit, error) {
+	limit := altitudeLimit{Text: strings.TrimSpace(text)}
+	s := strings.ToUpper(strings.Replace(limit.Text, " ", "", -1))
+	switch {
+	case s == "GND" || s == "SFC" || s == "0":
+		limit.Ground = true
+		return limit, nil
+	case strings.HasPrefix(s, "UNL"):
+		limit.Unlimited = true
+		return limit, nil
+	case strings.HasPrefix(s, "FL"):
+		level, err := strconv.ParseFloat(s[2:], 64)
+		if err != nil {
+			return limit, fmt.Errorf("bad flight level %q", text)
+		}
+		limit.FlightLevel = true
+		limit.Metres = level * 100 * feet
+		return limit, nil
+	}
+
+	for _, suffix := range []string{"AGL", "AGND", "ASFC", "GND", "SFC"} {
+		if strings.HasSuffix(s, suffix) {
+			limit.AboveGround = true
+			s = strings.TrimSuffix(s, suffix)
+			break
+		}
+	}
+	if !limit.AboveGround {
+		for _, suffix := range []string{"AMSL", "MSL", "ALT"} {
+			s = strings.TrimSuffix(s, suffix)
+		}
+	}
+	unit := feet
+	if strings.HasSuffix(s, "M") {
+		unit, s = 1, strings.TrimSuffix(s, "M")
+	} else {
+		s = strings.TrimSuffix(s, "FT")
+		s = strings.TrimSuffix(s, "F")
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return limit, fmt.Errorf("bad altitude %q", text)
+	}
+	limit.Metres = value * unit
+	if limit.AboveGround && limit.Metres == 0 {
+		limit.AboveGround, limit.Ground = false, true
+	}
+	return limit, nil
+}
+
+// Parses an OpenAir coordinate such as "60:47:42 N 010:41:24 E" or
+// "60:47.7N 10:41.4E"
+func parseCoordinate(text string) ([2]float64, error) {
+	s := strings.ToUpper(strings.Replace(text, " ", "", -1))
+	split := strings.IndexAny(s, "NS")
+	if split < 0 || split == len(s)-1 {
+		return [2]float64{}, fmt.Errorf("bad coordinate %q", text)
+	}
+	lat, err := parseDegrees(s[:split], s[split] == 'S')
+	if err != nil {
+		return [2]float64{}, err
+	}
+	lonText := s[split+1:]
+	if len(lonText) == 0 || (lonText[len(lonText)-1] != 'E' && lonText[len(lonText)-1] != 'W') {
+		return [2]float64{}, fmt.Errorf("bad coordinate %q", text)
+	}
+	lon, err := parseDegrees(lonText[:len(lonText)-1], lonText[len(lonText)-1] == 'W')
+	if err != nil {
+		return [2]float64{}, err
+	}
+	return [2]float64{lat, lon}, nil
+}
+
+// Degrees from "DD:MM:SS", "DD:MM.mmm" or "DD.ddd"
+func parseDegrees(text string, negative bool) (float64, error) {
+	degrees := 0.0
+	for i, part := range strings.Split(text, ":") {
+		value, err := strconv.ParseFloat(part, 64)
+		if err != nil || i > 2 {
+			return 0, fmt.Errorf("bad coordinate %q", text)
+		}
+		degrees += value / math.Pow(60, float64(i))
+	}
+	if negative {
+		degrees = -degrees
+	}
+	return degrees, nil
+}
+
+// Point at the given distance (km) and bearing (degrees) from centre
+func destination(centre [2]float64, bearingDeg, distance float64) [2]float64 {
+	const earthRadius = 6371.0
+	lat1, lon1 := centre[0]*math.Pi/180, centre[1]*math.Pi/180
+	b, d := bearingDeg*math.Pi/180, distance/earthRadius
+	lat2 := math.Asin(math.Sin(lat1)*math.Cos(d) + math.Cos(lat1)*math.Sin(d)*math.Cos(b))
+	lon2 := lon1 + math.Atan2(math.Sin(b)*math.Sin(d)*math.Cos(lat1), math.Cos(d)-math.Sin(lat1)*math.Sin(lat2))
+	return [2]float64{lat2 * 180 / math.Pi, lon2 * 180 / math.Pi}
+}
+
+// Points of an arc around centre from one bearing to another, clockwise
+// unless counter
+func arc(centre [2]float64, radius, from, to float64, clockwise bool) [][2]float64 {
+	sweep := math.Mod(to-from+360, 360)
+	if !clockwise {
+		sweep = -math.Mod(from-to+360, 360)
+	}
+	steps := int(math.Ceil(math.Abs(sweep) / arcStep))
+	points := [][2]float64{}
+	for i := 0; i <= steps; i++ {
+		points = append(points, destination(centre, from+sweep*float64(i)/math.Max(1, float64(steps)), radius))
+	}
+	return points
+}
+
+// Distance (km) and bearing (degrees) from a to b
+func rangeBearing(a, b [2]float64) (float64, float64) {
+	pa, pb := igc.NewPointFromLatLng(a[0], a[1]), igc.NewPointFromLatLng(b[0], b[1])
+	return pa.Distance(pb), math.Mod(bearing(pa, pb)+360, 360)
+}
+
+// Reads the airspaces of an OpenAir file
+func parseOpenAir(content string) ([]Airspace, error) {
+	airspaces := []Airspace{}
+	var current *Airspace
+	centre := [2]float64{}
+	clockwise := true
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for number := 1; scanner.Scan(); number++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "*"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if len(line) < 2 {
+			continue
+		}
+		fail := func(err error) ([]Airspace, error) {
+			return nil, fmt.Errorf("line %d: %v", number, err)
+		}
+
+		record, rest := strings.ToUpper(line[:2]), strings.TrimSpace(line[2:])
+		if record == "AC" {
+			airspaces = append(airspaces, Airspace{Class: rest})
+			current = &airspaces[len(airspaces)-1]
+			clockwise = true
+			continue
+		}
+		if current == nil {
+			continue // anything before the first airspace, such as styling
+		}
+
+		var err error
+		switch {
+		case record == "AN":
+			current.Name = rest
+		case record == "AL" || record == "AH":
+			// Limits of other kinds, such as above standard pressure, only
+			// cost their airspace
+			limit, limitErr := parseAltitude(rest)
+			if limitErr != nil && current.skipped == nil {
+				current.skipped = fmt.Errorf("line %d: %v", number, limitErr)
+			}
+			if record == "AL" {
+				current.Lower = limit
+			} else {
+				current.Upper = limit
+			}
+		case record == "DP":
+			var point [2]float64
+			point, err = parseCoordinate(rest)
+			current.Polygon = append(current.Polygon, point)
+		case record[0] == 'V':
+			variable := strings.ToUpper(strings.TrimSpace(line[1:]))
+			if strings.HasPrefix(variable, "X=") {
+				centre, err = parseCoordinate(variable[2:])
+			} else if strings.HasPrefix(variable, "D=") {
+				clockwise = strings.TrimSpace(variable[2:]) != "-"
+			}
+		case record == "DC":
+			var radius float64
+			radius, err = strconv.ParseFloat(rest, 64)
+			for angle := 0.0; angle < 360; angle += arcStep {
+				current.Polygon = append(current.Polygon, destination(centre, angle, radius*nauticalMi))
+			}
+		case record == "DA":
+			parts := strings.Split(rest, ",")
+			if len(parts) != 3 {
+				return fail(fmt.Errorf("bad arc %q", rest))
+			}
+			values := [3]float64{}
+			for i, part := range parts {
+				if values[i], err = strconv.ParseFloat(strings.TrimSpace(part), 64); err != nil {
+					return fail(fmt.Errorf("bad arc %q", rest))
+				}
+			}
+			current.Polygon = append(current.Polygon, arc(centre, values[0]*nauticalMi, values[1], values[2], clockwise)...)
+		case record == "DB":
+			parts := strings.Split(rest, ",")
+			if len(parts) != 2 {
+				return fail(fmt.Errorf("bad arc %q", rest))
+			}
+			var from, to [2]float64
+			if from, err = parseCoordinate(parts[0]); err != nil {
+				return fail(err)
+			}
+			if to, err = parseCoordinate(parts[1]); err != nil {
+				return fail(err)
+			}
+			radius, start := rangeBearing(centre, from)
+			_, end := rangeBearing(centre, to)
+			current.Polygon = append(current.Polygon, arc(centre, radius, start, end, clockwise)...)
+		}
+		if err != nil {
+			return fail(err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// Airspaces without an area can't be flown into
+	kept := airspaces[:0]
+	for _, airspace := range airspaces {
+		if airspace.skipped != nil {
+			log.Printf("skipping airspace %q: %v", airspace.Name, airspace.skipped)
+			continue
+		}
+		if len(airspace.Polygon) >= 3 {
+			airspace.bound()
+			kept = append(kept, airspace)
+		}
+	}
+	return kept, nil
+}
+
+func (a *Airspace) bound() {
+	a.minLat, a.minLon, a.maxLat, a.maxLon = 90, 180, -90, -180
+	for _, point := range a.Polygon {
+		a.minLat, a.maxLat = math.Min(a.minLat, point[0]), math.Max(a.maxLat, point[0])
+		a.minLon, a.maxLon = math.Min(a.minLon, point[1]), math.Max(a.maxLon, point[1])
+	}
+}
+
+// Whether the position is inside the polygon, by ray casting
+func (a *Airspace) contains(lat, lon float64) bool {
+	if lat < a.minLat || lat > a.maxLat || lon < a.minLon || lon > a.maxLon {
+		return false
+	}
+	inside := false
+	for i, j := 0, len(a.Polygon)-1; i < len(a.Polygon); j, i = i, i+1 {
+		pi, pj := a.Polygon[i], a.Polygon[j]
+		if (pi[0] > lat) != (pj[0] > lat) && lon < (pj[1]-pi[1])*(lat-pi[0])/(pj[0]-pi[0])+pi[1] {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// Vertical margin of a fix inside the limits of the airspace in m, negative
+// when it is above or below. amsl is corrected to the QNH, pressure is not.
+// Limits above ground are left out, see unverified.
+func (a *Airspace) vertical(amsl, pressure float64) float64 {
+	margin := math.Inf(1)
+	if !a.Lower.Ground && !a.Lower.AboveGround {
+		altitude := amsl
+		if a.Lower.FlightLevel {
+			altitude = pressure
+		}
+		margin = altitude - a.Lower.Metres
+	}
+	if !a.Upper.Unlimited && !a.Upper.Ground && !a.Upper.AboveGround {
+		altitude := amsl
+		if a.Upper.FlightLevel {
+			altitude = pressure
+		}
+		margin = math.Min(margin, a.Upper.Metres-altitude)
+	}
+	return margin
+}
+
+// airspaceIndex holds the loaded airspaces in a grid of one degree cells
+type airspaceIndex struct {
+	mutex     sync.RWMutex
+	airspaces []*Airspace
+	cells     map[[2]int][]*Airspace
+	files     []string
+	version   string // of the directory the files were loaded from, see airspaceFiles
+}
+
+func newAirspaceIndex() *airspaceIndex {
+	return &airspaceIndex{cells: make(map[[2]int][]*Airspace)}
+}
+
+// The airspaces used when tracks are added
+var airspaces = newAirspaceIndex()
+
+// Adds the airspaces of an OpenAir file
+func (index *airspaceIndex) load(name, content string) (int, error) {
+	parsed, err := parseOpenAir(content)
+	if err != nil {
+		return 0, fmt.Errorf("%v: %v", name, err)
+	}
+
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	for i := range parsed {
+		airspace := &parsed[i]
+		index.airspaces = append(index.airspaces, airspace)
+		for lat := int(math.Floor(airspace.minLat)); lat <= int(math.Floor(airspace.maxLat)); lat++ {
+			for lon := int(math.Floor(airspace.minLon)); lon <= int(math.Floor(airspace.maxLon)); lon++ {
+				cell := [2]int{lat, lon}
+				index.cells[cell] = append(index.cells[cell], airspace)
+			}
+		}
+	}
+	index.files = append(index.files, name)
+	return len(parsed), nil
+}
+
+// The .txt and .air files of a directory, and a version made of their
+// names, sizes and modification times, which changes with any of them
+func airspaceFiles(dir string) ([]string, string, error) {
+	names := []string{}
+	for _, pattern := range []string{"*.txt", "*.air"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, "", err
+		}
+		names = append(names, matches...)
+	}
+	version := ""
+	for _, name := range names {
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, "", err
+		}
+		version += fmt.Sprintf("%v %d %d\n", filepath.Base(name), info.Size(), info.ModTime().UnixNano())
+	}
+	return names, version, nil
+}
+
+// Replaces the airspaces by those of every .txt and .air file of a
+// directory. On errors the loaded airspaces are kept.
+func (index *airspaceIndex) loadDir(dir string) error {
+	names, version, err := airspaceFiles(dir)
+	if err != nil {
+		return err
+	}
+	loaded := newAirspaceIndex()
+	for _, name := range names {
+		content, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		count, err := loaded.load(filepath.Base(name), string(content))
+		if err != nil {
+			return err
+		}
+		log.Printf("loaded %d airspaces from %v", count, name)
+	}
+
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	index.airspaces, index.cells, index.files = loaded.airspaces, loaded.cells, loaded.files
+	index.version = version
+	return nil
+}
+
+// Loads the directory again whenever its files change, such as after an
+// upload to another replica
+func (index *airspaceIndex) watchDir(dir string, interval time.Duration) {
+	for range time.Tick(interval) {
+		_, version, err := airspaceFiles(dir)
+		index.mutex.RLock()
+		changed := version != index.version
+		index.mutex.RUnlock()
+		if err == nil && changed {
+			err = index.loadDir(dir)
+		}
+		if err != nil {
+			log.Println("reloading airspaces:", err)
+		}
+	}
+}
+
+// Name of the file an upload is written to, in the airspace directory
+func airspaceFileName(name string) string {
+	name = filepath.Base(name)
+	if name == "." || name == string(filepath.Separator) || strings.HasPrefix(name, ".") {
+		name = "upload"
+	}
+	if ext := strings.ToLower(filepath.Ext(name)); ext != ".txt" && ext != ".air" {
+		name += ".txt"
+	}
+	return name
+}
+
+// Writes the file to the directory and loads it again. The file is
+// renamed into place, so other replicas never read half of it.
+func (index *airspaceIndex) save(dir, name string, content []byte) error {
+	file, err := ioutil.TempFile(dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filepath.Join(dir, name))
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return index.loadDir(dir)
+}
+
+// Removes the airspace files of the directory and drops their airspaces
+func (index *airspaceIndex) removeDir(dir string) error {
+	names, _, err := airspaceFiles(dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+	}
+	return index.loadDir(dir)
+}
+
+// Drops all airspaces
+func (index *airspaceIndex) clear() {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	index.airspaces, index.files, index.version = nil, nil, ""
+	index.cells = make(map[[2]int][]*Airspace)
+}
+
+// Finds where a flight was inside an airspace, one violation for every
+// time an airspace was entered
+func (index *airspaceIndex) check(track igc.Track) []Violation {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	violations := []Violation{}
+	if len(index.airspaces) == 0 {
+		return violations
+	}
+	times := fixTimes(track)
+
+	// Old loggers without a pressure sensor write zeros, use GNSS then
+	usePressure := false
+	for _, point := range track.Points {
+		if point.PressureAltitude != 0 {
+			usePressure = true
+			break
+		}
+	}
+
+	open := map[*Airspace]int{} // airspace -> index in violations
+	for i, point := range track.Points {
+		lat, lon := point.Lat.Degrees(), point.Lng.Degrees()
+		pressure, amsl := float64(point.GNSSAltitude), float64(point.GNSSAltitude)
+		if usePressure {
+			pressure = float64(point.PressureAltitude)
+			amsl = pressure + (airspaceQNH-1013.25)*metresHPa
+		}
+
+		inside := map[*Airspace]bool{}
+		for _, airspace := range index.cells[[2]int{int(math.Floor(lat)), int(math.Floor(lon))}] {
+			margin := airspace.vertical(amsl, pressure)
+			if margin < 0 || !airspace.contains(lat, lon) {
+				continue
+			}
+			inside[airspace] = true
+
+			k, ok := open[airspace]
+			if !ok {
+				violations = append(violations, Violation{
+					Airspace:   airspace.Name,
+					Class:      airspace.Class,
+					Lower:      airspace.Lower.Text,
+					Upper:      airspace.Upper.Text,
+					Entry:      times[i],
+					Lat:        lat,
+					Lon:        lon,
+					Altitude:   amsl,
+					Unverified: airspace.unverified(),
+				})
+				k = len(violations) - 1
+				open[airspace] = k
+			}
+			violation := &violations[k]
+			violation.Exit = times[i]
+			violation.Altitude = math.Max(violation.Altitude, amsl)
+			violation.Penetration = math.Max(violation.Penetration, math.Min(margin, airspace.border(lat, lon)))
+		}
+		for airspace := range open {
+			if !inside[airspace] {
+				delete(open, airspace)
+			}
+		}
+	}
+	return violations
+}
+
+// Whether a limit of the airspace is above ground. Its violations only
+// show the flight was within the other limits.
+func (a *Airspace) unverified() bool {
+	return a.Lower.AboveGround || a.Upper.AboveGround
+}
+
+// Distance from a position inside the airspace to its border, in m
+func (a *Airspace) border(lat, lon float64) float64 {
+	here := TaskPoint{Lat: lat, Lon: lon}
+	nearest := math.Inf(1)
+	for i, j := 0, len(a.Polygon)-1; i < len(a.Polygon); j, i = i, i+1 {
+		// Distance to the edge in metres around the position
+		ax, ay := localXY(here, a.Polygon[j][0], a.Polygon[j][1])
+		bx, by := localXY(here, a.Polygon[i][0], a.Polygon[i][1])
+		dx, dy := bx-ax, by-ay
+		f := 0.0
+		if length := dx*dx + dy*dy; length > 0 {
+			f = math.Max(0, math.Min(1, -(ax*dx+ay*dy)/length))
+		}
+		nearest = math.Min(nearest, math.Hypot(ax+f*dx, ay+f*dy))
+	}
+	return nearest
+}
+
+// GET /paragliding/api/track/{id}/airspace gives the airspace violations
+// found when the track was added
+func airspaceHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	id := parts[len(parts)-2]
+
+	track, err := trackDataBase.Get(id)
+	if err != nil {
+		errorStore(w, err)
+		return
+	}
+	writeJSON(w, append([]Violation{}, track.Airspace...))
+}
+
+// POST adds the airspaces of the OpenAir file in the body to AIRSPACE_DIR,
+// named by the "name" query parameter, replacing a file of the same name.
+// GET lists the loaded files, DELETE removes them all.
+func adminAirspace(w http.ResponseWriter, r *http.Request) {
+	if airspaceDir == "" && (r.Method == "POST" || r.Method == "DELETE") {
+		http.Error(w, "AIRSPACE_DIR is not set, changes would be lost on restart", http.StatusServiceUnavailable)
+		return
+	}
+	switch r.Method {
+	case "POST":
+		content, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxUploadSize))
+		if err != nil {
+			error400(w)
+			return
+		}
+		name := airspaceFileName(r.URL.Query().Get("name"))
+		parsed, err := parseOpenAir(string(content))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("%v: %v", name, err), http.StatusBadRequest)
+			return
+		}
+		if err := airspaces.save(airspaceDir, name, content); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, len(parsed))
+	case "GET":
+		airspaces.mutex.RLock()
+		defer airspaces.mutex.RUnlock()
+		writeJSON(w, map[string]interface{}{
+			"files":     append([]string{}, airspaces.files...),
+			"airspaces": len(airspaces.airspaces),
+		})
+	case "DELETE":
+		if err := airspaces.removeDir(airspaceDir); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, 0)
+	default:
+		error400(w)
+	}
+}
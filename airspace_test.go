@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/marni/goigc"
+)
+
+// Around the thermal of the sample flight from 1500ft, a polygon far off
+// and an arc-shaped sector
+const testOpenAir = `* Test airspace
+AC C
+AN GJOVIK CTR
+AL 1500ft MSL
+AH FL95
+V X=60:47:44 N 010:41:36 E
+DC 0.5
+
+AC D
+AN FAR AWAY
+AL GND
+AH 4500ft AMSL
+DP 59:00:00 N 009:00:00 E
+DP 59:00:00 N 009:10:00 E
+DP 59:05:00 N 009:10:00 E
+DP 59:05:00 N 009:00:00 E
+
+AC R
+AN SECTOR
+AL 1000m
+AH UNL
+V D=+
+V X=60:00:00 N 010:00:00 E
+DP 60:00:00 N 010:00:00 E
+DA 5,0,90
+`
+
+func TestParseOpenAir(t *testing.T) {
+	parsed, err := parseOpenAir(testOpenAir)
+	if err != nil || len(parsed) != 3 {
+		t.Fatalf("parsed %d airspaces, %v", len(parsed), err)
+	}
+	ctr, far, sector := parsed[0], parsed[1], parsed[2]
+	if ctr.Name != "GJOVIK CTR" || ctr.Class != "C" || math.Abs(ctr.Lower.Metres-457.2) > 0.1 || !ctr.Upper.FlightLevel || math.Abs(ctr.Upper.Metres-2895.6) > 0.1 {
+		t.Errorf("CTR %+v", ctr)
+	}
+	if !far.Lower.Ground || len(far.Polygon) != 4 || !far.contains(59.02, 9.05) || far.contains(59.02, 9.2) {
+		t.Errorf("polygon %+v", far)
+	}
+	if !sector.Upper.Unlimited || sector.Lower.Metres != 1000 {
+		t.Errorf("sector limits %+v, %+v", sector.Lower, sector.Upper)
+	}
+	// North-east of the centre is inside, south-west is not
+	if !sector.contains(60.02, 10.04) || sector.contains(59.98, 9.96) {
+		t.Error("arc sector has the wrong shape")
+	}
+	if !ctr.contains(60.7956, 10.6933) || ctr.contains(60.8139, 10.732) {
+		t.Error("circle has the wrong shape")
+	}
+
+	for _, bad := range []string{"AC C\nDP 60:00:00 X 010:00:00 E\n", "AC C\nDA 5,0\n"} {
+		if _, err := parseOpenAir(bad); err == nil {
+			t.Errorf("parsed %q", bad)
+		}
+	}
+}
+
+func TestParseAltitude(t *testing.T) {
+	tests := []struct {
+		text  string
+		limit altitudeLimit
+	}{
+		{"2500ft MSL", altitudeLimit{Metres: 762}},
+		{"1500m", altitudeLimit{Metres: 1500}},
+		{"1000ft AGL", altitudeLimit{Metres: 304.8, AboveGround: true}},
+		{"300m AGND", altitudeLimit{Metres: 300, AboveGround: true}},
+		{"500ft SFC", altitudeLimit{Metres: 152.4, AboveGround: true}},
+		{"0ft AGL", altitudeLimit{Ground: true}},
+		{"SFC", altitudeLimit{Ground: true}},
+	}
+	for _, test := range tests {
+		limit, err := parseAltitude(test.text)
+		limit.Text = ""
+		if err != nil || math.Abs(limit.Metres-test.limit.Metres) > 0.01 {
+			t.Errorf("%q parsed as %+v, %v", test.text, limit, err)
+		}
+		limit.Metres = test.limit.Metres
+		if limit != test.limit {
+			t.Errorf("%q parsed as %+v, want %+v", test.text, limit, test.limit)
+		}
+	}
+	for _, bad := range []string{"high", "3500ft STD"} {
+		if _, err := parseAltitude(bad); err == nil {
+			t.Errorf("parsed %q", bad)
+		}
+	}
+}
+
+func TestAirspaceAboveGround(t *testing.T) {
+	track, err := igc.Parse(string(readTestData(t, "sample.igc")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first limit is unknown, so only that airspace is left out
+	parsed, err := parseOpenAir(`AC C
+AN STANDARD
+AL 3500ft STD
+AH FL95
+DP 59:00:00 N 009:00:00 E
+DP 59:00:00 N 009:10:00 E
+DP 59:05:00 N 009:10:00 E
+
+AC D
+AN GJOVIK TMZ
+AL 1000ft AGL
+AH FL95
+V X=60:47:44 N 010:41:36 E
+DC 0.5
+`)
+	if err != nil || len(parsed) != 1 || parsed[0].Name != "GJOVIK TMZ" {
+		t.Fatalf("parsed %+v, %v", parsed, err)
+	}
+
+	// The floor above ground is not checked, so the flight may have been
+	// below it
+	index := newAirspaceIndex()
+	index.load("agl.txt", "AC D\nAN GJOVIK TMZ\nAL 1000ft AGL\nAH FL95\nV X=60:47:44 N 010:41:36 E\nDC 0.5\n")
+	violations := index.check(track)
+	if len(violations) != 1 || !violations[0].Unverified || violations[0].Lower != "1000ft AGL" {
+		t.Errorf("violations %+v", violations)
+	}
+}
+
+func TestAirspaceCheck(t *testing.T) {
+	track, err := igc.Parse(string(readTestData(t, "sample.igc")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := newAirspaceIndex()
+	if _, err := index.load("test.txt", testOpenAir); err != nil {
+		t.Fatal(err)
+	}
+
+	// The thermal climbs to 608m on the standard pressure altitude
+	violations := index.check(track)
+	if len(violations) != 1 || violations[0].Airspace != "GJOVIK CTR" {
+		t.Fatalf("violations %+v", violations)
+	}
+	violation := violations[0]
+	if violation.Altitude != 608 || violation.Penetration <= 0 || !violation.Entry.Before(violation.Exit) {
+		t.Errorf("violation %+v", violation)
+	}
+
+	// With a higher QNH the same pressure altitude is higher above the sea
+	defer func(qnh float64) { airspaceQNH = qnh }(airspaceQNH)
+	airspaceQNH = 1030
+	higher := index.check(track)
+	if len(higher) != 1 || !higher[0].Entry.Before(violation.Entry) || higher[0].Altitude <= violation.Altitude {
+		t.Errorf("with QNH 1030 %+v", higher)
+	}
+
+	if empty := newAirspaceIndex().check(track); len(empty) != 0 {
+		t.Errorf("violations without airspace %+v", empty)
+	}
+}
+
+func TestAirspaceHandler(t *testing.T) {
+	setupMemStores(t)
+	defer airspaces.clear()
+	defer func(dir string) { airspaceDir = dir }(airspaceDir)
+	upload := func(name, content string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		adminAirspace(w, httptest.NewRequest("POST", "/UnexpectedURL/admin/api/airspace?name="+name, strings.NewReader(content)))
+		return w
+	}
+
+	// Uploads would be lost without a directory
+	airspaceDir = ""
+	if w := upload("test.txt", testOpenAir); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("upload without AIRSPACE_DIR gave %d, want 503", w.Code)
+	}
+	airspaceDir = t.TempDir()
+	if w := upload("test.txt", testOpenAir); w.Code != http.StatusOK || w.Body.String() != "3" {
+		t.Fatalf("airspace upload gave %d %q", w.Code, w.Body.String())
+	}
+	// A file of the same name is replaced, and names can't leave the directory
+	if w := upload("test.txt", testOpenAir); w.Code != http.StatusOK || len(airspaces.airspaces) != 3 {
+		t.Errorf("second upload gave %d, %d airspaces loaded", w.Code, len(airspaces.airspaces))
+	}
+	if w := upload("../other", testOpenAir); w.Code != http.StatusOK {
+		t.Errorf("upload of other gave %d", w.Code)
+	}
+	if names, _, _ := airspaceFiles(airspaceDir); len(names) != 2 || filepath.Base(names[0]) != "other.txt" {
+		t.Errorf("files in the directory %v", names)
+	}
+
+	// After a restart, or on another replica
+	restarted := newAirspaceIndex()
+	if err := restarted.loadDir(airspaceDir); err != nil || len(restarted.airspaces) != 6 || restarted.version != airspaces.version {
+		t.Errorf("loaded %d airspaces again, %v", len(restarted.airspaces), err)
+	}
+	w := httptest.NewRecorder()
+	adminAirspace(w, httptest.NewRequest("DELETE", "/UnexpectedURL/admin/api/airspace", nil))
+	if names, _, _ := airspaceFiles(airspaceDir); w.Code != http.StatusOK || len(names) != 0 || len(airspaces.airspaces) != 0 {
+		t.Errorf("DELETE gave %d and left %v", w.Code, names)
+	}
+	upload("test.txt", testOpenAir)
+
+	id := postIGC(t, readTestData(t, "sample.igc"))
+	w = httptest.NewRecorder()
+	airspaceHandler(w, httptest.NewRequest("GET", "/paragliding/api/track/"+id+"/airspace", nil))
+	var violations []Violation
+	if err := json.Unmarshal(w.Body.Bytes(), &violations); err != nil || len(violations) != 1 {
+		t.Errorf("GET airspace gave %d %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	adminAirspace(w, httptest.NewRequest("POST", "/UnexpectedURL/admin/api/airspace", strings.NewReader("AC C\nDA 5,0\n")))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("upload of a broken file gave %d, want 400", w.Code)
+	}
+}
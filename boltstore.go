@@ -0,0 +1,574 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Stores backed by a single embedded BoltDB file, for running without Mongo.
+// Documents are stored as JSON, keyed by their ID.
+
+var trackBucket = []byte("tracks")
+var webhookBucket = []byte("webhooks")
+var taskBucket = []byte("tasks")
+var igcBucket = []byte("igc")
+var trackHashBucket = []byte("track_hashes") // canonical hash -> track id
+var trackOrderBucket = []byte("track_order") // TimeStamp -> track id
+var sequenceBucket = []byte("sequences")     // bucket name -> last number handed out
+var deliveryBucket = []byte("webhook_deliveries")
+var jobBucket = []byte("jobs")
+
+// boltFile is shared by all the stores, since a bolt file can
+// only be opened once per process
+type boltFile struct {
+	Path string
+
+	mutex sync.Mutex
+	db    *bolt.DB
+}
+
+type trackBoltDB struct {
+	file *boltFile
+}
+
+type webhookBoltDB struct {
+	file *boltFile
+}
+
+type taskBoltDB struct {
+	file *boltFile
+}
+
+// Opens the database file the first time it is needed
+func (f *boltFile) open() (*bolt.DB, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.db != nil {
+		return f.db, nil
+	}
+
+	db, err := bolt.Open(f.Path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{trackBucket, webhookBucket, taskBucket, igcBucket, trackHashBucket, trackOrderBucket, sequenceBucket, deliveryBucket, jobBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	f.db = db
+	return db, nil
+}
+
+// Runs fn in a read-write transaction
+func (f *boltFile) update(fn func(tx *bolt.Tx) error) error {
+	db, err := f.open()
+	if err != nil {
+		return err
+	}
+	return db.Update(fn)
+}
+
+// Runs fn in a read-only transaction
+func (f *boltFile) view(fn func(tx *bolt.Tx) error) error {
+	db, err := f.open()
+	if err != nil {
+		return err
+	}
+	return db.View(fn)
+}
+
+// Stores value as JSON under key in the given bucket, unless the key is taken
+func (f *boltFile) put(bucket []byte, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return f.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b.Get([]byte(key)) != nil {
+			return ErrDuplicate
+		}
+		return b.Put([]byte(key), data)
+	})
+}
+
+// Stores value as JSON under key in the given bucket, in place of what is
+// there already
+func (f *boltFile) replace(bucket []byte, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return f.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b.Get([]byte(key)) == nil {
+			return ErrNotFound
+		}
+		return b.Put([]byte(key), data)
+	})
+}
+
+// Decodes the JSON stored under key into value
+func (f *boltFile) get(bucket []byte, key string, value interface{}) error {
+	return f.view(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucket).Get([]byte(key))
+		if data == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(data, value)
+	})
+}
+
+func (f *boltFile) count(bucket []byte) (int, error) {
+	count := 0
+	err := f.view(func(tx *bolt.Tx) error {
+		count = bucketSize(tx.Bucket(bucket))
+		return nil
+	})
+	return count, err
+}
+
+// Hands out the next number of the sequence for bucket. The sequences are
+// kept apart from the buckets, so they survive the buckets being emptied.
+// A new sequence continues after the highest id already in the bucket.
+func (f *boltFile) nextSequence(bucket []byte) (int, error) {
+	next := 0
+	err := f.update(func(tx *bolt.Tx) error {
+		sequences := tx.Bucket(sequenceBucket)
+		if last := sequences.Get(bucket); last != nil {
+			next = int(binary.BigEndian.Uint64(last)) + 1
+		} else {
+			tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+				if n := idNumber(string(k)); n > next {
+					next = n
+				}
+				return nil
+			})
+			next++
+		}
+
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, uint64(next))
+		return sequences.Put(bucket, value)
+	})
+	return next, err
+}
+
+// Number of keys in the bucket
+func bucketSize(bucket *bolt.Bucket) int {
+	count := 0
+	bucket.ForEach(func(k, v []byte) error {
+		count++
+		return nil
+	})
+	return count
+}
+
+func (db *trackBoltDB) Init() error {
+	_, err := db.file.open()
+	return err
+}
+
+func (db *webhookBoltDB) Init() error {
+	_, err := db.file.open()
+	return err
+}
+
+func (db *trackBoltDB) Add(s Track) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return db.file.update(func(tx *bolt.Tx) error {
+		tracks := tx.Bucket(trackBucket)
+		if tracks.Get([]byte(s.ID)) != nil {
+			return ErrDuplicate
+		}
+		if s.ContentHash != "" {
+			hashes := tx.Bucket(trackHashBucket)
+			if hashes.Get([]byte(s.ContentHash)) != nil {
+				return ErrDuplicate
+			}
+			if err := hashes.Put([]byte(s.ContentHash), []byte(s.ID)); err != nil {
+				return err
+			}
+		}
+		if s.TimeStamp != "" {
+			if err := tx.Bucket(trackOrderBucket).Put([]byte(s.TimeStamp), []byte(s.ID)); err != nil {
+				return err
+			}
+		}
+		return tracks.Put([]byte(s.ID), data)
+	})
+}
+
+func (db *webhookBoltDB) Add(s Webhook) error {
+	return db.file.put(webhookBucket, s.ID, s)
+}
+
+func (db *trackBoltDB) Count() (int, error) {
+	return db.file.count(trackBucket)
+}
+
+func (db *webhookBoltDB) Count() (int, error) {
+	return db.file.count(webhookBucket)
+}
+
+func (db *trackBoltDB) Get(keyID string) (Track, error) {
+	track := Track{}
+	err := db.file.get(trackBucket, keyID, &track)
+	return track, err
+}
+
+func (db *trackBoltDB) FindByHash(hash string) (Track, error) {
+	track := Track{}
+	err := db.file.view(func(tx *bolt.Tx) error {
+		id := tx.Bucket(trackHashBucket).Get([]byte(hash))
+		if id == nil {
+			return ErrNotFound
+		}
+		data := tx.Bucket(trackBucket).Get(id)
+		if data == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(data, &track)
+	})
+	return track, err
+}
+
+func (db *trackBoltDB) NextSequence() (int, error) {
+	return db.file.nextSequence(trackBucket)
+}
+
+func (db *webhookBoltDB) NextSequence() (int, error) {
+	return db.file.nextSequence(webhookBucket)
+}
+
+func (db *trackBoltDB) List(after bson.ObjectId, limit int) ([]Track, error) {
+	tracks := []Track{}
+	err := db.file.view(func(tx *bolt.Tx) error {
+		data := tx.Bucket(trackBucket)
+		cursor := tx.Bucket(trackOrderBucket).Cursor()
+
+		k, id := cursor.First()
+		if after != "" {
+			k, id = cursor.Seek([]byte(after))
+			if k != nil && string(k) == string(after) {
+				k, id = cursor.Next()
+			}
+		}
+		for ; k != nil && (limit == 0 || len(tracks) < limit); k, id = cursor.Next() {
+			track := Track{}
+			if err := json.Unmarshal(data.Get(id), &track); err != nil {
+				return err
+			}
+			tracks = append(tracks, track)
+		}
+		return nil
+	})
+	return tracks, err
+}
+
+func (db *trackBoltDB) Latest() (Track, error) {
+	track := Track{}
+	err := db.file.view(func(tx *bolt.Tx) error {
+		_, id := tx.Bucket(trackOrderBucket).Cursor().Last()
+		if id == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(tx.Bucket(trackBucket).Get(id), &track)
+	})
+	return track, err
+}
+
+// Bolt has no indexes on the fields, so all tracks are read and filtered
+func (db *trackBoltDB) Find(q TrackQuery) ([]Track, error) {
+	tracks := []Track{}
+	err := db.file.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(trackBucket).ForEach(func(k, v []byte) error {
+			track := Track{}
+			if err := json.Unmarshal(v, &track); err != nil {
+				return err
+			}
+			tracks = append(tracks, track)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return q.apply(tracks), nil
+}
+
+func (db *webhookBoltDB) List() ([]Webhook, error) {
+	hooks := []Webhook{}
+	err := db.file.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(webhookBucket).ForEach(func(k, v []byte) error {
+			hook := Webhook{}
+			if err := json.Unmarshal(v, &hook); err != nil {
+				return err
+			}
+			hooks = append(hooks, hook)
+			return nil
+		})
+	})
+	sort.Slice(hooks, func(i, j int) bool {
+		return idNumber(hooks[i].ID) < idNumber(hooks[j].ID)
+	})
+	return hooks, err
+}
+
+func (db *webhookBoltDB) Get(keyID string) (Webhook, error) {
+	hook := Webhook{}
+	err := db.file.get(webhookBucket, keyID, &hook)
+	return hook, err
+}
+
+func (db *trackBoltDB) Delete() (int, error) {
+	count := 0
+	err := db.file.update(func(tx *bolt.Tx) error {
+		count = bucketSize(tx.Bucket(trackBucket))
+		for _, bucket := range [][]byte{trackBucket, igcBucket, trackHashBucket, trackOrderBucket} {
+			if err := tx.DeleteBucket(bucket); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (db *trackBoltDB) AddIGC(keyID string, content []byte) error {
+	return db.file.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(igcBucket)
+		if bucket.Get([]byte(keyID)) != nil {
+			return ErrDuplicate
+		}
+		return bucket.Put([]byte(keyID), content)
+	})
+}
+
+func (db *trackBoltDB) GetIGC(keyID string) ([]byte, error) {
+	var content []byte
+	err := db.file.view(func(tx *bolt.Tx) error {
+		data := tx.Bucket(igcBucket).Get([]byte(keyID))
+		if data == nil {
+			return ErrNotFound
+		}
+		// data is only valid during the transaction
+		content = append([]byte(nil), data...)
+		return nil
+	})
+	return content, err
+}
+
+func (db *trackBoltDB) DeleteIGC(keyID string) error {
+	return db.file.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(igcBucket)
+		if bucket.Get([]byte(keyID)) == nil {
+			return ErrNotFound
+		}
+		return bucket.Delete([]byte(keyID))
+	})
+}
+
+func (db *webhookBoltDB) Delete(keyID string) error {
+	return db.file.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(webhookBucket)
+		if bucket.Get([]byte(keyID)) == nil {
+			return ErrNotFound
+		}
+		return bucket.Delete([]byte(keyID))
+	})
+}
+
+func (db *webhookBoltDB) Update(s Webhook) error {
+	return db.file.replace(webhookBucket, s.ID, s)
+}
+
+func (db *trackBoltDB) AddJob(j Job) error {
+	return db.file.put(jobBucket, j.ID, j)
+}
+
+func (db *trackBoltDB) UpdateJob(j Job) error {
+	return db.file.replace(jobBucket, j.ID, j)
+}
+
+func (db *trackBoltDB) GetJob(keyID string) (Job, error) {
+	job := Job{}
+	err := db.file.get(jobBucket, keyID, &job)
+	return job, err
+}
+
+// The keys are ObjectIds, so the bucket is in the order of creation
+func (db *trackBoltDB) FindJobs(instance string, status string) ([]Job, error) {
+	jobs := []Job{}
+	err := db.file.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobBucket).ForEach(func(k, v []byte) error {
+			job := Job{}
+			if err := json.Unmarshal(v, &job); err != nil {
+				return err
+			}
+			if (instance == "" || job.Instance == instance) && (status == "" || job.Status == status) {
+				jobs = append(jobs, job)
+			}
+			return nil
+		})
+	})
+	return jobs, err
+}
+
+func (db *trackBoltDB) DeleteJobs(before time.Time) (int, error) {
+	count := 0
+	err := db.file.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(jobBucket)
+		old := [][]byte{}
+		err := bucket.ForEach(func(k, v []byte) error {
+			job := Job{}
+			if err := json.Unmarshal(v, &job); err != nil {
+				return err
+			}
+			if job.Updated.Before(before) {
+				old = append(old, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// Deleting while iterating skips keys
+		for _, k := range old {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		count = len(old)
+		return nil
+	})
+	return count, err
+}
+
+func (db *webhookBoltDB) AddDelivery(d Delivery) error {
+	return db.file.put(deliveryBucket, d.ID, d)
+}
+
+func (db *webhookBoltDB) UpdateDelivery(d Delivery) error {
+	return db.file.replace(deliveryBucket, d.ID, d)
+}
+
+// The keys are ObjectIds, so the bucket is in the order of creation
+func (db *webhookBoltDB) FindDeliveries(webhookID string, status string) ([]Delivery, error) {
+	deliveries := []Delivery{}
+	err := db.file.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(deliveryBucket).ForEach(func(k, v []byte) error {
+			delivery := Delivery{}
+			if err := json.Unmarshal(v, &delivery); err != nil {
+				return err
+			}
+			if (webhookID == "" || delivery.WebhookID == webhookID) && (status == "" || delivery.Status == status) {
+				deliveries = append(deliveries, delivery)
+			}
+			return nil
+		})
+	})
+	return deliveries, err
+}
+
+func (db *taskBoltDB) Init() error {
+	_, err := db.file.open()
+	return err
+}
+
+func (db *taskBoltDB) Add(s Task) error {
+	return db.file.put(taskBucket, s.ID, s)
+}
+
+func (db *taskBoltDB) Count() (int, error) {
+	return db.file.count(taskBucket)
+}
+
+func (db *taskBoltDB) Get(keyID string) (Task, error) {
+	task := Task{}
+	err := db.file.get(taskBucket, keyID, &task)
+	return task, err
+}
+
+func (db *taskBoltDB) AddTrack(taskID string, trackID string) (Task, error) {
+	task := Task{}
+	err := db.file.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(taskBucket)
+		data := bucket.Get([]byte(taskID))
+		if data == nil {
+			return ErrNotFound
+		}
+		if err := json.Unmarshal(data, &task); err != nil {
+			return err
+		}
+		for _, submitted := range task.Tracks {
+			if submitted == trackID {
+				return ErrDuplicate
+			}
+		}
+		task.Tracks = append(task.Tracks, trackID)
+		data, err := json.Marshal(task)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(taskID), data)
+	})
+	return task, err
+}
+
+func (db *taskBoltDB) NextSequence() (int, error) {
+	return db.file.nextSequence(taskBucket)
+}
+
+func (db *taskBoltDB) List() ([]Task, error) {
+	tasks := []Task{}
+	err := db.file.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(taskBucket).ForEach(func(k, v []byte) error {
+			task := Task{}
+			if err := json.Unmarshal(v, &task); err != nil {
+				return err
+			}
+			tasks = append(tasks, task)
+			return nil
+		})
+	})
+	sort.Slice(tasks, func(i, j int) bool {
+		return idNumber(tasks[i].ID) < idNumber(tasks[j].ID)
+	})
+	return tasks, err
+}
+
+func (db *taskBoltDB) Delete(keyID string) error {
+	return db.file.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(taskBucket)
+		if bucket.Get([]byte(keyID)) == nil {
+			return ErrNotFound
+		}
+		return bucket.Delete([]byte(keyID))
+	})
+}
@@ -1,83 +1,800 @@
 package main
 
 import "testing"
+import "bytes"
+import "crypto/sha256"
+import "encoding/hex"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io"
 import "gopkg.in/mgo.v2"
 import "gopkg.in/mgo.v2/bson"
+import "net"
+import "path/filepath"
+import "reflect"
+import "strconv"
+import "sync"
 import "time"
 
 func setupDB(t *testing.T) *trackDB {
 	db := trackDB{
-		"mongodb://localhost",
-		"testtrackdb",
-		"tracks",
+		mongoSession:        &mongoSession{HostURL: "mongodb://localhost", Config: defaultMongoConfig},
+		DatabaseName:        "testtrackdb",
+		TrackCollectionName: "tracks",
 	}
 
-	session, err := mgo.Dial(db.HostURL)
-	defer session.Close()
+	session, err := mgo.DialWithTimeout(db.HostURL, time.Second)
 	if err != nil {
-		t.Error(err)
+		t.Skip("no MongoDB available: ", err)
 	}
+	defer session.Close()
 
 	return &db
 }
 
 func tearDownDB(t *testing.T, db *trackDB) {
-	session, err := mgo.Dial(db.HostURL)
-	defer session.Close()
+	session, err := db.copy()
 	if err != nil {
 		t.Error(err)
+		return
 	}
+	defer db.Close()
+	defer session.Close()
 
-	session.DB(db.DatabaseName).DropDatabase()
+	err = session.DB(db.DatabaseName).DropDatabase()
 	if err != nil {
 		t.Error(err)
 	}
 }
 
-func TestTrackDB_Add(t *testing.T) {
-	db := setupDB(t)
-	defer tearDownDB(t, db)
+func setupBoltDB(t *testing.T) (*trackBoltDB, *webhookBoltDB) {
+	file := &boltFile{Path: filepath.Join(t.TempDir(), "test.db")}
+	t.Cleanup(func() {
+		if file.db != nil {
+			file.db.Close()
+		}
+	})
+	return &trackBoltDB{file}, &webhookBoltDB{file}
+}
 
-	db.Init()
-	if db.Count() != 0 {
+// Count that fails the test on error
+func mustCount(t *testing.T, db interface{ Count() (int, error) }) int {
+	count, err := db.Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func testTrackStoreAdd(t *testing.T, db TrackStore) {
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if mustCount(t, db) != 0 {
 		t.Error("database not properly initialized. track Count() should be 0")
 	}
 
-	track := Track{"test", time.Now(), "Gerd", "Glider1", "123Glider", 5, "some line", bson.NewObjectIdWithTime(time.Now()),}
-	db.Add(track)
+	track := Track{
+		ID:          "test",
+		HDate:       time.Now(),
+		Pilot:       "Gerd",
+		Glider:      "Glider1",
+		GliderID:    "123Glider",
+		TrackLength: 5,
+		URL:         "some line",
+		TimeStamp:   bson.NewObjectId(),
+	}
+	if err := db.Add(track); err != nil {
+		t.Error(err)
+	}
 
-	if db.Count() != 1 {
+	if mustCount(t, db) != 1 {
 		t.Error("adding new student failed!")
 	}
-}
 
-func TestTrackDB_Get(t *testing.T) {
-	db := setupDB(t)
-	defer tearDownDB(t, db)
+	if err := db.Add(track); err != ErrDuplicate {
+		t.Errorf("adding the same track twice gave %v, want ErrDuplicate", err)
+	}
+}
 
-	db.Init()
-	if db.Count() != 0 {
+func testTrackStoreGet(t *testing.T, db TrackStore) {
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if mustCount(t, db) != 0 {
 		t.Error("database not properly initialized. track Count() should be 0")
 	}
 
-	track := Track{"test", time.Now(), "Gerd", "Glider1", "123Glider", 5, "some line", 	bson.NewObjectIdWithTime(time.Now())}
+	track := Track{
+		ID:          "test",
+		HDate:       time.Now(),
+		Pilot:       "Gerd",
+		Glider:      "Glider1",
+		GliderID:    "123Glider",
+		TrackLength: 5,
+		URL:         "some line",
+		TimeStamp:   bson.NewObjectId(),
+	}
 	db.Add(track)
 
-	if db.Count() != 1 {
+	if mustCount(t, db) != 1 {
 		t.Error("adding new student failed!")
 	}
 
-	newTrack, ok := db.Get(track.ID)
-	if !ok {
+	newTrack, err := db.Get(track.ID)
+	if err != nil {
 		t.Error("Could not get track")
 	}
 
 	if newTrack.Pilot != track.Pilot ||
 		newTrack.Glider != track.Glider ||
 		newTrack.GliderID != track.GliderID ||
-		newTrack.HDate != track.HDate ||
+		!newTrack.HDate.Equal(track.HDate) ||
 		newTrack.URL != track.URL ||
 		newTrack.ID != track.ID {
 		t.Error("tracks do not match")
 	}
+
+	if _, err := db.Get("missing"); err != ErrNotFound {
+		t.Errorf("getting a missing track gave %v, want ErrNotFound", err)
+	}
+}
+
+func testTrackStoreHash(t *testing.T, db TrackStore) {
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	db.Add(Track{ID: "igc1", ContentHash: "abc"})
+	db.Add(Track{ID: "igc2"})
+	db.Add(Track{ID: "igc3"})
+
+	track, err := db.FindByHash("abc")
+	if err != nil || track.ID != "igc1" {
+		t.Errorf("FindByHash() = %v, %v, want igc1", track.ID, err)
+	}
+	if _, err := db.FindByHash("def"); err != ErrNotFound {
+		t.Errorf("FindByHash() of an unknown hash gave %v, want ErrNotFound", err)
+	}
+	if err := db.Add(Track{ID: "igc4", ContentHash: "abc"}); err != ErrDuplicate {
+		t.Errorf("adding a track with a known hash gave %v, want ErrDuplicate", err)
+	}
+}
+
+func testTrackStoreOrder(t *testing.T, db TrackStore) {
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Latest(); err != ErrNotFound {
+		t.Errorf("Latest() of an empty store gave %v, want ErrNotFound", err)
+	}
+
+	// Ids don't follow the order the tracks were added in
+	ids := []string{"igc7", "igc2", "igc30", "igc4"}
+	stamps := []bson.ObjectId{}
+	for _, id := range ids {
+		stamp := bson.NewObjectId()
+		stamps = append(stamps, stamp)
+		db.Add(Track{ID: id, TimeStamp: stamp})
+	}
+
+	tracks, err := db.List("", 0)
+	if err != nil || len(tracks) != 4 {
+		t.Fatalf("List() gave %d tracks, %v", len(tracks), err)
+	}
+	for i, track := range tracks {
+		if track.ID != ids[i] {
+			t.Errorf("List()[%d] = %v, want %v", i, track.ID, ids[i])
+		}
+	}
+
+	tracks, _ = db.List(stamps[0], 2)
+	if len(tracks) != 2 || tracks[0].ID != "igc2" || tracks[1].ID != "igc30" {
+		t.Errorf("List(after igc7, 2) = %v", tracks)
+	}
+	tracks, _ = db.List(stamps[3], 0)
+	if len(tracks) != 0 {
+		t.Errorf("List(after the last track) gave %d tracks", len(tracks))
+	}
+
+	latest, err := db.Latest()
+	if err != nil || latest.ID != "igc4" {
+		t.Errorf("Latest() = %v, %v, want igc4", latest.ID, err)
+	}
+}
+
+func testTrackStoreFind(t *testing.T, db TrackStore) {
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	day := time.Date(2018, 9, 2, 0, 0, 0, 0, time.UTC)
+	tracks := []Track{
+		{ID: "igc1", Pilot: "Anne", Glider: "Rush", HDate: day, TrackLength: 40},
+		{ID: "igc2", Pilot: "Bob", Glider: "Rush", HDate: day.AddDate(0, 0, 1), TrackLength: 10},
+		{ID: "igc3", Pilot: "Anne", Glider: "Mentor", HDate: day.AddDate(0, 0, 2), TrackLength: 40, Validation: validationValid},
+		{ID: "igc4", Pilot: "Carl", Glider: "Mentor", HDate: day.AddDate(0, 0, 3), TrackLength: 25},
+	}
+	for _, track := range tracks {
+		track.TimeStamp = bson.NewObjectId()
+		if err := db.Add(track); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ids := func(tracks []Track) string {
+		s := ""
+		for _, track := range tracks {
+			s += track.ID + " "
+		}
+		return s
+	}
+	tests := []struct {
+		query TrackQuery
+		want  string
+	}{
+		{TrackQuery{}, "igc1 igc2 igc3 igc4 "},
+		{TrackQuery{Pilot: "Anne"}, "igc1 igc3 "},
+		{TrackQuery{Glider: "Mentor", MinLength: 30}, "igc3 "},
+		{TrackQuery{From: day.AddDate(0, 0, 1), To: day.AddDate(0, 0, 2)}, "igc2 igc3 "},
+		{TrackQuery{Validation: validationValid}, "igc3 "},
+		{TrackQuery{SortBy: sortTrackLength}, "igc2 igc4 igc1 igc3 "},
+		{TrackQuery{SortBy: sortTrackLength, Desc: true}, "igc3 igc1 igc4 igc2 "},
+		{TrackQuery{SortBy: sortHDate, Desc: true, Limit: 2}, "igc4 igc3 "},
+		{TrackQuery{Desc: true}, "igc4 igc3 igc2 igc1 "},
+	}
+	for _, test := range tests {
+		found, err := db.Find(test.query)
+		if err != nil || ids(found) != test.want {
+			t.Errorf("Find(%+v) = %q, %v, want %q", test.query, ids(found), err, test.want)
+		}
+	}
+
+	// Paging through with cursors gives every track once, in order
+	for _, sortBy := range []string{sortTimeStamp, sortHDate, sortTrackLength} {
+		for _, desc := range []bool{false, true} {
+			q := TrackQuery{SortBy: sortBy, Desc: desc}
+			all, _ := db.Find(q)
+			paged := []Track{}
+			q.Limit = 1
+			for {
+				page, err := db.Find(q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(page) == 0 {
+					break
+				}
+				paged = append(paged, page...)
+				q.After = cursorOf(page[len(page)-1])
+			}
+			if ids(paged) != ids(all) {
+				t.Errorf("paging by %v (desc %v) gave %q, want %q", sortBy, desc, ids(paged), ids(all))
+			}
+		}
+	}
+}
+
+func testTrackStoreSequence(t *testing.T, db TrackStore) {
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	first, err := db.NextSequence()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Add(Track{ID: "igc" + strconv.Itoa(first)})
+	db.Delete()
+
+	second, err := db.NextSequence()
+	if err != nil || second <= first {
+		t.Errorf("NextSequence() after Delete() = %d, %v, want more than %d", second, err, first)
+	}
+}
+
+func testTrackStoreDelete(t *testing.T, db TrackStore) {
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	db.Add(Track{ID: "igc1"})
+	db.Add(Track{ID: "igc2"})
+
+	count, err := db.Delete()
+	if err != nil || count != 2 {
+		t.Errorf("Delete() = %d, %v, want 2, nil", count, err)
+	}
+	if mustCount(t, db) != 0 {
+		t.Error("tracks left after Delete()")
+	}
+}
+
+func testTrackStoreIGC(t *testing.T, db TrackStore) {
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("AXXXABC\r\nHFDTE020918\r\n")
+	if err := db.AddIGC("igc1", content); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddIGC("igc1", content); err != ErrDuplicate {
+		t.Errorf("adding the same file twice gave %v, want ErrDuplicate", err)
+	}
+
+	stored, err := db.GetIGC("igc1")
+	if err != nil || !bytes.Equal(stored, content) {
+		t.Errorf("GetIGC() = %q, %v, want %q", stored, err, content)
+	}
+	if _, err := db.GetIGC("igc2"); err != ErrNotFound {
+		t.Errorf("getting a missing file gave %v, want ErrNotFound", err)
+	}
+
+	db.AddIGC("igc2", content)
+	if err := db.DeleteIGC("igc2"); err != nil {
+		t.Error(err)
+	}
+	if _, err := db.GetIGC("igc2"); err != ErrNotFound {
+		t.Errorf("file left after DeleteIGC(), got %v", err)
+	}
+	if err := db.DeleteIGC("igc2"); err != ErrNotFound {
+		t.Errorf("deleting a missing file gave %v, want ErrNotFound", err)
+	}
+
+	db.Delete()
+	if _, err := db.GetIGC("igc1"); err != ErrNotFound {
+		t.Errorf("file left after Delete(), got %v", err)
+	}
+}
+
+func testTrackStoreJobs(t *testing.T, db TrackStore) {
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().UTC().Add(-2 * time.Hour).Truncate(time.Millisecond)
+	stored := []Job{
+		{ID: bson.NewObjectId().Hex(), Instance: "a", Status: jobDone, Created: old, Updated: old},
+		{ID: bson.NewObjectId().Hex(), Instance: "a", Status: jobQueued, Created: old, Updated: old.Add(time.Hour)},
+		{ID: bson.NewObjectId().Hex(), Instance: "b", Status: jobQueued, Created: old, Updated: old.Add(time.Hour)},
+	}
+	for _, job := range stored {
+		if err := db.AddJob(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.AddJob(stored[0]); err != ErrDuplicate {
+		t.Errorf("adding a job twice gave %v, want ErrDuplicate", err)
+	}
+
+	stored[1].Status, stored[1].TrackID = jobDone, "igc1"
+	if err := db.UpdateJob(stored[1]); err != nil {
+		t.Error(err)
+	}
+	if job, err := db.GetJob(stored[1].ID); err != nil || job.Status != jobDone || job.TrackID != "igc1" || !job.Updated.Equal(stored[1].Updated) {
+		t.Errorf("GetJob() = %+v, %v", job, err)
+	}
+	if err := db.UpdateJob(Job{ID: "missing"}); err != ErrNotFound {
+		t.Errorf("updating a missing job gave %v, want ErrNotFound", err)
+	}
+	if _, err := db.GetJob("missing"); err != ErrNotFound {
+		t.Errorf("getting a missing job gave %v, want ErrNotFound", err)
+	}
+
+	if jobs, err := db.FindJobs("a", ""); err != nil || len(jobs) != 2 || jobs[0].ID != stored[0].ID {
+		t.Errorf("jobs of a: %+v, %v", jobs, err)
+	}
+	if jobs, err := db.FindJobs("", jobQueued); err != nil || len(jobs) != 1 || jobs[0].Instance != "b" {
+		t.Errorf("queued jobs: %+v, %v", jobs, err)
+	}
+
+	if n, err := db.DeleteJobs(old.Add(time.Minute)); err != nil || n != 1 {
+		t.Errorf("DeleteJobs() = %d, %v, want 1", n, err)
+	}
+	if _, err := db.GetJob(stored[0].ID); err != ErrNotFound {
+		t.Errorf("old job left after DeleteJobs(), got %v", err)
+	}
+}
+
+func testWebhookStore(t *testing.T, db WebhookStore) {
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	hook := Webhook{ID: "1", URL: "http://example.com/hook", Value: 2, Events: []string{eventTrackCreated}}
+	if err := db.Add(hook); err != nil {
+		t.Error(err)
+	}
+
+	if mustCount(t, db) != 1 {
+		t.Error("adding new webhook failed!")
+	}
+
+	newHook, err := db.Get(hook.ID)
+	if err != nil || !reflect.DeepEqual(newHook, hook) {
+		t.Error("webhooks do not match")
+	}
+
+	db.Add(Webhook{ID: "10", URL: "http://example.com/other"})
+	hooks, err := db.List()
+	if err != nil || len(hooks) != 2 || hooks[0].ID != "1" || hooks[1].ID != "10" {
+		t.Errorf("List() = %v, %v", hooks, err)
+	}
+	db.Delete("10")
+
+	hook.Value = 3
+	if err := db.Update(hook); err != nil {
+		t.Error(err)
+	}
+	if updated, err := db.Get(hook.ID); err != nil || updated.Value != 3 || mustCount(t, db) != 1 {
+		t.Errorf("Get() after Update() = %+v, %v", updated, err)
+	}
+	if err := db.Update(Webhook{ID: "99"}); err != ErrNotFound {
+		t.Errorf("updating a missing webhook gave %v, want ErrNotFound", err)
+	}
+
+	first := Delivery{ID: bson.NewObjectId().Hex(), WebhookID: "1", Payload: json.RawMessage(`{"text":1}`), Status: deliveryPending}
+	second := Delivery{ID: bson.NewObjectId().Hex(), WebhookID: "10", Payload: json.RawMessage(`{}`), Status: deliveryPending}
+	for _, delivery := range []Delivery{first, second} {
+		if err := db.AddDelivery(delivery); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := db.AddDelivery(first); err != ErrDuplicate {
+		t.Errorf("adding a delivery twice gave %v, want ErrDuplicate", err)
+	}
+	first.Status = deliveryDelivered
+	first.Attempts = []DeliveryAttempt{{StatusCode: 200}}
+	if err := db.UpdateDelivery(first); err != nil {
+		t.Error(err)
+	}
+	if err := db.UpdateDelivery(Delivery{ID: "missing"}); err != ErrNotFound {
+		t.Errorf("updating a missing delivery gave %v, want ErrNotFound", err)
+	}
+	deliveries, err := db.FindDeliveries("", "")
+	if err != nil || len(deliveries) != 2 || deliveries[0].ID != first.ID || deliveries[1].ID != second.ID {
+		t.Errorf("FindDeliveries() = %v, %v", deliveries, err)
+	}
+	deliveries, err = db.FindDeliveries("1", deliveryDelivered)
+	if err != nil || len(deliveries) != 1 || string(deliveries[0].Payload) != `{"text":1}` || len(deliveries[0].Attempts) != 1 {
+		t.Errorf("FindDeliveries(1, delivered) = %v, %v", deliveries, err)
+	}
+	deliveries, err = db.FindDeliveries("", deliveryPending)
+	if err != nil || len(deliveries) != 1 || deliveries[0].ID != second.ID {
+		t.Errorf("FindDeliveries(pending) = %v, %v", deliveries, err)
+	}
+
+	if err := db.Delete(hook.ID); err != nil {
+		t.Error("could not delete webhook")
+	}
+	if err := db.Delete(hook.ID); err != ErrNotFound {
+		t.Errorf("deleting a webhook twice gave %v, want ErrNotFound", err)
+	}
+	if mustCount(t, db) != 0 {
+		t.Error("webhook left after Delete()")
+	}
+}
+
+func testTaskStore(t *testing.T, db TaskStore) {
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	task := Task{
+		ID:    "task1",
+		Name:  "Day 1",
+		Start: TaskPoint{Name: "Start", Lat: 60.79, Lon: 10.69, Radius: 400, Type: taskCylinder},
+		Turnpoints: []TaskPoint{
+			{Name: "TP1", Lat: 60.8, Lon: 10.7, Radius: 400, Type: taskCylinder},
+		},
+		Goal:     TaskPoint{Name: "Goal", Lat: 60.81, Lon: 10.73, Radius: 200, Type: taskLine},
+		Deadline: time.Date(2018, 9, 2, 18, 0, 0, 0, time.UTC),
+	}
+	if err := db.Add(task); err != nil {
+		t.Error(err)
+	}
+	if err := db.Add(task); err != ErrDuplicate {
+		t.Errorf("adding a task twice gave %v, want ErrDuplicate", err)
+	}
+	if mustCount(t, db) != 1 {
+		t.Error("adding new task failed!")
+	}
+
+	stored, err := db.Get(task.ID)
+	if err != nil || stored.Name != task.Name || len(stored.Turnpoints) != 1 || stored.Goal != task.Goal || !stored.Deadline.Equal(task.Deadline) {
+		t.Errorf("Get() = %+v, %v", stored, err)
+	}
+	if _, err := db.Get("task99"); err != ErrNotFound {
+		t.Errorf("Get() of a missing task gave %v, want ErrNotFound", err)
+	}
+
+	db.Add(Task{ID: "task10"})
+	tasks, err := db.List()
+	if err != nil || len(tasks) != 2 || tasks[0].ID != "task1" || tasks[1].ID != "task10" {
+		t.Errorf("List() = %v, %v", tasks, err)
+	}
+	if next, err := db.NextSequence(); err != nil || next < 1 {
+		t.Errorf("NextSequence() = %d, %v", next, err)
+	}
+
+	// Concurrent submissions are all kept
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := db.AddTrack(task.ID, fmt.Sprintf("igc%d", i)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	updated, err := db.AddTrack(task.ID, "igc10")
+	if stored, _ := db.Get(task.ID); err != nil || len(updated.Tracks) != 11 || len(stored.Tracks) != 11 || stored.Name != task.Name {
+		t.Errorf("AddTrack() = %+v, %v, stored %+v", updated, err, stored)
+	}
+	if _, err := db.AddTrack(task.ID, "igc3"); err != ErrDuplicate {
+		t.Errorf("adding a track twice gave %v, want ErrDuplicate", err)
+	}
+	if _, err := db.AddTrack("task99", "igc3"); err != ErrNotFound {
+		t.Errorf("AddTrack() to a missing task gave %v, want ErrNotFound", err)
+	}
+
+	if err := db.Delete(task.ID); err != nil {
+		t.Error("could not delete task")
+	}
+	if err := db.Delete(task.ID); err != ErrNotFound {
+		t.Errorf("deleting a task twice gave %v, want ErrNotFound", err)
+	}
+	if mustCount(t, db) != 1 {
+		t.Error("wrong number of tasks left after Delete()")
+	}
+}
+
+func TestTrackDB_Add(t *testing.T) {
+	db := setupDB(t)
+	defer tearDownDB(t, db)
+
+	testTrackStoreAdd(t, db)
+}
+
+func TestTrackDB_Get(t *testing.T) {
+	db := setupDB(t)
+	defer tearDownDB(t, db)
+
+	testTrackStoreGet(t, db)
+}
+
+func TestTrackDB_IGC(t *testing.T) {
+	db := setupDB(t)
+	defer tearDownDB(t, db)
+
+	testTrackStoreIGC(t, db)
+
+	// GridFS tells the format of the original file
+	gpx := []byte(`<?xml version="1.0"?><gpx version="1.1"></gpx>`)
+	if err := db.AddIGC("igc3", gpx); err != nil {
+		t.Fatal(err)
+	}
+	session, err := db.copy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	file, err := db.gridFS(session).Open("igc3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if file.ContentType() != mediaGPX {
+		t.Errorf("GPX file stored as %v", file.ContentType())
+	}
+}
+
+func TestTrackDB_Jobs(t *testing.T) {
+	db := setupDB(t)
+	defer tearDownDB(t, db)
+
+	testTrackStoreJobs(t, db)
+}
+
+func TestTrackDB_Find(t *testing.T) {
+	db := setupDB(t)
+	defer tearDownDB(t, db)
+
+	testTrackStoreFind(t, db)
+}
+
+func TestTrackDB_InitDuplicates(t *testing.T) {
+	db := setupDB(t)
+	defer tearDownDB(t, db)
+	session, err := db.copy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	// Stored by the counter that started again after a restart
+	tracks := session.DB(db.DatabaseName).C(db.TrackCollectionName)
+	files := map[string][]byte{"first": []byte("first file"), "second": []byte("second file")}
+	for _, track := range []Track{{ID: "igc1", Pilot: "first"}, {ID: "igc2"}, {ID: "igc1", Pilot: "second"}} {
+		if content, ok := files[track.Pilot]; ok {
+			digest := sha256.Sum256(content)
+			track.SHA256 = hex.EncodeToString(digest[:])
+			if err := db.AddIGC(track.ID, content); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tracks.Insert(track); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if track, err := db.Get("igc1"); err != nil || track.Pilot != "first" {
+		t.Errorf("igc1 is %+v, %v", track, err)
+	}
+	if track, err := db.Get("igc3"); err != nil || track.Pilot != "second" {
+		t.Errorf("the duplicate was renumbered to %+v, %v", track, err)
+	}
+	// The original files went along
+	for id, want := range map[string]string{"igc1": "first file", "igc3": "second file"} {
+		if content, err := db.GetIGC(id); err != nil || string(content) != want {
+			t.Errorf("file of %v is %q, %v", id, content, err)
+		}
+	}
+	if err := db.Add(Track{ID: "igc2"}); err != ErrDuplicate {
+		t.Errorf("adding a taken id gave %v, the index is missing", err)
+	}
+	if n, err := db.NextSequence(); err != nil || n != 4 {
+		t.Errorf("next sequence is %d, %v", n, err)
+	}
+}
+
+func TestTrackDB_InitUnreachable(t *testing.T) {
+	db := trackDB{
+		mongoSession: &mongoSession{
+			HostURL: "mongodb://127.0.0.1:1",
+			Config:  mongoConfig{DialTimeout: 100 * time.Millisecond, DialRetries: 2, RetryDelay: 10 * time.Millisecond},
+		},
+		DatabaseName:        "testtrackdb",
+		TrackCollectionName: "tracks",
+	}
+
+	if err := db.Init(); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Init() gave %v, want ErrUnavailable", err)
+	}
+	if _, err := db.Get("igc1"); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Get() gave %v, want ErrUnavailable", err)
+	}
+}
+
+func TestMongoWrap(t *testing.T) {
+	m := &mongoSession{}
+	tests := []struct {
+		err         error
+		unavailable bool
+	}{
+		{io.EOF, true},
+		{&net.OpError{Op: "read", Err: errors.New("connection reset")}, true},
+		{errors.New("no reachable servers"), true},
+		{&mgo.QueryError{Code: 2, Message: "bad query"}, false},
+		{errors.New("document is too large"), false},
+	}
+	for _, test := range tests {
+		if err := m.wrap(test.err); errors.Is(err, ErrUnavailable) != test.unavailable {
+			t.Errorf("wrap(%v) = %v", test.err, err)
+		}
+	}
+	if m.wrap(mgo.ErrNotFound) != ErrNotFound {
+		t.Error("wrap(mgo.ErrNotFound) is not ErrNotFound")
+	}
+}
+
+func TestTrackMemDB(t *testing.T) {
+	testTrackStoreAdd(t, newTrackMemDB())
+	testTrackStoreGet(t, newTrackMemDB())
+	testTrackStoreDelete(t, newTrackMemDB())
+	testTrackStoreIGC(t, newTrackMemDB())
+	testTrackStoreJobs(t, newTrackMemDB())
+	testTrackStoreHash(t, newTrackMemDB())
+	testTrackStoreOrder(t, newTrackMemDB())
+	testTrackStoreFind(t, newTrackMemDB())
+	testTrackStoreSequence(t, newTrackMemDB())
+}
+
+func TestWebhookMemDB(t *testing.T) {
+	testWebhookStore(t, newWebhookMemDB())
+}
+
+func TestTaskMemDB(t *testing.T) {
+	testTaskStore(t, newTaskMemDB())
+}
+
+func TestTaskDB(t *testing.T) {
+	tracks := setupDB(t)
+	defer tearDownDB(t, tracks)
+	db := &taskDB{
+		mongoSession:       tracks.mongoSession,
+		DatabaseName:       tracks.DatabaseName,
+		TaskCollectionName: "tasks",
+	}
+
+	testTaskStore(t, db)
+}
+
+func TestTrackBoltDB(t *testing.T) {
+	db, _ := setupBoltDB(t)
+	testTrackStoreAdd(t, db)
+
+	db, _ = setupBoltDB(t)
+	testTrackStoreGet(t, db)
+
+	db, _ = setupBoltDB(t)
+	testTrackStoreDelete(t, db)
+
+	db, _ = setupBoltDB(t)
+	testTrackStoreIGC(t, db)
+
+	db, _ = setupBoltDB(t)
+	testTrackStoreJobs(t, db)
+
+	db, _ = setupBoltDB(t)
+	testTrackStoreHash(t, db)
+
+	db, _ = setupBoltDB(t)
+	testTrackStoreOrder(t, db)
+
+	db, _ = setupBoltDB(t)
+	testTrackStoreFind(t, db)
+
+	db, _ = setupBoltDB(t)
+	testTrackStoreSequence(t, db)
+}
+
+func TestBoltSequenceSeed(t *testing.T) {
+	db, _ := setupBoltDB(t)
+	db.Add(Track{ID: "igc41"})
+	db.Add(Track{ID: "igc7"})
+
+	next, err := db.NextSequence()
+	if err != nil || next != 42 {
+		t.Errorf("NextSequence() = %d, %v, want 42 after the stored ids", next, err)
+	}
+}
+
+func TestWebhookBoltDB(t *testing.T) {
+	_, db := setupBoltDB(t)
+	testWebhookStore(t, db)
+}
+
+func TestTaskBoltDB(t *testing.T) {
+	tracks, _ := setupBoltDB(t)
+	testTaskStore(t, &taskBoltDB{tracks.file})
+}
+
+func TestOpenStores(t *testing.T) {
+	tracks, webhooks, tasks, err := openStores("memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tracks.(*trackMemDB); !ok {
+		t.Error("memory backend did not give a memory track store")
+	}
+	if _, ok := webhooks.(*webhookMemDB); !ok {
+		t.Error("memory backend did not give a memory webhook store")
+	}
+	if _, ok := tasks.(*taskMemDB); !ok {
+		t.Error("memory backend did not give a memory task store")
+	}
+
+	tracks, webhooks, tasks, _ = openStores("")
+	if _, ok := tracks.(*trackDB); !ok {
+		t.Fatal("default backend should be MongoDB")
+	}
+	session := tracks.(*trackDB).mongoSession
+	if webhooks.(*webhookDB).mongoSession != session || tasks.(*taskDB).mongoSession != session {
+		t.Error("MongoDB stores do not share their session")
+	}
+
+	if _, _, _, err := openStores("postgres"); err == nil {
+		t.Error("unknown backend gave no error")
+	}
 }
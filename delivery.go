@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Status of a Delivery
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryDead      = "dead" // given up on, kept as a dead letter
+)
+
+var deliveryStatuses = []string{deliveryPending, deliveryDelivered, deliveryDead}
+
+// DeliveryAttempt is one call of a webhook. StatusCode is 0 when no
+// response came back.
+type DeliveryAttempt struct {
+	Time       time.Time `json:"time"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Delivery is a notification for a webhook. It is stored before the first
+// attempt, so pending ones are resumed after a restart.
+type Delivery struct {
+	ID          string            `json:"id"` // an ObjectId, so ids sort by creation
+	WebhookID   string            `json:"webhook_id"`
+	Payload     json.RawMessage   `json:"payload"`
+	Status      string            `json:"status"`
+	Created     time.Time         `json:"created"`
+	NextAttempt time.Time         `json:"next_attempt"` // due time, while pending
+	Attempts    []DeliveryAttempt `json:"attempts"`
+}
+
+// webhookDispatcher sends the deliveries of every webhook in order on a
+// worker of its own, at most Workers webhooks at a time, so a slow webhook
+// only holds up its own deliveries. Failed ones are retried with
+// exponential backoff and jitter until MaxAttempts calls have failed.
+type webhookDispatcher struct {
+	MaxAttempts int
+	Backoff     time.Duration // after the first failure, doubling after every further one
+	MaxBackoff  time.Duration
+	Workers     int
+
+	client *http.Client // with the timeout of a call
+	wake   chan struct{}
+
+	mutex sync.Mutex
+	busy  map[string]bool // webhooks a worker is calling
+
+	// Outcomes of attempts the store failed to save, by delivery id. They
+	// are saved before the delivery is looked at again, so that the
+	// webhook isn't called twice for one attempt.
+	unsaved map[string]Delivery
+}
+
+func newDispatcherFromEnv() *webhookDispatcher {
+	return &webhookDispatcher{
+		MaxAttempts: getEnvInt("WEBHOOK_MAX_ATTEMPTS", 8),
+		Backoff:     getEnvDuration("WEBHOOK_BACKOFF", 10*time.Second),
+		MaxBackoff:  getEnvDuration("WEBHOOK_MAX_BACKOFF", time.Hour),
+		Workers:     getEnvInt("WEBHOOK_WORKERS", 4),
+		client:      &http.Client{Timeout: getEnvDuration("WEBHOOK_TIMEOUT", 10*time.Second)},
+		wake:        make(chan struct{}, 1),
+		busy:        map[string]bool{},
+		unsaved:     map[string]Delivery{},
+	}
+}
+
+// The dispatcher of sendWebhook, started by main()
+var dispatcher = newDispatcherFromEnv()
+
+// How long the dispatcher sleeps when nothing is due, and after the store
+// failed
+const dispatcherIdle = time.Minute
+
+// Stores a new delivery of payload to the webhook and wakes the dispatcher
+func queueDelivery(webhookID string, payload []byte) (Delivery, error) {
+	now := time.Now().UTC()
+	delivery := Delivery{
+		ID:          bson.NewObjectId().Hex(),
+		WebhookID:   webhookID,
+		Payload:     payload,
+		Status:      deliveryPending,
+		Created:     now,
+		NextAttempt: now,
+		Attempts:    []DeliveryAttempt{},
+	}
+	if err := webhookDataBase.AddDelivery(delivery); err != nil {
+		return Delivery{}, err
+	}
+	dispatcher.notify()
+	return delivery, nil
+}
+
+// Makes run look for due deliveries right away
+func (d *webhookDispatcher) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Sends deliveries as they become due, starting with those left pending
+// before a restart. Never returns.
+func (d *webhookDispatcher) run() {
+	for {
+		timer := time.NewTimer(d.deliverDue(time.Now()))
+		select {
+		case <-d.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// Starts a worker for every webhook with deliveries due at now, as long as
+// there are free workers, and returns how long it is until the next
+// delivery of the others is due. Workers wake run when they are done.
+// Only run calls this, never concurrently.
+func (d *webhookDispatcher) deliverDue(now time.Time) time.Duration {
+	// Only this starts workers, so the webhooks that have none now get
+	// none before the listing below, which is then up to date for them
+	d.mutex.Lock()
+	busy := map[string]bool{}
+	for hookID := range d.busy {
+		busy[hookID] = true
+	}
+	d.mutex.Unlock()
+
+	pending, err := webhookDataBase.FindDeliveries("", deliveryPending)
+	if err != nil {
+		log.Println("listing webhook deliveries:", err)
+		return dispatcherIdle
+	}
+	wait := dispatcherIdle
+	due := map[string][]Delivery{}
+	hooks := []string{} // with due deliveries, in the order of the oldest
+	for _, delivery := range pending {
+		if busy[delivery.WebhookID] {
+			continue
+		}
+		// Deliveries the store failed on are left out of the wait, so the
+		// dispatcher doesn't spin on a failing store
+		if unsaved, ok := d.takeUnsaved(delivery.ID); ok {
+			if err := webhookDataBase.UpdateDelivery(unsaved); err != nil {
+				log.Println("updating webhook delivery:", err)
+				d.keepUnsaved(unsaved)
+				continue
+			}
+			delivery = unsaved
+		}
+		if delivery.Status != deliveryPending {
+			continue
+		}
+		if !delivery.NextAttempt.After(now) {
+			if _, ok := due[delivery.WebhookID]; !ok {
+				hooks = append(hooks, delivery.WebhookID)
+			}
+			due[delivery.WebhookID] = append(due[delivery.WebhookID], delivery)
+		} else if until := delivery.NextAttempt.Sub(now); until < wait {
+			wait = until
+		}
+	}
+
+	for _, hookID := range hooks {
+		d.mutex.Lock()
+		if len(d.busy) >= d.Workers {
+			// The rest are started when a worker is done
+			d.mutex.Unlock()
+			break
+		}
+		d.busy[hookID] = true
+		d.mutex.Unlock()
+		go d.deliverAll(hookID, due[hookID])
+	}
+	return wait
+}
+
+// Makes an attempt at the due deliveries of a webhook, in order. After a
+// failed call the others wait for the same retry, so a webhook that is
+// down holds its worker for one call.
+func (d *webhookDispatcher) deliverAll(hookID string, deliveries []Delivery) {
+	defer func() {
+		d.mutex.Lock()
+		delete(d.busy, hookID)
+		d.mutex.Unlock()
+		d.notify()
+	}()
+
+	var retry time.Time
+	for _, delivery := range deliveries {
+		if retry.IsZero() {
+			d.attempt(&delivery)
+			if delivery.Status == deliveryPending {
+				retry = delivery.NextAttempt
+			}
+		} else {
+			delivery.NextAttempt = retry
+		}
+		if err := webhookDataBase.UpdateDelivery(delivery); err != nil {
+			log.Println("updating webhook delivery:", err)
+			d.keepUnsaved(delivery)
+		}
+	}
+}
+
+func (d *webhookDispatcher) keepUnsaved(delivery Delivery) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.unsaved[delivery.ID] = delivery
+}
+
+func (d *webhookDispatcher) takeUnsaved(id string) (Delivery, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delivery, ok := d.unsaved[id]
+	delete(d.unsaved, id)
+	return delivery, ok
+}
+
+// Calls the webhook of the delivery once and records the outcome. When the
+// webhook can't be read, the delivery is put off without counting an
+// attempt.
+func (d *webhookDispatcher) attempt(delivery *Delivery) {
+	hook, err := webhookDataBase.Get(delivery.WebhookID)
+	if errors.Is(err, ErrNotFound) {
+		delivery.Attempts = append(delivery.Attempts, DeliveryAttempt{Time: time.Now().UTC(), Error: "webhook was deleted"})
+		delivery.Status = deliveryDead
+		return
+	}
+	if err != nil {
+		log.Println("reading webhook:", err)
+		delivery.NextAttempt = time.Now().UTC().Add(d.backoff(len(delivery.Attempts) + 1))
+		return
+	}
+
+	result := DeliveryAttempt{Time: time.Now().UTC()}
+	request, err := http.NewRequest("POST", hook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		delivery.Attempts = append(delivery.Attempts, DeliveryAttempt{Time: result.Time, Error: err.Error()})
+		delivery.Status = deliveryDead
+		return
+	}
+	request.Header.Set("Content-Type", "application/json")
+	signDelivery(request, hook, result.Time, delivery.Payload)
+	resp, err := d.client.Do(request)
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		// Read a little of the body, so the connection can be reused
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+		result.StatusCode = resp.StatusCode
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			result.Error = resp.Status
+		}
+	}
+	delivery.Attempts = append(delivery.Attempts, result)
+
+	switch {
+	case result.Error == "":
+		delivery.Status = deliveryDelivered
+	case len(delivery.Attempts) >= d.MaxAttempts:
+		delivery.Status = deliveryDead
+		log.Printf("giving up on delivery %v to webhook %v: %v", delivery.ID, hook.ID, result.Error)
+	default:
+		delivery.NextAttempt = result.Time.Add(d.backoff(len(delivery.Attempts)))
+	}
+}
+
+// Wait after the given number of failed attempts: Backoff doubled for every
+// failure after the first, at most MaxBackoff, of which a random part of up
+// to half is taken off so that many failed deliveries don't retry at once
+func (d *webhookDispatcher) backoff(failures int) time.Duration {
+	delay := d.Backoff
+	for i := 1; i < failures && delay < d.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > d.MaxBackoff {
+		delay = d.MaxBackoff
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay - time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+// Reads the status filter of the delivery listings
+func deliveryStatusParam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	status := r.URL.Query().Get("status")
+	for _, known := range deliveryStatuses {
+		if status == known {
+			return status, true
+		}
+	}
+	if status != "" {
+		http.Error(w, "status must be one of "+strings.Join(deliveryStatuses, ", "), http.StatusBadRequest)
+		return "", false
+	}
+	return "", true
+}
+
+// GET /paragliding/api/webhook/new_track/{id}/deliveries lists the
+// deliveries of a webhook with all their attempts, oldest first, optionally
+// only those with the given ?status=
+func deliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		error400(w)
+		return
+	}
+	parts := strings.Split(r.URL.Path, "/")
+	hook, err := webhookDataBase.Get(parts[len(parts)-2])
+	if err != nil {
+		errorStore(w, err)
+		return
+	}
+	status, ok := deliveryStatusParam(w, r)
+	if !ok {
+		return
+	}
+	deliveries, err := webhookDataBase.FindDeliveries(hook.ID, status)
+	if err != nil {
+		errorStore(w, err)
+		return
+	}
+	writeJSON(w, deliveries)
+}
+
+// GET /UnexpectedURL/admin/api/webhook_deadletters lists the deliveries of
+// all webhooks that were given up on
+func deadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		error400(w)
+		return
+	}
+	deliveries, err := webhookDataBase.FindDeliveries("", deliveryDead)
+	if err != nil {
+		errorStore(w, err)
+		return
+	}
+	writeJSON(w, deliveries)
+}
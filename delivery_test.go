@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDispatcherBackoff(t *testing.T) {
+	d := &webhookDispatcher{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	tests := []struct {
+		failures int
+		max      time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 5 * time.Second},
+		{40, 5 * time.Second},
+	}
+	for _, test := range tests {
+		for i := 0; i < 20; i++ {
+			if wait := d.backoff(test.failures); wait > test.max || wait < test.max/2 {
+				t.Errorf("backoff(%d) = %v, want between %v and %v", test.failures, wait, test.max/2, test.max)
+			}
+		}
+	}
+}
+
+// Webhook receiver answering with the given status codes in turn, and 200
+// after them
+type testReceiver struct {
+	mutex    sync.Mutex
+	statuses []int
+	bodies   []string
+}
+
+func (h *testReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	h.bodies = append(h.bodies, string(body))
+	if len(h.statuses) > 0 {
+		w.WriteHeader(h.statuses[0])
+		h.statuses = h.statuses[1:]
+	}
+}
+
+// Runs the dispatcher until the delivery is no longer pending
+func dispatchUntilDone(t *testing.T, d *webhookDispatcher, id string) Delivery {
+	t.Helper()
+	return dispatchUntil(t, d, id, func(delivery Delivery) bool { return delivery.Status != deliveryPending })
+}
+
+// Runs the dispatcher until the stored delivery meets the condition
+func dispatchUntil(t *testing.T, d *webhookDispatcher, id string, done func(Delivery) bool) Delivery {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		d.deliverDue(time.Now())
+		deliveries, err := webhookDataBase.FindDeliveries("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, delivery := range deliveries {
+			if delivery.ID == id && done(delivery) {
+				return delivery
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("delivery %v did not get there", id)
+	return Delivery{}
+}
+
+func testDispatcher() *webhookDispatcher {
+	return &webhookDispatcher{
+		MaxAttempts: 3,
+		Backoff:     time.Millisecond,
+		MaxBackoff:  10 * time.Millisecond,
+		Workers:     2,
+		client:      &http.Client{Timeout: time.Second},
+		wake:        make(chan struct{}, 1),
+		busy:        map[string]bool{},
+		unsaved:     map[string]Delivery{},
+	}
+}
+
+func TestDispatcher(t *testing.T) {
+	setupMemStores(t)
+	receiver := &testReceiver{statuses: []int{http.StatusInternalServerError, http.StatusBadGateway}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	webhookDataBase.Add(Webhook{ID: "1", URL: server.URL, Value: 1})
+
+	d := testDispatcher()
+	queued, err := queueDelivery("1", []byte(`{"text":"hello"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivery := dispatchUntilDone(t, d, queued.ID)
+	if delivery.Status != deliveryDelivered || len(delivery.Attempts) != 3 {
+		t.Fatalf("delivery ended as %+v", delivery)
+	}
+	for i, want := range []int{500, 502, 200} {
+		if delivery.Attempts[i].StatusCode != want {
+			t.Errorf("attempt %d got %d, want %d", i, delivery.Attempts[i].StatusCode, want)
+		}
+	}
+	if delivery.Attempts[2].Error != "" || receiver.bodies[2] != `{"text":"hello"}` {
+		t.Errorf("last attempt %+v sent %q", delivery.Attempts[2], receiver.bodies[2])
+	}
+
+	// A receiver that never answers well ends up in the dead letters
+	receiver.statuses = []int{500, 500, 500}
+	queued, _ = queueDelivery("1", []byte(`{}`))
+	if delivery = dispatchUntilDone(t, d, queued.ID); delivery.Status != deliveryDead || len(delivery.Attempts) != 3 {
+		t.Errorf("failing delivery ended as %+v", delivery)
+	}
+
+	webhookDataBase.Delete("1")
+	queued, _ = queueDelivery("1", []byte(`{}`))
+	if delivery = dispatchUntilDone(t, d, queued.ID); delivery.Status != deliveryDead || len(receiver.bodies) != 6 {
+		t.Errorf("delivery to a deleted webhook ended as %+v", delivery)
+	}
+
+	w := httptest.NewRecorder()
+	deadLettersHandler(w, httptest.NewRequest("GET", "/UnexpectedURL/admin/api/webhook_deadletters", nil))
+	var dead []Delivery
+	if err := json.Unmarshal(w.Body.Bytes(), &dead); err != nil || len(dead) != 2 {
+		t.Errorf("dead letters are %v, %v", w.Body.String(), err)
+	}
+}
+
+func TestDispatcher_SlowWebhook(t *testing.T) {
+	setupMemStores(t)
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-release }))
+	defer slow.Close()
+	fast := httptest.NewServer(&testReceiver{})
+	defer fast.Close()
+	webhookDataBase.Add(Webhook{ID: "1", URL: slow.URL, Value: 1})
+	webhookDataBase.Add(Webhook{ID: "2", URL: fast.URL, Value: 1})
+
+	d := testDispatcher()
+	held, _ := queueDelivery("1", []byte(`{}`))
+	queued, _ := queueDelivery("2", []byte(`{}`))
+	if delivery := dispatchUntilDone(t, d, queued.ID); delivery.Status != deliveryDelivered {
+		t.Errorf("delivery behind a slow webhook ended as %+v", delivery)
+	}
+	if deliveries, _ := webhookDataBase.FindDeliveries("1", deliveryPending); len(deliveries) != 1 {
+		t.Errorf("slow webhook has %d pending deliveries, want 1", len(deliveries))
+	}
+	close(release)
+	dispatchUntilDone(t, d, held.ID)
+}
+
+func TestDispatcher_WebhookDown(t *testing.T) {
+	setupMemStores(t)
+	receiver := &testReceiver{statuses: []int{500}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	webhookDataBase.Add(Webhook{ID: "1", URL: server.URL, Value: 1})
+
+	// After the first call fails, the others wait for the same retry
+	d := testDispatcher()
+	d.Backoff, d.MaxBackoff = time.Hour, time.Hour
+	queueDelivery("1", []byte(`{}`))
+	second, _ := queueDelivery("1", []byte(`{}`))
+	dispatchUntil(t, d, second.ID, func(delivery Delivery) bool { return delivery.NextAttempt.After(second.NextAttempt) })
+	deliveries, _ := webhookDataBase.FindDeliveries("1", deliveryPending)
+	if len(deliveries) != 2 || len(deliveries[1].Attempts) != 0 || !deliveries[1].NextAttempt.Equal(deliveries[0].NextAttempt) {
+		t.Errorf("deliveries are %+v", deliveries)
+	}
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	if len(receiver.bodies) != 1 {
+		t.Errorf("webhook was called %d times, want once", len(receiver.bodies))
+	}
+}
+
+// WebhookStore whose Get and UpdateDelivery fail the given number of times
+type flakyWebhookDB struct {
+	*webhookMemDB
+	mutex                    sync.Mutex
+	failGets, failDeliveries int
+}
+
+func (db *flakyWebhookDB) Get(keyID string) (Webhook, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.failGets > 0 {
+		db.failGets--
+		return Webhook{}, ErrUnavailable
+	}
+	return db.webhookMemDB.Get(keyID)
+}
+
+func (db *flakyWebhookDB) UpdateDelivery(d Delivery) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.failDeliveries > 0 {
+		db.failDeliveries--
+		return ErrUnavailable
+	}
+	return db.webhookMemDB.UpdateDelivery(d)
+}
+
+func (db *flakyWebhookDB) fail(gets, deliveries int) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.failGets, db.failDeliveries = gets, deliveries
+}
+
+func TestDispatcher_StoreFailure(t *testing.T) {
+	setupMemStores(t)
+	db := &flakyWebhookDB{webhookMemDB: newWebhookMemDB()}
+	webhookDataBase = db
+	receiver := &testReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	db.Add(Webhook{ID: "1", URL: server.URL, Value: 1})
+	d := testDispatcher()
+	d.Backoff, d.MaxBackoff = time.Hour, time.Hour
+
+	// The webhook can't be read: the delivery is put off, not retried at once
+	db.fail(1, 0)
+	queued, _ := queueDelivery("1", []byte(`{}`))
+	d.deliverDue(time.Now())
+	delivery := dispatchUntil(t, d, queued.ID, func(delivery Delivery) bool { return delivery.NextAttempt.After(queued.NextAttempt) })
+	if len(delivery.Attempts) != 0 || time.Until(delivery.NextAttempt) < 29*time.Minute {
+		t.Errorf("delivery to an unreadable webhook is %+v", delivery)
+	}
+	if wait := d.deliverDue(time.Now()); wait < dispatcherIdle {
+		t.Errorf("dispatcher waits %v after the store failed", wait)
+	}
+
+	// The outcome can't be saved: it is saved later, without calling again
+	db.fail(0, 1)
+	queued, _ = queueDelivery("1", []byte(`{"text":"once"}`))
+	if delivery = dispatchUntilDone(t, d, queued.ID); delivery.Status != deliveryDelivered || len(delivery.Attempts) != 1 {
+		t.Errorf("delivery ended as %+v", delivery)
+	}
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	if len(receiver.bodies) != 1 {
+		t.Errorf("webhook was called %d times, want once", len(receiver.bodies))
+	}
+}
+
+// WebhookStore that can't store deliveries for one webhook
+type failingDeliveryDB struct {
+	*webhookMemDB
+	failFor string
+}
+
+func (db *failingDeliveryDB) AddDelivery(d Delivery) error {
+	if d.WebhookID == db.failFor {
+		return ErrUnavailable
+	}
+	return db.webhookMemDB.AddDelivery(d)
+}
+
+func TestSendWebhook_Failure(t *testing.T) {
+	setupMemStores(t)
+	db := &failingDeliveryDB{newWebhookMemDB(), "1"}
+	webhookDataBase = db
+	db.Add(Webhook{ID: "1", URL: "http://example.com/a", Value: 1})
+	db.Add(Webhook{ID: "2", URL: "http://example.com/b", Value: 1})
+	postIGC(t, readTestData(t, "sample.igc"))
+
+	// The webhook after the failing one is still served
+	if deliveries, _ := db.FindDeliveries("2", ""); len(deliveries) != 1 {
+		t.Errorf("webhook 2 got %d deliveries, want 1", len(deliveries))
+	}
+	failed, _ := db.Get("1")
+	served, _ := db.Get("2")
+	if failed.LastTrack != "" || served.LastTrack == "" {
+		t.Errorf("webhooks moved on to %q and %q", failed.LastTrack, served.LastTrack)
+	}
+}
+
+func TestDeliveriesHandler(t *testing.T) {
+	setupMemStores(t)
+	webhookDataBase.Add(Webhook{ID: "1", URL: "http://example.com/hook", Value: 1})
+	content := readTestData(t, "sample.igc")
+	id := postIGC(t, content)
+
+	tests := []struct {
+		path   string
+		status int
+		count  int
+	}{
+		{"/paragliding/api/webhook/new_track/1/deliveries", http.StatusOK, 1},
+		{"/paragliding/api/webhook/new_track/1/deliveries?status=pending", http.StatusOK, 1},
+		{"/paragliding/api/webhook/new_track/1/deliveries?status=dead", http.StatusOK, 0},
+		{"/paragliding/api/webhook/new_track/1/deliveries?status=lost", http.StatusBadRequest, 0},
+		{"/paragliding/api/webhook/new_track/2/deliveries", http.StatusNotFound, 0},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		deliveriesHandler(w, httptest.NewRequest("GET", test.path, nil))
+		if w.Code != test.status {
+			t.Errorf("GET %v gave %d, want %d", test.path, w.Code, test.status)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var deliveries []Delivery
+		json.Unmarshal(w.Body.Bytes(), &deliveries)
+		if len(deliveries) != test.count {
+			t.Errorf("GET %v listed %d deliveries, want %d", test.path, len(deliveries), test.count)
+		}
+		if len(deliveries) > 0 && !strings.Contains(string(deliveries[0].Payload), id) {
+			t.Errorf("delivery %s does not announce %v", deliveries[0].Payload, id)
+		}
+	}
+}
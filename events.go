@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marni/goigc"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Types of events webhooks can subscribe to
+const (
+	eventTrackCreated   = "track.created"
+	eventTrackDeleted   = "track.deleted"
+	eventTrackValidated = "track.validated"
+	eventRecordBroken   = "record.broken"
+	eventTaskResults    = "task.results_updated"
+	eventTracksPurged   = "admin.tracks_purged"
+)
+
+var eventTypes = []string{eventTrackCreated, eventTrackDeleted, eventTrackValidated, eventRecordBroken, eventTaskResults, eventTracksPurged}
+
+// Event is the body of every delivery to a webhook subscribed to events.
+// The id is the same for all the webhooks told about the event and for
+// every attempt, so receivers can drop repeats.
+type Event struct {
+	ID      string      `json:"id"`
+	Type    string      `json:"type"`
+	Created time.Time   `json:"created"`
+	Data    interface{} `json:"data"` // one of the *Event types below
+}
+
+// TrackEvent is the data of the track.* events
+type TrackEvent struct {
+	ID          string    `json:"id"`
+	Pilot       string    `json:"pilot"`
+	Glider      string    `json:"glider"`
+	GliderID    string    `json:"glider_id"`
+	HDate       time.Time `json:"H_date"`
+	TrackLength float64   `json:"track_length"`
+	Format      string    `json:"format"`
+	Validation  string    `json:"validation"`
+}
+
+func trackEventOf(track Track) TrackEvent {
+	return TrackEvent{track.ID, track.Pilot, track.Glider, track.GliderID, track.HDate, track.TrackLength, track.Format, track.Validation}
+}
+
+// Scopes of the records of record.broken
+const (
+	recordPersonal = "personal" // longest flight of the pilot
+	recordSite     = "site"     // longest flight from the same takeoff
+	recordClub     = "club"     // longest flight stored in the service
+)
+
+// RecordEvent is the data of record.broken. Site is the takeoff of the new
+// record, for site records.
+type RecordEvent struct {
+	Scope    string     `json:"scope"`
+	Track    TrackEvent `json:"track"`
+	Previous TrackEvent `json:"previous"`
+	Site     *Fix       `json:"site,omitempty"`
+}
+
+// TaskResultsEvent is the data of task.results_updated, sent when Track
+// was submitted for the task
+type TaskResultsEvent struct {
+	Task    string     `json:"task"`
+	Track   string     `json:"track"`
+	Results TaskScores `json:"results"`
+}
+
+// PurgeEvent is the data of admin.tracks_purged
+type PurgeEvent struct {
+	Count int `json:"count"`
+}
+
+// Takeoffs closer than this, in m, are at the same site
+var siteRadius = getEnvFloat("RECORD_SITE_RADIUS", 1000)
+
+// The site record is looked for among this many of the longest tracks
+var recordSiteScan = getEnvInt("RECORD_SITE_SCAN", 1000)
+
+// Held while the records of a new track are checked and announced, so
+// tracks added at the same time don't claim the same record
+var recordMutex sync.Mutex
+
+// Checks the event types a webhook subscribes to
+func checkEventTypes(types []string) error {
+	for _, eventType := range types {
+		known := false
+		for _, other := range eventTypes {
+			known = known || eventType == other
+		}
+		if !known {
+			return fmt.Errorf("unknown event type %q, use %v", eventType, strings.Join(eventTypes, ", "))
+		}
+	}
+	return nil
+}
+
+// The webhooks subscribed to the event type. Those without event types
+// are the new_track webhooks of sendWebhook, and get no events.
+func subscribers(eventType string) []Webhook {
+	hooks, err := webhookDataBase.List()
+	if err != nil {
+		log.Println("listing webhooks:", err)
+		return nil
+	}
+	subscribed := []Webhook{}
+	for _, hook := range hooks {
+		for _, other := range hook.Events {
+			if other == eventType {
+				subscribed = append(subscribed, hook)
+				break
+			}
+		}
+	}
+	return subscribed
+}
+
+// The webhooks subscribed to the event type whose filter the track passes
+func trackSubscribers(eventType string, track Track) []Webhook {
+	subscribed := []Webhook{}
+	for _, hook := range subscribers(eventType) {
+		if hook.Filter.match(track) {
+			subscribed = append(subscribed, hook)
+		}
+	}
+	return subscribed
+}
+
+// Queues a delivery of the event to every subscribed webhook. Events are
+// sent in the background, so failures are only logged.
+func emitEvent(eventType string, data interface{}) {
+	deliverEvent(subscribers(eventType), eventType, data)
+}
+
+// Like emitEvent, for the events about a track, which go to the webhooks
+// whose filter it passes
+func emitTrackEvent(eventType string, track Track, data interface{}) {
+	deliverEvent(trackSubscribers(eventType, track), eventType, data)
+}
+
+func deliverEvent(hooks []Webhook, eventType string, data interface{}) {
+	if len(hooks) == 0 {
+		return
+	}
+	event := Event{ID: bson.NewObjectId().Hex(), Type: eventType, Created: time.Now().UTC(), Data: data}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, hook := range hooks {
+		if _, err := queueDelivery(hook.ID, payload); err != nil {
+			log.Printf("queueing %v event for webhook %v: %v", eventType, hook.ID, err)
+		}
+	}
+}
+
+// Emits the events of a track that was just added
+func announceTrack(track Track) {
+	emitTrackEvent(eventTrackCreated, track, trackEventOf(track))
+	// Only when a validator checked the signature
+	if track.Validation == validationValid || track.Validation == validationInvalid {
+		emitTrackEvent(eventTrackValidated, track, trackEventOf(track))
+	}
+	// Finding the records takes a few queries, so only when someone listens
+	if len(trackSubscribers(eventRecordBroken, track)) == 0 {
+		return
+	}
+	recordMutex.Lock()
+	defer recordMutex.Unlock()
+	records, err := brokenRecords(track)
+	if err != nil {
+		log.Println("checking records:", err)
+		return
+	}
+	for _, record := range records {
+		emitTrackEvent(eventRecordBroken, track, record)
+	}
+}
+
+// The records the track beats, measured by track length. A first flight
+// sets a record but breaks none.
+func brokenRecords(track Track) ([]RecordEvent, error) {
+	club, err := longestOther(TrackQuery{}, track)
+	if err != nil {
+		return nil, err
+	}
+	var personal *Track
+	if track.Pilot != "" {
+		if personal, err = longestOther(TrackQuery{Pilot: track.Pilot}, track); err != nil {
+			return nil, err
+		}
+	}
+	site, err := siteRecord(track)
+	if err != nil {
+		return nil, err
+	}
+
+	records := []RecordEvent{}
+	for _, record := range []struct {
+		scope    string
+		previous *Track
+	}{{recordPersonal, personal}, {recordSite, site}, {recordClub, club}} {
+		if record.previous == nil || track.TrackLength <= record.previous.TrackLength {
+			continue
+		}
+		event := RecordEvent{Scope: record.scope, Track: trackEventOf(track), Previous: trackEventOf(*record.previous)}
+		if record.scope == recordSite {
+			takeoff := track.Stats.Takeoff
+			event.Site = &takeoff
+		}
+		records = append(records, event)
+	}
+	return records, nil
+}
+
+// The longest track passing the filters of the query other than the given
+// one, nil if there is none
+func longestOther(q TrackQuery, track Track) (*Track, error) {
+	q.SortBy, q.Desc, q.Limit = sortTrackLength, true, 2
+	tracks, err := trackDataBase.Find(q)
+	if err != nil {
+		return nil, err
+	}
+	for i := range tracks {
+		if tracks[i].ID != track.ID {
+			return &tracks[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// The longest other track from the takeoff of the given one, looked for
+// page by page among the recordSiteScan longest tracks
+func siteRecord(track Track) (*Track, error) {
+	if track.Stats.Takeoff.Time.IsZero() {
+		return nil, nil
+	}
+	takeoff := igc.NewPointFromLatLng(track.Stats.Takeoff.Lat, track.Stats.Takeoff.Lon)
+	q := TrackQuery{SortBy: sortTrackLength, Desc: true}
+	for scanned := 0; scanned < recordSiteScan; {
+		q.Limit = recordSiteScan - scanned
+		if q.Limit > 100 {
+			q.Limit = 100
+		}
+		tracks, err := trackDataBase.Find(q)
+		if err != nil {
+			return nil, err
+		}
+		for i := range tracks {
+			other := &tracks[i]
+			if other.ID != track.ID && !other.Stats.Takeoff.Time.IsZero() &&
+				takeoff.Distance(igc.NewPointFromLatLng(other.Stats.Takeoff.Lat, other.Stats.Takeoff.Lon))*1000 <= siteRadius {
+				return other, nil
+			}
+		}
+		scanned += len(tracks)
+		if len(tracks) < q.Limit {
+			break
+		}
+		q.After = cursorOf(tracks[len(tracks)-1])
+	}
+	return nil, nil
+}
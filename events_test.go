@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The events queued for the webhook, in order
+func queuedEvents(t *testing.T, hookID string) []Event {
+	t.Helper()
+	deliveries, err := webhookDataBase.FindDeliveries(hookID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := []Event{}
+	for _, delivery := range deliveries {
+		var event Event
+		if err := json.Unmarshal(delivery.Payload, &event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func eventTypesOf(events []Event) string {
+	types := []string{}
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	return strings.Join(types, " ")
+}
+
+func TestNewWebhook_Events(t *testing.T) {
+	setupMemStores(t)
+	w := postWebhook(t, `{"webhookURL": "http://example.com/hook", "events": ["track.created", "track.eaten"]}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unknown event type gave %d, want 400", w.Code)
+	}
+	w = postWebhook(t, `{"webhookURL": "http://example.com/hook", "events": ["track.created", "admin.tracks_purged"]}`)
+	if hook, err := webhookDataBase.Get(w.Body.String()); err != nil || len(hook.Events) != 2 {
+		t.Errorf("stored webhook %+v, %v", hook, err)
+	}
+
+	// Only POST adds webhooks
+	for _, method := range []string{"PUT", "GET"} {
+		w = httptest.NewRecorder()
+		newWebhook(w, httptest.NewRequest(method, "/paragliding/api/webhook/", strings.NewReader(`{"webhookURL": "http://example.com/hook"}`)))
+		if count, _ := webhookDataBase.Count(); w.Code != http.StatusBadRequest || count != 1 {
+			t.Errorf("%v gave %d and left %d webhooks", method, w.Code, count)
+		}
+	}
+}
+
+func TestTrackEvents(t *testing.T) {
+	setupMemStores(t)
+	tracks := postWebhook(t, `{"webhookURL": "http://example.com/a", "events": ["track.created", "track.validated"]}`).Body.String()
+	purges := postWebhook(t, `{"webhookURL": "http://example.com/b", "events": ["track.deleted", "admin.tracks_purged"]}`).Body.String()
+	legacy := postWebhook(t, `{"webhookURL": "http://example.com/c"}`).Body.String()
+
+	// The file is unsigned, so it was not validated
+	id := postIGC(t, readTestData(t, "sample.igc"))
+	events := queuedEvents(t, tracks)
+	if eventTypesOf(events) != "track.created" {
+		t.Fatalf("track webhook got %v", eventTypesOf(events))
+	}
+	data := events[0].Data.(map[string]interface{})
+	if data["id"] != id || data["pilot"] != "Gerd Gliding" || data["validation"] != validationUnsigned {
+		t.Errorf("track.created data is %v", data)
+	}
+	if events[0].ID == "" || time.Since(events[0].Created) > time.Minute {
+		t.Errorf("events are %+v", events)
+	}
+	if deliveries, _ := webhookDataBase.FindDeliveries(legacy, ""); len(deliveries) != 1 || !strings.Contains(string(deliveries[0].Payload), `"tracks":["`+id+`"]`) {
+		t.Errorf("new_track webhook got %v", deliveries)
+	}
+
+	w := httptest.NewRecorder()
+	adminDelete(w, httptest.NewRequest("DELETE", "/UnexpectedURL/admin/api/tracks", nil))
+	events = queuedEvents(t, purges)
+	if w.Body.String() != "1" || eventTypesOf(events) != "track.deleted admin.tracks_purged" {
+		t.Fatalf("purge webhook got %v", eventTypesOf(events))
+	}
+	if data := events[0].Data.(map[string]interface{}); data["id"] != id {
+		t.Errorf("track.deleted data is %v", data)
+	}
+	if data := events[1].Data.(map[string]interface{}); data["count"] != 1.0 {
+		t.Errorf("admin.tracks_purged data is %v", data)
+	}
+}
+
+func TestTrackValidatedEvent(t *testing.T) {
+	setupMemStores(t)
+	registerValidator("XXX", stubValidator{})
+	defer delete(validators, "XXX")
+	hook := postWebhook(t, `{"webhookURL": "http://example.com/a", "events": ["track.validated"]}`).Body.String()
+	content := readTestData(t, "sample.igc")
+
+	// Files without a signature or a validator for it are not validated
+	postIGC(t, content)
+	unknown := bytes.Replace(content, []byte("AXXX"), []byte("AYYY"), 1)
+	unknown = bytes.Replace(unknown, []byte("Gerd Gliding"), []byte("Anne"), 1)
+	postIGC(t, append(unknown, []byte("GGOOD\r\n")...))
+	if events := queuedEvents(t, hook); len(events) != 0 {
+		t.Fatalf("webhook got %v", eventTypesOf(events))
+	}
+
+	// Those the validator checked are, whether valid or not
+	valid := bytes.Replace(content, []byte("Gerd Gliding"), []byte("Bob"), 1)
+	invalid := bytes.Replace(content, []byte("Gerd Gliding"), []byte("Carl"), 1)
+	postIGC(t, append(valid, []byte("GGOOD\r\n")...))
+	postIGC(t, append(invalid, []byte("GBAD\r\n")...))
+	events := queuedEvents(t, hook)
+	if eventTypesOf(events) != "track.validated track.validated" || events[0].ID == events[1].ID {
+		t.Fatalf("webhook got %+v", events)
+	}
+	for i, want := range []string{validationValid, validationInvalid} {
+		if data := events[i].Data.(map[string]interface{}); data["validation"] != want {
+			t.Errorf("track.validated data is %v, want %v", data, want)
+		}
+	}
+}
+
+// TrackStore recording the queries given to Find
+type queryTrackDB struct {
+	*trackMemDB
+	queries []TrackQuery
+}
+
+func (db *queryTrackDB) Find(q TrackQuery) ([]Track, error) {
+	db.queries = append(db.queries, q)
+	return db.trackMemDB.Find(q)
+}
+
+func TestBrokenRecords(t *testing.T) {
+	at := func(lat, lon float64) FlightStats {
+		return FlightStats{Takeoff: Fix{Time: time.Date(2018, 9, 2, 11, 0, 0, 0, time.UTC), Lat: lat, Lon: lon}}
+	}
+	// Stores the records to beat and the new track
+	setup := func(track Track) {
+		setupMemStores(t)
+		for _, stored := range []Track{
+			{ID: "igc1", Pilot: "Anna", TrackLength: 50, Stats: at(60.795, 10.69)},
+			{ID: "igc2", Pilot: "Gerd", TrackLength: 30, Stats: at(60.795, 10.69)},
+			{ID: "igc3", Pilot: "Gerd", TrackLength: 20, Stats: at(46.5, 8.0)},
+			track,
+		} {
+			trackDataBase.Add(stored)
+		}
+	}
+
+	tests := []struct {
+		track  Track
+		scopes string
+	}{
+		// A first flight, of the pilot or from the site, breaks no record
+		{Track{ID: "igc4", Pilot: "Bob", TrackLength: 10, Stats: at(0, 0)}, ""},
+		{Track{ID: "igc4", Pilot: "Gerd", TrackLength: 25, Stats: at(60.7951, 10.6901)}, ""},
+		{Track{ID: "igc4", Pilot: "Gerd", TrackLength: 40, Stats: at(46.5001, 8.0)}, "personal site"},
+		{Track{ID: "igc4", Pilot: "Gerd", TrackLength: 60, Stats: at(60.795, 10.69)}, "personal site club"},
+		{Track{ID: "igc4", Pilot: "", TrackLength: 60, Stats: at(0, 0)}, "club"},
+	}
+	for _, test := range tests {
+		setup(test.track)
+		records, err := brokenRecords(test.track)
+		scopes := []string{}
+		for _, record := range records {
+			scopes = append(scopes, record.Scope)
+		}
+		if err != nil || strings.Join(scopes, " ") != test.scopes {
+			t.Errorf("%+v broke %v, %v, want %v", test.track, scopes, err, test.scopes)
+		}
+	}
+
+	record := Track{ID: "igc4", Pilot: "Gerd", TrackLength: 60, Stats: at(60.795, 10.69)}
+	setup(record)
+	records, _ := brokenRecords(record)
+	if len(records) != 3 || records[0].Previous.ID != "igc2" || records[1].Previous.ID != "igc1" || records[1].Site == nil || records[2].Previous.ID != "igc1" {
+		t.Errorf("records are %+v", records)
+	}
+
+	// Only a few of the longest tracks are read
+	db := &queryTrackDB{trackMemDB: trackDataBase.(*trackMemDB)}
+	trackDataBase = db
+	defer func(scan int) { recordSiteScan = scan }(recordSiteScan)
+	recordSiteScan = 1
+	far := Track{ID: "igc5", Pilot: "Gerd", TrackLength: 70, Stats: at(46.5, 8.0)}
+	trackDataBase.Add(far)
+	records, _ = brokenRecords(far)
+	scopes := []string{}
+	for _, record := range records {
+		scopes = append(scopes, record.Scope)
+	}
+	// The site record igc3 is beyond the scan
+	if strings.Join(scopes, " ") != "personal club" {
+		t.Errorf("with a short scan %v broke %v", far.ID, scopes)
+	}
+	for _, q := range db.queries {
+		if q.Limit == 0 || q.Limit > 100 {
+			t.Errorf("records read with %+v", q)
+		}
+	}
+}
+
+func TestTaskResultsEvent(t *testing.T) {
+	setupMemStores(t)
+	hook := postWebhook(t, `{"webhookURL": "http://example.com/a", "events": ["task.results_updated"]}`).Body.String()
+	trackID := postIGC(t, readTestData(t, "sample.igc"))
+	task := Task{
+		Start: TaskPoint{Name: "Start", Lat: 60.795, Lon: 10.69, Radius: 400},
+		Goal:  TaskPoint{Name: "Goal", Lat: 60.8139, Lon: 10.73198, Radius: 400},
+	}
+	task.validate()
+	task.ID, task.Tracks = "task1", []string{}
+	taskDataBase.Add(task)
+
+	w := httptest.NewRecorder()
+	taskTracksHandler(w, httptest.NewRequest("POST", "/paragliding/api/task/task1/tracks", strings.NewReader(`"`+trackID+`"`)))
+	events := queuedEvents(t, hook)
+	if w.Code != http.StatusOK || eventTypesOf(events) != "task.results_updated" {
+		t.Fatalf("submitting a track gave %d and events %v", w.Code, eventTypesOf(events))
+	}
+	var data TaskResultsEvent
+	raw, _ := json.Marshal(events[0].Data)
+	json.Unmarshal(raw, &data)
+	if data.Task != "task1" || data.Track != trackID || len(data.Results.Results) != 1 || !data.Results.Results[0].Goal {
+		t.Errorf("task.results_updated data is %+v", data)
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marni/goigc"
+)
+
+// Media types a track can be served as
+const (
+	mediaJSON    = "application/json"
+	mediaGPX     = "application/gpx+xml"
+	mediaGeoJSON = "application/geo+json"
+	mediaKML     = "application/vnd.google-earth.kml+xml"
+	mediaKMZ     = "application/vnd.google-earth.kmz"
+	mediaFIT     = "application/vnd.ant.fit"
+)
+
+// Offered by GET /paragliding/api/track/{id}, the first one by default
+var trackMediaTypes = []string{mediaJSON, mediaGPX, mediaGeoJSON, mediaKML, mediaKMZ}
+
+// Picks the media type of trackMediaTypes the Accept header prefers, or ""
+// if none is acceptable. Without an Accept header it is the default.
+func negotiateTrack(accept string) string {
+	if strings.TrimSpace(accept) == "" {
+		return trackMediaTypes[0]
+	}
+	type choice struct {
+		mediaType string
+		q         float64
+	}
+	choices := []choice{}
+	for _, entry := range strings.Split(accept, ",") {
+		params := strings.Split(entry, ";")
+		c := choice{strings.ToLower(strings.TrimSpace(params[0])), 1}
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					c.q = q
+				}
+			}
+		}
+		if c.q > 0 {
+			choices = append(choices, c)
+		}
+	}
+	sort.SliceStable(choices, func(i, j int) bool { return choices[i].q > choices[j].q })
+
+	for _, c := range choices {
+		for _, offered := range trackMediaTypes {
+			if c.mediaType == offered || c.mediaType == "*/*" ||
+				c.mediaType == "application/*" && strings.HasPrefix(offered, "application/") {
+				return offered
+			}
+		}
+	}
+	return ""
+}
+
+// Loads the metadata and parsed IGC file of a track, answering with an
+// error if either can't be had
+func storedFlight(w http.ResponseWriter, id string) (Track, igc.Track, bool) {
+	meta, err := trackDataBase.Get(id)
+	if err != nil {
+		errorStore(w, err)
+		return meta, igc.Track{}, false
+	}
+	content, err := trackDataBase.GetIGC(id)
+	if err != nil {
+		errorStore(w, err)
+		return meta, igc.Track{}, false
+	}
+	track, err := parseTrack(content)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return meta, track, false
+	}
+	return meta, track, true
+}
+
+// Answers with the track in one of the trackMediaTypes other than JSON
+func writeTrackAs(w http.ResponseWriter, id string, mediaType string) {
+	meta, track, ok := storedFlight(w, id)
+	if !ok {
+		return
+	}
+	switch mediaType {
+	case mediaGPX:
+		writeGPX(w, meta, track)
+	case mediaGeoJSON:
+		writeGeoJSON(w, meta, track, false)
+	case mediaKML:
+		writeKML(w, meta, track, false)
+	case mediaKMZ:
+		writeKML(w, meta, track, true)
+	}
+}
+
+// Subset of GPX 1.1 used for tracks
+type gpxDocument struct {
+	XMLName   xml.Name   `xml:"http://www.topografix.com/GPX/1/1 gpx"`
+	Version   string     `xml:"version,attr"`
+	Creator   string     `xml:"creator,attr"`
+	Name      string     `xml:"metadata>name"`
+	Time      string     `xml:"metadata>time,omitempty"`
+	Waypoints []gpxPoint `xml:"wpt"`
+	TrackName string     `xml:"trk>name"`
+	Points    []gpxPoint `xml:"trk>trkseg>trkpt"`
+}
+
+type gpxPoint struct {
+	Lat         float64 `xml:"lat,attr"`
+	Lon         float64 `xml:"lon,attr"`
+	Elevation   int64   `xml:"ele"`
+	Time        string  `xml:"time,omitempty"`
+	Name        string  `xml:"name,omitempty"`
+	Description string  `xml:"desc,omitempty"`
+}
+
+func gpxPointOf(fix Fix) gpxPoint {
+	point := gpxPoint{Lat: fix.Lat, Lon: fix.Lon, Elevation: fix.Altitude}
+	if !fix.Time.IsZero() {
+		point.Time = fix.Time.Format(time.RFC3339)
+	}
+	return point
+}
+
+// Renders a flight as a GPX track at GNSS altitude, with waypoints for
+// takeoff, landing and the thermals
+func trackGPX(meta Track, track igc.Track) gpxDocument {
+	name := meta.ID + " " + meta.Pilot
+	doc := gpxDocument{Version: "1.1", Creator: "paragliding", Name: name, TrackName: name}
+	times := fixTimes(track)
+	if len(times) > 0 {
+		doc.Time = times[0].Format(time.RFC3339)
+	}
+	for i, point := range track.Points {
+		doc.Points = append(doc.Points, gpxPointOf(fixOf(point, times[i])))
+	}
+
+	takeoff, landing := gpxPointOf(meta.Stats.Takeoff), gpxPointOf(meta.Stats.Landing)
+	takeoff.Name, landing.Name = "Takeoff", "Landing"
+	doc.Waypoints = append(doc.Waypoints, takeoff, landing)
+	for i, thermal := range detectThermals(track) {
+		point := gpxPointOf(Fix{Time: thermal.Entry, Lat: thermal.Lat, Lon: thermal.Lon, Altitude: thermal.Base})
+		point.Name = "Thermal " + strconv.Itoa(i+1)
+		point.Description = strconv.FormatInt(thermal.Base, 10) + " m to " + strconv.FormatInt(thermal.Top, 10) +
+			" m, " + strconv.FormatFloat(thermal.Climb, 'f', 1, 64) + " m/s, " + thermal.Direction
+		doc.Waypoints = append(doc.Waypoints, point)
+	}
+	return doc
+}
+
+func writeGPX(w http.ResponseWriter, meta Track, track igc.Track) {
+	gpx, err := xml.MarshalIndent(trackGPX(meta, track), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", mediaGPX)
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+meta.ID+".gpx\"")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(xml.Header))
+	w.Write(gpx)
+}
+
+// GeoJSON (RFC 7946) types. Coordinates are longitude, latitude, altitude.
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   geoJSONGeometry        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJSONGeometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+type geoJSONCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+func geoJSONPoint(fix Fix, properties map[string]interface{}) geoJSONFeature {
+	return geoJSONFeature{
+		Type:       "Feature",
+		Geometry:   geoJSONGeometry{"Point", []float64{fix.Lon, fix.Lat, float64(fix.Altitude)}},
+		Properties: properties,
+	}
+}
+
+// The flight as a LineString at GNSS altitude. The time and pressure
+// altitude of each fix are in the times and pressure_altitudes properties.
+func trackGeoJSON(meta Track, track igc.Track) geoJSONFeature {
+	times := fixTimes(track)
+	coordinates := make([][]float64, len(track.Points))
+	stamps := make([]string, len(track.Points))
+	altitudes := make([]int64, len(track.Points))
+	pressureAltitudes := make([]int64, len(track.Points))
+	for i, point := range track.Points {
+		coordinates[i] = []float64{point.Lng.Degrees(), point.Lat.Degrees(), float64(point.GNSSAltitude)}
+		stamps[i] = times[i].Format(time.RFC3339)
+		altitudes[i] = point.GNSSAltitude
+		pressureAltitudes[i] = point.PressureAltitude
+	}
+	return geoJSONFeature{
+		Type:     "Feature",
+		Geometry: geoJSONGeometry{"LineString", coordinates},
+		Properties: map[string]interface{}{
+			"id":                 meta.ID,
+			"pilot":              meta.Pilot,
+			"glider":             meta.Glider,
+			"glider_id":          meta.GliderID,
+			"track_length":       meta.TrackLength,
+			"times":              stamps,
+			"altitudes":          altitudes,
+			"pressure_altitudes": pressureAltitudes,
+		},
+	}
+}
+
+// The flight together with points for takeoff, landing and the thermals,
+// told apart by their event property
+func trackGeoJSONEvents(meta Track, track igc.Track) geoJSONCollection {
+	collection := geoJSONCollection{Type: "FeatureCollection"}
+	collection.Features = append(collection.Features,
+		trackGeoJSON(meta, track),
+		geoJSONPoint(meta.Stats.Takeoff, map[string]interface{}{"event": "takeoff", "time": meta.Stats.Takeoff.Time}),
+		geoJSONPoint(meta.Stats.Landing, map[string]interface{}{"event": "landing", "time": meta.Stats.Landing.Time}))
+	for _, thermal := range detectThermals(track) {
+		fix := Fix{Lat: thermal.Lat, Lon: thermal.Lon, Altitude: thermal.Base}
+		collection.Features = append(collection.Features, geoJSONPoint(fix, map[string]interface{}{
+			"event":     "thermal",
+			"entry":     thermal.Entry,
+			"exit":      thermal.Exit,
+			"base":      thermal.Base,
+			"top":       thermal.Top,
+			"climb":     thermal.Climb,
+			"direction": thermal.Direction,
+		}))
+	}
+	return collection
+}
+
+func writeGeoJSON(w http.ResponseWriter, meta Track, track igc.Track, events bool) {
+	var value interface{} = trackGeoJSON(meta, track)
+	if events {
+		value = trackGeoJSONEvents(meta, track)
+	}
+	geojson, err := json.Marshal(value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", mediaGeoJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(geojson)
+}
+
+// GET /paragliding/api/track/{id}/gpx
+func gpxHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	meta, track, ok := storedFlight(w, parts[len(parts)-2])
+	if !ok {
+		return
+	}
+	writeGPX(w, meta, track)
+}
+
+// GET /paragliding/api/track/{id}/geojson gives the flight as a Feature,
+// with ?events=true as a FeatureCollection that also holds its events
+func geojsonHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	events, err := strconv.ParseBool(r.URL.Query().Get("events"))
+	if err != nil && r.URL.Query().Get("events") != "" {
+		http.Error(w, "events must be true or false", http.StatusBadRequest)
+		return
+	}
+	meta, track, ok := storedFlight(w, parts[len(parts)-2])
+	if !ok {
+		return
+	}
+	writeGeoJSON(w, meta, track, events)
+}
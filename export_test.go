@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiateTrack(t *testing.T) {
+	tests := map[string]string{
+		"":                                     mediaJSON,
+		"*/*":                                  mediaJSON,
+		"application/geo+json":                 mediaGeoJSON,
+		"text/html, application/gpx+xml;q=0.9": mediaGPX,
+		"application/json;q=0.5, application/vnd.google-earth.kml+xml": mediaKML,
+		"application/gpx+xml;q=0, application/*":                       mediaJSON,
+		"text/html":                                                    "",
+	}
+	for accept, want := range tests {
+		if mediaType := negotiateTrack(accept); mediaType != want {
+			t.Errorf("Accept %q gave %q, want %q", accept, mediaType, want)
+		}
+	}
+}
+
+func TestGPXHandler(t *testing.T) {
+	setupMemStores(t)
+	id := postIGC(t, readTestData(t, "sample.igc"))
+
+	w := httptest.NewRecorder()
+	gpxHandler(w, httptest.NewRequest("GET", "/paragliding/api/track/"+id+"/gpx", nil))
+	var gpx gpxDocument
+	if err := xml.Unmarshal(w.Body.Bytes(), &gpx); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("GET gpx gave %d: %v", w.Code, err)
+	}
+	if len(gpx.Points) != 230 || gpx.Points[0].Time != "2018-09-02T11:00:00Z" || math.Abs(gpx.Points[0].Lat-60.795) > 1e-6 {
+		t.Errorf("GPX track starts %+v with %d points", gpx.Points[0], len(gpx.Points))
+	}
+	if len(gpx.Waypoints) != 3 || gpx.Waypoints[2].Name != "Thermal 1" {
+		t.Errorf("GPX waypoints are %+v", gpx.Waypoints)
+	}
+}
+
+func TestGeoJSONHandler(t *testing.T) {
+	setupMemStores(t)
+	id := postIGC(t, readTestData(t, "sample.igc"))
+
+	w := httptest.NewRecorder()
+	geojsonHandler(w, httptest.NewRequest("GET", "/paragliding/api/track/"+id+"/geojson", nil))
+	var feature struct {
+		Type     string
+		Geometry struct {
+			Type        string
+			Coordinates [][]float64
+		}
+		Properties struct {
+			Times     []string
+			Altitudes []int64
+		}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &feature); err != nil || w.Header().Get("Content-Type") != mediaGeoJSON {
+		t.Fatalf("GET geojson gave %d %q: %v", w.Code, w.Header().Get("Content-Type"), err)
+	}
+	first := feature.Geometry.Coordinates[0]
+	if feature.Type != "Feature" || feature.Geometry.Type != "LineString" || len(feature.Geometry.Coordinates) != 230 ||
+		math.Abs(first[0]-10.69) > 1e-6 || math.Abs(first[1]-60.795) > 1e-6 || first[2] != float64(feature.Properties.Altitudes[0]) ||
+		len(feature.Properties.Times) != 230 {
+		t.Errorf("GeoJSON feature is %v, %v starting at %v", feature.Type, feature.Geometry.Type, first)
+	}
+
+	w = httptest.NewRecorder()
+	geojsonHandler(w, httptest.NewRequest("GET", "/paragliding/api/track/"+id+"/geojson?events=true", nil))
+	var collection struct {
+		Type     string
+		Features []struct {
+			Geometry struct {
+				Type string
+			}
+			Properties map[string]interface{}
+		}
+	}
+	json.Unmarshal(w.Body.Bytes(), &collection)
+	if collection.Type != "FeatureCollection" || len(collection.Features) != 4 ||
+		collection.Features[1].Properties["event"] != "takeoff" || collection.Features[3].Properties["event"] != "thermal" {
+		t.Errorf("GeoJSON with events is %v", w.Body.String()[:200])
+	}
+
+	w = httptest.NewRecorder()
+	geojsonHandler(w, httptest.NewRequest("GET", "/paragliding/api/track/"+id+"/geojson?events=some", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("events=some gave %d, want 400", w.Code)
+	}
+}
+
+func TestIdHandler_Accept(t *testing.T) {
+	setupMemStores(t)
+	id := postIGC(t, readTestData(t, "sample.igc"))
+
+	tests := map[string]int{
+		"":                http.StatusOK,
+		mediaGPX:          http.StatusOK,
+		mediaGeoJSON:      http.StatusOK,
+		mediaKMZ:          http.StatusOK,
+		"text/html;q=0.8": http.StatusNotAcceptable,
+	}
+	for accept, want := range tests {
+		r := httptest.NewRequest("GET", "/paragliding/api/track/"+id, nil)
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		idHandler(w, r)
+		if w.Code != want {
+			t.Errorf("Accept %q gave %d, want %d", accept, w.Code, want)
+		}
+		if want == http.StatusOK && accept != "" && w.Header().Get("Content-Type") != accept {
+			t.Errorf("Accept %q gave Content-Type %q", accept, w.Header().Get("Content-Type"))
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Reasons a remote track file could not be fetched, reported as the
+// error_code of the job
+const (
+	fetchInvalidURL      = "invalid_url"
+	fetchSchemeForbidden = "scheme_not_allowed"
+	fetchAddressBlocked  = "address_blocked"
+	fetchTooManyRedirect = "too_many_redirects"
+	fetchTimeout         = "timeout"
+	fetchTooLarge        = "too_large"
+	fetchHTTPStatus      = "http_status"
+	fetchConnection      = "connection_failed"
+)
+
+// fetchError is a failure to fetch a remote file. Status is set for
+// fetchHTTPStatus.
+type fetchError struct {
+	Code   string
+	Err    error
+	Status int
+}
+
+func (e *fetchError) Error() string {
+	return e.Code + ": " + e.Err.Error()
+}
+
+func (e *fetchError) Unwrap() error {
+	return e.Err
+}
+
+// Whether another attempt could go better
+func (e *fetchError) temporary() bool {
+	return e.Code == fetchTimeout || e.Code == fetchConnection ||
+		e.Status >= 500 || e.Status == http.StatusTooManyRequests
+}
+
+// fetcher downloads the track files posted by URL, guarding the server
+// against slow, endless and huge responses and against being used to probe
+// the internal network
+type fetcher struct {
+	ConnectTimeout time.Duration
+	Timeout        time.Duration // for a whole attempt, body included
+	MaxSize        int64
+	Schemes        []string
+	AllowPrivate   bool // allow loopback, private and link-local addresses
+	MaxRedirects   int
+	Retries        int           // further attempts after temporary failures
+	Backoff        time.Duration // before the first retry, doubling after that
+
+	once   sync.Once
+	client *http.Client
+}
+
+func newFetcherFromEnv() *fetcher {
+	return &fetcher{
+		ConnectTimeout: getEnvDuration("FETCH_CONNECT_TIMEOUT", 5*time.Second),
+		Timeout:        getEnvDuration("FETCH_TIMEOUT", 30*time.Second),
+		MaxSize:        int64(getEnvInt("FETCH_MAX_SIZE", maxUploadSize)),
+		Schemes:        strings.Split(getEnv("FETCH_SCHEMES", "http,https"), ","),
+		AllowPrivate:   getEnv("FETCH_ALLOW_PRIVATE", "false") == "true",
+		MaxRedirects:   getEnvInt("FETCH_MAX_REDIRECTS", 5),
+		Retries:        getEnvInt("FETCH_RETRIES", 2),
+		Backoff:        getEnvDuration("FETCH_BACKOFF", time.Second),
+	}
+}
+
+// The fetcher of trackHandler
+var remote = newFetcherFromEnv()
+
+// Blocked unless AllowPrivate is set. Go 1.15 has no IP.IsPrivate.
+var privateNetworks = func() []*net.IPNet {
+	networks := []*net.IPNet{}
+	for _, cidr := range []string{
+		"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", // RFC 1918
+		"100.64.0.0/10", // carrier-grade NAT
+		"fc00::/7",      // unique local
+	} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+func blockedIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks a URL before anything is fetched from it
+func (f *fetcher) check(rawURL string) (*url.URL, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Scheme == "" {
+		return nil, &fetchError{Code: fetchInvalidURL, Err: fmt.Errorf("%q is not an absolute URL", rawURL)}
+	}
+	allowed := false
+	for _, scheme := range f.Schemes {
+		allowed = allowed || strings.EqualFold(parsed.Scheme, strings.TrimSpace(scheme))
+	}
+	if !allowed {
+		return nil, &fetchError{Code: fetchSchemeForbidden, Err: fmt.Errorf("scheme %q is not allowed", parsed.Scheme)}
+	}
+	if parsed.Host == "" {
+		return nil, &fetchError{Code: fetchInvalidURL, Err: fmt.Errorf("%q has no host", rawURL)}
+	}
+	return parsed, nil
+}
+
+func (f *fetcher) httpClient() *http.Client {
+	f.once.Do(f.newClient)
+	return f.client
+}
+
+func (f *fetcher) newClient() {
+	dialer := &net.Dialer{
+		Timeout: f.ConnectTimeout,
+		// Checked on the address actually dialled, so a host name can't
+		// resolve to a public address first and a private one later
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip != nil && !f.AllowPrivate && blockedIP(ip) {
+				return &fetchError{Code: fetchAddressBlocked, Err: fmt.Errorf("address %v is not allowed", ip)}
+			}
+			return nil
+		},
+	}
+	f.client = &http.Client{
+		Timeout: f.Timeout,
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   f.ConnectTimeout,
+			ResponseHeaderTimeout: f.Timeout,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       90 * time.Second,
+		},
+		CheckRedirect: func(r *http.Request, via []*http.Request) error {
+			if len(via) > f.MaxRedirects {
+				return &fetchError{Code: fetchTooManyRedirect, Err: fmt.Errorf("more than %d redirects", f.MaxRedirects)}
+			}
+			_, err := f.check(r.URL.String())
+			return err
+		},
+	}
+}
+
+// Downloads the file at rawURL, retrying temporary failures
+func (f *fetcher) fetch(rawURL string) ([]byte, error) {
+	if _, err := f.check(rawURL); err != nil {
+		return nil, err
+	}
+	backoff := f.Backoff
+	for attempt := 0; ; attempt++ {
+		content, err := f.attempt(rawURL)
+		var fetchErr *fetchError
+		if err == nil || attempt >= f.Retries || !errors.As(err, &fetchErr) || !fetchErr.temporary() {
+			return content, err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (f *fetcher) attempt(rawURL string) ([]byte, error) {
+	resp, err := f.httpClient().Get(rawURL)
+	if err != nil {
+		return nil, classifyFetchError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &fetchError{Code: fetchHTTPStatus, Err: errors.New(resp.Status), Status: resp.StatusCode}
+	}
+	if resp.ContentLength > f.MaxSize {
+		return nil, &fetchError{Code: fetchTooLarge, Err: fmt.Errorf("file is %d bytes, more than %d", resp.ContentLength, f.MaxSize)}
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, f.MaxSize+1))
+	if err != nil {
+		return nil, classifyFetchError(err)
+	}
+	if int64(len(content)) > f.MaxSize {
+		return nil, &fetchError{Code: fetchTooLarge, Err: fmt.Errorf("file is more than %d bytes", f.MaxSize)}
+	}
+	return content, nil
+}
+
+// Gives errors of the http client one of the fetch* codes
+func classifyFetchError(err error) error {
+	var fetchErr *fetchError
+	if errors.As(err, &fetchErr) {
+		return fetchErr
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		return &fetchError{Code: fetchTimeout, Err: err}
+	}
+	return &fetchError{Code: fetchConnection, Err: err}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBlockedIP(t *testing.T) {
+	tests := map[string]bool{
+		"127.0.0.1": true, "10.1.2.3": true, "172.20.0.1": true, "192.168.1.1": true,
+		"169.254.169.254": true, "100.64.0.1": true, "0.0.0.0": true, "::1": true, "fd00::1": true,
+		"8.8.8.8": false, "172.32.0.1": false, "2001:4860:4860::8888": false,
+	}
+	for ip, want := range tests {
+		if blockedIP(net.ParseIP(ip)) != want {
+			t.Errorf("blockedIP(%v) = %v", ip, !want)
+		}
+	}
+}
+
+// A fetcher for the test server, which is on the loopback address
+func testFetcher() *fetcher {
+	return &fetcher{
+		ConnectTimeout: time.Second,
+		Timeout:        time.Second,
+		MaxSize:        100,
+		Schemes:        []string{"http"},
+		AllowPrivate:   true,
+		MaxRedirects:   2,
+		Retries:        2,
+		Backoff:        time.Millisecond,
+	}
+}
+
+func fetchCode(err error) string {
+	var fetchErr *fetchError
+	if errors.As(err, &fetchErr) {
+		return fetchErr.Code
+	}
+	return ""
+}
+
+func TestFetcher(t *testing.T) {
+	hits := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits[r.URL.Path]++
+		switch r.URL.Path {
+		case "/flight.igc":
+			w.Write([]byte("AXXX"))
+		case "/flaky":
+			if hits[r.URL.Path] < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte("AXXX"))
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		case "/huge":
+			w.Write([]byte(strings.Repeat("B", 1000)))
+		case "/endless":
+			for i := 0; i < 1000; i++ {
+				if _, err := w.Write([]byte("BBBBBBBBBB")); err != nil {
+					return
+				}
+				w.(http.Flusher).Flush()
+				time.Sleep(10 * time.Millisecond)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	f := testFetcher()
+	if content, err := f.fetch(server.URL + "/flaky"); err != nil || string(content) != "AXXX" || hits["/flaky"] != 3 {
+		t.Errorf("flaky server gave %q, %v after %d attempts", content, err, hits["/flaky"])
+	}
+	tests := map[string]string{
+		"/flight.igc": "",
+		"/missing":    fetchHTTPStatus,
+		"/loop":       fetchTooManyRedirect,
+		"/huge":       fetchTooLarge,
+		"/endless":    fetchTooLarge,
+	}
+	for path, want := range tests {
+		if _, err := f.fetch(server.URL + path); fetchCode(err) != want {
+			t.Errorf("fetching %v gave %v, want %v", path, err, want)
+		}
+	}
+	if hits["/missing"] != 1 {
+		t.Errorf("404 was tried %d times, want once", hits["/missing"])
+	}
+
+	f = testFetcher()
+	f.MaxSize, f.Retries, f.Timeout = 1000, 0, 200*time.Millisecond
+	if _, err := f.fetch(server.URL + "/endless"); fetchCode(err) != fetchTimeout {
+		t.Errorf("endless response gave %v, want %v", err, fetchTimeout)
+	}
+
+	f = testFetcher()
+	f.AllowPrivate = false
+	if _, err := f.fetch(server.URL + "/flight.igc"); fetchCode(err) != fetchAddressBlocked {
+		t.Errorf("loopback server gave %v, want %v", err, fetchAddressBlocked)
+	}
+	for url, want := range map[string]string{"ftp://example.com/a.igc": fetchSchemeForbidden, "flight.igc": fetchInvalidURL, "http:///a.igc": fetchInvalidURL} {
+		if _, err := f.fetch(url); fetchCode(err) != want {
+			t.Errorf("fetching %v gave %v, want %v", url, err, want)
+		}
+	}
+}
+
+func TestTrackHandler_URL(t *testing.T) {
+	setupMemStores(t)
+	post := func(url string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(url)
+		r := httptest.NewRequest("POST", "/paragliding/api/track/", strings.NewReader(string(body)))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		trackHandler(w, r)
+		return w
+	}
+
+	w := post("file:///etc/passwd")
+	if w.Code != http.StatusBadRequest || !strings.HasPrefix(w.Body.String(), fetchSchemeForbidden) {
+		t.Errorf("file URL gave %d %q", w.Code, w.Body.String())
+	}
+
+	w = post("http://127.0.0.1:1/flight.igc")
+	var job Job
+	json.Unmarshal(w.Body.Bytes(), &job)
+	if job = waitJob(t, job.ID); job.Status != jobFailed || job.ErrorCode != fetchAddressBlocked {
+		t.Errorf("loopback URL ended as %+v", job)
+	}
+
+	// The same flight submitted twice at once is stored once, and both
+	// jobs point at it
+	content := readTestData(t, "sample.igc")
+	var arrived sync.WaitGroup
+	arrived.Add(2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived.Done()
+		arrived.Wait()
+		w.Write(content)
+	}))
+	defer server.Close()
+	defer func(saved *fetcher) { remote = saved }(remote)
+	remote = testFetcher()
+	remote.MaxSize = int64(len(content))
+	results := []Job{}
+	for _, w := range []*httptest.ResponseRecorder{post(server.URL + "/a.igc"), post(server.URL + "/b.igc")} {
+		var job Job
+		json.Unmarshal(w.Body.Bytes(), &job)
+		results = append(results, waitJob(t, job.ID))
+	}
+	if results[0].Status != jobDone || results[1].Status != jobDone || results[0].TrackID != results[1].TrackID ||
+		results[0].Duplicate == results[1].Duplicate {
+		t.Errorf("concurrent submissions ended as %+v", results)
+	}
+	if count, _ := trackDataBase.Count(); count != 1 {
+		t.Errorf("%d tracks stored, want 1", count)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/marni/goigc"
+)
+
+// File formats tracks can be added from. Tracks added before GPX and FIT
+// were accepted have an empty format and are IGC.
+const (
+	formatIGC = "igc"
+	formatGPX = "gpx"
+	formatFIT = "fit"
+)
+
+// Media types of the original files of every format
+var sourceMediaTypes = map[string]string{formatIGC: "text/plain; charset=utf-8", formatGPX: mediaGPX, formatFIT: mediaFIT}
+
+// Tells the format of a track file from its content
+func sourceFormat(content []byte) string {
+	if len(content) >= 12 && string(content[8:12]) == ".FIT" {
+		return formatFIT
+	}
+	head := bytes.TrimPrefix(bytes.TrimSpace(content), []byte("\xef\xbb\xbf"))
+	if bytes.HasPrefix(head, []byte("<")) && bytes.Contains(content, []byte("<gpx")) {
+		return formatGPX
+	}
+	return formatIGC
+}
+
+// Parses a track file of any of the supported formats. GPX and FIT files
+// are converted to the model of the igc library, with the date of the
+// first fix as flight date.
+func parseTrack(content []byte) (igc.Track, error) {
+	switch sourceFormat(content) {
+	case formatGPX:
+		return parseGPX(content)
+	case formatFIT:
+		return parseFIT(content)
+	}
+	return parseIGC(content)
+}
+
+// Hash used to recognise a flight that is submitted again, see
+// canonicalHash. Converted files are recognised by their pilot and fixes.
+func flightHash(content []byte, track igc.Track) string {
+	if sourceFormat(content) == formatIGC {
+		return canonicalHash(content)
+	}
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%v\n%v\n", track.Pilot, track.Date.Format("2006-01-02"))
+	for _, point := range track.Points {
+		fmt.Fprintf(hash, "%v %.6f %.6f %d\n", point.Time.Format(igc.TimeFormat),
+			point.Lat.Degrees(), point.Lng.Degrees(), point.GNSSAltitude)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// A fix read from a GPX or FIT file
+type importedFix struct {
+	Time     time.Time
+	Lat      float64
+	Lon      float64
+	Altitude float64 // m
+}
+
+// Builds a track the way the igc library would have parsed it. GPX and
+// FIT have a single altitude, which is used as both GNSS and pressure
+// altitude.
+func importedTrack(fixes []importedFix, pilot string) (igc.Track, error) {
+	track := igc.NewTrack()
+	if len(fixes) == 0 {
+		return track, errors.New("no track points in file")
+	}
+	first := fixes[0].Time.UTC()
+	track.Date = time.Date(first.Year(), first.Month(), first.Day(), 0, 0, 0, 0, time.UTC)
+	track.Pilot = pilot
+	for _, fix := range fixes {
+		at := fix.Time.UTC()
+		point := igc.NewPointFromLatLng(fix.Lat, fix.Lon)
+		point.Time = time.Date(0, 1, 1, at.Hour(), at.Minute(), at.Second(), 0, time.UTC) // time of day, as in B records
+		point.GNSSAltitude = int64(math.Round(fix.Altitude))
+		point.PressureAltitude = point.GNSSAltitude
+		track.Points = append(track.Points, point)
+	}
+	return track, nil
+}
+
+// The parts of GPX 1.0 and 1.1 files read on import
+type gpxImport struct {
+	Author   string `xml:"metadata>author>name"` // GPX 1.1
+	Author10 string `xml:"author"`               // GPX 1.0
+	Tracks   []struct {
+		Segments []struct {
+			Points []struct {
+				Lat       float64   `xml:"lat,attr"`
+				Lon       float64   `xml:"lon,attr"`
+				Elevation float64   `xml:"ele"`
+				Time      time.Time `xml:"time"`
+			} `xml:"trkpt"`
+		} `xml:"trkseg"`
+	} `xml:"trk"`
+}
+
+// Reads the track points of a GPX file, all tracks and segments in order.
+// The author is taken as the pilot.
+func parseGPX(content []byte) (igc.Track, error) {
+	var gpx gpxImport
+	if err := xml.Unmarshal(content, &gpx); err != nil {
+		return igc.NewTrack(), err
+	}
+	fixes := []importedFix{}
+	for _, track := range gpx.Tracks {
+		for _, segment := range track.Segments {
+			for _, point := range segment.Points {
+				if point.Time.IsZero() {
+					return igc.NewTrack(), errors.New("GPX track point without time")
+				}
+				fixes = append(fixes, importedFix{point.Time, point.Lat, point.Lon, point.Elevation})
+			}
+		}
+	}
+	pilot := gpx.Author
+	if pilot == "" {
+		pilot = gpx.Author10
+	}
+	return importedTrack(fixes, pilot)
+}
+
+// FIT timestamps are seconds since this moment
+var fitEpoch = time.Date(1989, 12, 31, 0, 0, 0, 0, time.UTC)
+
+// Global number of FIT record messages and the fields read from them
+const (
+	fitRecord           = 20
+	fitLatitude         = 0
+	fitLongitude        = 1
+	fitAltitude         = 2
+	fitEnhancedAltitude = 78
+	fitTimestamp        = 253
+)
+
+type fitField struct {
+	Number byte
+	Size   int
+}
+
+// Layout of the data messages of a local message type
+type fitDefinition struct {
+	Global    uint16
+	ByteOrder binary.ByteOrder
+	Fields    []fitField
+	Size      int // of a data message, developer fields included
+}
+
+// CRC of FIT files
+func fitCRC(data []byte) uint16 {
+	table := [16]uint16{
+		0x0000, 0xCC01, 0xD801, 0x1400, 0xF001, 0x3C00, 0x2800, 0xE401,
+		0xA001, 0x6C00, 0x7800, 0xB401, 0x5000, 0x9C01, 0x8801, 0x4400,
+	}
+	var crc uint16
+	for _, b := range data {
+		crc = (crc >> 4) ^ table[crc&0xF] ^ table[b&0xF]
+		crc = (crc >> 4) ^ table[crc&0xF] ^ table[b>>4]
+	}
+	return crc
+}
+
+// Reads the record messages of a Garmin FIT activity file. Records without
+// a position, such as those logged before the GPS had a fix, are skipped.
+func parseFIT(content []byte) (igc.Track, error) {
+	truncated := errors.New("truncated FIT file")
+	if len(content) < 12 || string(content[8:12]) != ".FIT" {
+		return igc.NewTrack(), errors.New("not a FIT file")
+	}
+	headerSize := int(content[0])
+	end := headerSize + int(binary.LittleEndian.Uint32(content[4:8]))
+	if headerSize < 12 || end+2 > len(content) {
+		return igc.NewTrack(), truncated
+	}
+	// The CRC over the data and the CRC that follows it is 0
+	if fitCRC(content[:end+2]) != 0 {
+		return igc.NewTrack(), errors.New("FIT file fails its CRC check")
+	}
+
+	definitions := map[byte]*fitDefinition{}
+	fixes := []importedFix{}
+	var last uint32 // timestamp of the last message, for compressed ones
+	for pos := headerSize; pos < end; {
+		header := content[pos]
+		pos++
+
+		local, timestamp := header&0x0F, uint32(0)
+		if header&0x80 != 0 {
+			// Compressed timestamp header: five bits of seconds after last
+			local = header >> 5 & 0x03
+			offset := uint32(header & 0x1F)
+			timestamp = last&^0x1F | offset
+			if offset < last&0x1F {
+				timestamp += 0x20
+			}
+			last = timestamp
+		} else if header&0x40 != 0 {
+			if pos+5 > end {
+				return igc.NewTrack(), truncated
+			}
+			definition := &fitDefinition{ByteOrder: binary.LittleEndian}
+			if content[pos+1] == 1 {
+				definition.ByteOrder = binary.BigEndian
+			}
+			definition.Global = definition.ByteOrder.Uint16(content[pos+2 : pos+4])
+			fields := int(content[pos+4])
+			pos += 5
+			if pos+3*fields > end {
+				return igc.NewTrack(), truncated
+			}
+			for i := 0; i < fields; i++ {
+				field := fitField{content[pos], int(content[pos+1])}
+				definition.Fields = append(definition.Fields, field)
+				definition.Size += field.Size
+				pos += 3
+			}
+			if header&0x20 != 0 {
+				if pos >= end {
+					return igc.NewTrack(), truncated
+				}
+				developerFields := int(content[pos])
+				pos++
+				if pos+3*developerFields > end {
+					return igc.NewTrack(), truncated
+				}
+				for i := 0; i < developerFields; i++ {
+					definition.Size += int(content[pos+1])
+					pos += 3
+				}
+			}
+			definitions[local] = definition
+			continue
+		}
+
+		definition, ok := definitions[local]
+		if !ok {
+			return igc.NewTrack(), fmt.Errorf("FIT data message of undefined type %d", local)
+		}
+		if pos+definition.Size > end {
+			return igc.NewTrack(), truncated
+		}
+		message := content[pos : pos+definition.Size]
+		pos += definition.Size
+
+		lat, lon := int32(math.MaxInt32), int32(math.MaxInt32) // invalid values
+		altitude, hasAltitude := 0.0, false
+		for _, field := range definition.Fields {
+			value := message[:field.Size]
+			message = message[field.Size:]
+			switch {
+			case field.Number == fitTimestamp && field.Size == 4:
+				timestamp = definition.ByteOrder.Uint32(value)
+				last = timestamp
+			case field.Number == fitLatitude && field.Size == 4:
+				lat = int32(definition.ByteOrder.Uint32(value))
+			case field.Number == fitLongitude && field.Size == 4:
+				lon = int32(definition.ByteOrder.Uint32(value))
+			case field.Number == fitEnhancedAltitude && field.Size == 4:
+				if raw := definition.ByteOrder.Uint32(value); raw != math.MaxUint32 {
+					altitude, hasAltitude = float64(raw)/5-500, true
+				}
+			case field.Number == fitAltitude && field.Size == 2 && !hasAltitude:
+				if raw := definition.ByteOrder.Uint16(value); raw != math.MaxUint16 {
+					altitude = float64(raw)/5 - 500
+				}
+			}
+		}
+		if definition.Global != fitRecord || lat == math.MaxInt32 || lon == math.MaxInt32 || timestamp == 0 {
+			continue
+		}
+		// Positions are in semicircles, 2^31 of them to 180 degrees
+		fixes = append(fixes, importedFix{
+			Time:     fitEpoch.Add(time.Duration(timestamp) * time.Second),
+			Lat:      float64(lat) * 180 / math.Exp2(31),
+			Lon:      float64(lon) * 180 / math.Exp2(31),
+			Altitude: altitude,
+		})
+	}
+	return importedTrack(fixes, "")
+}
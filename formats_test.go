@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"math"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/marni/goigc"
+)
+
+// Writes the fixes of a track as a FIT file. Every other record has a
+// compressed timestamp header and the enhanced altitude field, and a
+// record without position comes first, as logged before a GPS fix.
+func encodeFIT(track igc.Track) []byte {
+	var data bytes.Buffer
+	le := binary.LittleEndian
+	write := func(values ...interface{}) {
+		for _, value := range values {
+			binary.Write(&data, le, value)
+		}
+	}
+	// Local type 0: timestamp, position and altitude; 1: position and
+	// enhanced altitude
+	write(byte(0x40), byte(0), byte(0), uint16(fitRecord), byte(4),
+		byte(fitTimestamp), byte(4), byte(0x86), byte(fitLatitude), byte(4), byte(0x85),
+		byte(fitLongitude), byte(4), byte(0x85), byte(fitAltitude), byte(2), byte(0x84))
+	write(byte(0x41), byte(0), byte(0), uint16(fitRecord), byte(3),
+		byte(fitLatitude), byte(4), byte(0x85), byte(fitLongitude), byte(4), byte(0x85),
+		byte(fitEnhancedAltitude), byte(4), byte(0x86))
+
+	semicircles := func(degrees float64) int32 {
+		return int32(math.Round(degrees * math.Exp2(31) / 180))
+	}
+	times := fixTimes(track)
+	start := uint32(times[0].Sub(fitEpoch).Seconds())
+	write(byte(0), start-1, int32(math.MaxInt32), int32(math.MaxInt32), uint16(math.MaxUint16))
+	for i, point := range track.Points {
+		timestamp := uint32(times[i].Sub(fitEpoch).Seconds())
+		lat, lon := semicircles(point.Lat.Degrees()), semicircles(point.Lng.Degrees())
+		if i%2 == 1 {
+			write(byte(0x80|0x20|timestamp&0x1F), lat, lon, uint32((point.GNSSAltitude+500)*5))
+		} else {
+			write(byte(0), timestamp, lat, lon, uint16((point.GNSSAltitude+500)*5))
+		}
+	}
+
+	var file bytes.Buffer
+	binary.Write(&file, le, []byte{14, 0x10})
+	binary.Write(&file, le, uint16(2093))
+	binary.Write(&file, le, uint32(data.Len()))
+	file.WriteString(".FIT")
+	binary.Write(&file, le, fitCRC(file.Bytes()))
+	file.Write(data.Bytes())
+	binary.Write(&file, le, fitCRC(file.Bytes()))
+	return file.Bytes()
+}
+
+func TestSourceFormat(t *testing.T) {
+	sample := readTestData(t, "sample.igc")
+	track, _ := parseIGC(sample)
+	tests := map[string][]byte{
+		formatIGC: sample,
+		formatGPX: []byte("\xef\xbb\xbf<?xml version=\"1.0\"?>\n<gpx version=\"1.1\"></gpx>"),
+		formatFIT: encodeFIT(track),
+	}
+	for want, content := range tests {
+		if format := sourceFormat(content); format != want {
+			t.Errorf("%v file taken for %v", want, format)
+		}
+	}
+}
+
+// Checks that a converted track has the fixes of the sample flight
+func checkConverted(t *testing.T, name string, converted igc.Track, original igc.Track) {
+	if len(converted.Points) != len(original.Points) {
+		t.Fatalf("%v has %d points, want %d", name, len(converted.Points), len(original.Points))
+	}
+	if !converted.Date.Equal(original.Date) {
+		t.Errorf("%v is dated %v, want %v", name, converted.Date, original.Date)
+	}
+	for i, point := range converted.Points {
+		want := original.Points[i]
+		if point.Time.Format(igc.TimeFormat) != want.Time.Format(igc.TimeFormat) ||
+			point.Distance(want) > 0.001 || point.GNSSAltitude != want.GNSSAltitude {
+			t.Fatalf("%v point %d is %v %v at %d m, want %v %v at %d m", name, i,
+				point.Time, point.LatLng, point.GNSSAltitude, want.Time, want.LatLng, want.GNSSAltitude)
+		}
+	}
+}
+
+func TestParseGPX(t *testing.T) {
+	original, _ := parseIGC(readTestData(t, "sample.igc"))
+	gpx, _ := xml.Marshal(trackGPX(Track{ID: "igc1"}, original))
+
+	converted, err := parseGPX(gpx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkConverted(t, "GPX", converted, original)
+
+	gpx10 := `<gpx version="1.0"><author>Anne</author><trk><trkseg>
+		<trkpt lat="60.1" lon="10.1"><ele>512.4</ele><time>2018-09-02T23:59:59Z</time></trkpt>
+		<trkpt lat="60.2" lon="10.2"><ele>520</ele><time>2018-09-03T00:00:09Z</time></trkpt>
+	</trkseg></trk></gpx>`
+	converted, err = parseGPX([]byte(gpx10))
+	if err != nil || converted.Pilot != "Anne" || len(converted.Points) != 2 || converted.Points[0].GNSSAltitude != 512 {
+		t.Errorf("GPX 1.0 gave %+v, %v", converted.Header, err)
+	}
+	if times := fixTimes(converted); !times[1].Equal(time.Date(2018, 9, 3, 0, 0, 9, 0, time.UTC)) {
+		t.Errorf("fix after midnight is at %v", times[1])
+	}
+
+	if _, err := parseGPX([]byte(`<gpx><trk><trkseg><trkpt lat="1" lon="2"/></trkseg></trk></gpx>`)); err == nil {
+		t.Error("GPX point without time gave no error")
+	}
+}
+
+func TestParseFIT(t *testing.T) {
+	original, _ := parseIGC(readTestData(t, "sample.igc"))
+	fit := encodeFIT(original)
+
+	converted, err := parseFIT(fit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkConverted(t, "FIT", converted, original)
+
+	corrupt := append([]byte(nil), fit...)
+	corrupt[len(corrupt)/2] ^= 0xFF
+	if _, err := parseFIT(corrupt); err == nil {
+		t.Error("corrupt FIT file gave no error")
+	}
+	if _, err := parseFIT(fit[:len(fit)-10]); err == nil {
+		t.Error("truncated FIT file gave no error")
+	}
+}
+
+func TestTrackHandler_Formats(t *testing.T) {
+	setupMemStores(t)
+	sample := readTestData(t, "sample.igc")
+	original, _ := parseIGC(sample)
+	gpx, _ := xml.Marshal(trackGPX(Track{ID: "igc1"}, original))
+
+	igcID := postIGC(t, sample)
+	igcTrack, _ := trackDataBase.Get(igcID)
+
+	// The FIT file has no pilot, so would be a duplicate of the GPX one
+	gpx = bytes.Replace(gpx, []byte("</metadata>"), []byte("<author><name>Anne</name></author></metadata>"), 1)
+	files := map[string][]byte{formatGPX: gpx, formatFIT: encodeFIT(original)}
+	for format, content := range files {
+		id := postIGC(t, content)
+		track, _ := trackDataBase.Get(id)
+		if track.Format != format || track.Validation != validationUnvalidated {
+			t.Errorf("%v track stored as %q, %q", format, track.Format, track.Validation)
+		}
+		if track.Stats.Duration != igcTrack.Stats.Duration || math.Abs(track.TrackLength-igcTrack.TrackLength) > 0.01 {
+			t.Errorf("%v track flew %v s and %v km, want %v s and %v km", format,
+				track.Stats.Duration, track.TrackLength, igcTrack.Stats.Duration, igcTrack.TrackLength)
+		}
+
+		if again := postIGC(t, content); again != id {
+			t.Errorf("second %v upload gave %q, want %q", format, again, id)
+		}
+
+		w := httptest.NewRecorder()
+		igcHandler(w, httptest.NewRequest("GET", "/paragliding/api/track/"+id+"/igc", nil))
+		if !bytes.Equal(w.Body.Bytes(), content) || w.Header().Get("Content-Disposition") != `attachment; filename="`+id+"."+format+`"` {
+			t.Errorf("original %v file served as %q", format, w.Header().Get("Content-Disposition"))
+		}
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// GAPParams are the competition parameters of the CIVL GAP formulas
+type GAPParams struct {
+	NominalDistance float64 `json:"nominal_distance"` // km
+	MinimumDistance float64 `json:"minimum_distance"` // km, every pilot who flew gets it
+	NominalTime     float64 `json:"nominal_time"`     // minutes
+	NominalGoal     float64 `json:"nominal_goal"`     // share of the pilots in goal, 0 to 1
+	NominalLaunch   float64 `json:"nominal_launch"`   // share of the pilots present who launch
+	PilotsPresent   int     `json:"pilots_present"`   // 0 when everyone present flew
+	NoLeading       bool    `json:"no_leading"`       // leave out leading points
+	NoArrival       bool    `json:"no_arrival"`       // leave out arrival points
+}
+
+// Defaults for the parameters a competition leaves out
+var defaultGAPParams = GAPParams{
+	NominalDistance: 35,
+	MinimumDistance: 5,
+	NominalTime:     90,
+	NominalGoal:     0.2,
+	NominalLaunch:   0.96,
+}
+
+// Fills in the defaults and checks the parameters
+func (p *GAPParams) validate() error {
+	if p.NominalDistance == 0 {
+		p.NominalDistance = defaultGAPParams.NominalDistance
+	}
+	if p.MinimumDistance == 0 {
+		p.MinimumDistance = defaultGAPParams.MinimumDistance
+	}
+	if p.NominalTime == 0 {
+		p.NominalTime = defaultGAPParams.NominalTime
+	}
+	if p.NominalGoal == 0 {
+		p.NominalGoal = defaultGAPParams.NominalGoal
+	}
+	if p.NominalLaunch == 0 {
+		p.NominalLaunch = defaultGAPParams.NominalLaunch
+	}
+	if p.NominalDistance < 0 || p.MinimumDistance < 0 || p.NominalTime < 0 || p.PilotsPresent < 0 {
+		return errors.New("scoring parameters can't be negative")
+	}
+	if p.MinimumDistance >= p.NominalDistance {
+		return errors.New("minimum distance must be shorter than the nominal distance")
+	}
+	if p.NominalGoal > 1 || p.NominalLaunch < 0 || p.NominalLaunch > 1 {
+		return errors.New("nominal goal and launch are shares between 0 and 1")
+	}
+	return nil
+}
+
+// GAPValidity tells how much a task is worth, each between 0 and 1
+type GAPValidity struct {
+	Launch   float64 `json:"launch"`
+	Distance float64 `json:"distance"`
+	Time     float64 `json:"time"`
+	Task     float64 `json:"task"`
+}
+
+// GAPWeights split the available points, they add up to 1
+type GAPWeights struct {
+	Distance float64 `json:"distance"`
+	Time     float64 `json:"time"`
+	Leading  float64 `json:"leading"`
+	Arrival  float64 `json:"arrival"`
+}
+
+// PilotScore is the result of one pilot in a task
+type PilotScore struct {
+	Rank             int     `json:"rank"`
+	TrackID          string  `json:"track"`
+	Pilot            string  `json:"pilot"`
+	Distance         float64 `json:"distance"` // km
+	ESS              bool    `json:"ess"`
+	Goal             bool    `json:"goal"`
+	SpeedSectionTime float64 `json:"speed_section_time,omitempty"` // s
+	DistancePoints   float64 `json:"distance_points"`
+	TimePoints       float64 `json:"time_points"`
+	LeadingPoints    float64 `json:"leading_points"`
+	ArrivalPoints    float64 `json:"arrival_points"`
+	Total            float64 `json:"total"`
+}
+
+// TaskScores are the ranked results of a task
+type TaskScores struct {
+	TaskID          string       `json:"task"`
+	TaskDistance    float64      `json:"task_distance"` // km
+	Validity        GAPValidity  `json:"validity"`
+	Weights         GAPWeights   `json:"weights"`
+	AvailablePoints float64      `json:"available_points"`
+	Results         []PilotScore `json:"results"`
+	Missing         []string     `json:"missing,omitempty"` // submitted tracks deleted since, left out of the results
+}
+
+// gapEntry is a track submitted for a task, followed through it
+type gapEntry struct {
+	Track  Track
+	Result TaskResult
+	Trace  []taskFix
+}
+
+// Leading coefficient: the area under the distance to ESS over the time
+// since the first start, counted where the pilot gets closer than ever.
+// Pilots who don't make ESS are charged the rest of the distance until end.
+// Lower is better.
+func leadingCoefficient(trace []taskFix, first, end time.Time, ssDistance float64) float64 {
+	if len(trace) == 0 || ssDistance == 0 {
+		return 0
+	}
+	lc := 0.0
+	best := ssDistance
+	for _, fix := range trace {
+		if fix.ToESS < best {
+			lc += fix.Time.Sub(first).Seconds() * (best*best - fix.ToESS*fix.ToESS)
+			best = fix.ToESS
+		}
+	}
+	if best > 0 {
+		lc += end.Sub(first).Seconds() * best * best
+	}
+	return lc / (1800 * ssDistance * ssDistance)
+}
+
+// Ranks the pilots of a task with the GAP formulas: distance, time,
+// leading and arrival points, scaled by how valid the task was
+func scoreTask(task Task, entries []gapEntry) TaskScores {
+	params := task.Scoring
+	distances := task.distances()
+	taskDistance := distances[len(distances)-1]
+	ssDistance := distances[task.essIndex()+1]
+	scores := TaskScores{TaskID: task.ID, TaskDistance: taskDistance, Results: []PilotScore{}}
+	flying := len(entries)
+	if flying == 0 {
+		return scores
+	}
+
+	// Best distance and time of the day, and the first start
+	bestDistance, bestTime := 0.0, 0.0
+	inGoal, atESS := 0, 0
+	var first, lastESS time.Time
+	for i := range entries {
+		result := &entries[i].Result
+		result.Distance = math.Max(result.Distance, params.MinimumDistance)
+		bestDistance = math.Max(bestDistance, result.Distance)
+		if result.Goal {
+			inGoal++
+		}
+		if result.ESS {
+			atESS++
+			if bestTime == 0 || result.SpeedSectionTime < bestTime {
+				bestTime = result.SpeedSectionTime
+			}
+			if result.ESSTime.After(lastESS) {
+				lastESS = *result.ESSTime
+			}
+		}
+		if result.Started && (first.IsZero() || result.StartTime.Before(first)) {
+			first = *result.StartTime
+		}
+	}
+
+	// Validity of the task
+	present := params.PilotsPresent
+	if present < flying {
+		present = flying
+	}
+	launch := math.Min(1, float64(flying)/(float64(present)*params.NominalLaunch))
+	scores.Validity.Launch = math.Min(1, 0.027*launch+2.917*launch*launch-1.944*launch*launch*launch)
+
+	sumDistance := 0.0
+	for _, entry := range entries {
+		sumDistance += math.Max(0, entry.Result.Distance-params.MinimumDistance)
+	}
+	nominalArea := ((params.NominalGoal+1)*(params.NominalDistance-params.MinimumDistance) +
+		math.Max(0, params.NominalGoal*(bestDistance-params.NominalDistance))) / 2
+	if nominalArea > 0 {
+		scores.Validity.Distance = math.Min(1, sumDistance/(float64(flying)*nominalArea))
+	}
+
+	timeRatio := bestDistance / params.NominalDistance
+	if atESS > 0 {
+		timeRatio = bestTime / (params.NominalTime * 60)
+	}
+	timeRatio = math.Min(1, timeRatio)
+	scores.Validity.Time = math.Max(0, math.Min(1, -0.271+2.912*timeRatio-2.098*timeRatio*timeRatio+0.457*timeRatio*timeRatio*timeRatio))
+	scores.Validity.Task = scores.Validity.Launch * scores.Validity.Distance * scores.Validity.Time
+	available := 1000 * scores.Validity.Task
+	scores.AvailablePoints = available
+
+	// Weights, from the share of pilots in goal
+	goalRatio := float64(inGoal) / float64(flying)
+	weights := &scores.Weights
+	weights.Distance = 0.9 - 1.665*goalRatio + 1.713*goalRatio*goalRatio - 0.587*goalRatio*goalRatio*goalRatio
+	if goalRatio > 0 {
+		if !params.NoLeading {
+			weights.Leading = (1 - weights.Distance) / 8 * 1.4
+		}
+		if !params.NoArrival {
+			weights.Arrival = (1 - weights.Distance) / 8
+		}
+		weights.Time = 1 - weights.Distance - weights.Leading - weights.Arrival
+	} else {
+		if !params.NoLeading && taskDistance > 0 {
+			weights.Leading = bestDistance / taskDistance * 0.1
+		}
+		weights.Distance = 1 - weights.Leading
+	}
+
+	// Leading coefficients, counted until the deadline or the last pilot at ESS
+	end := task.Deadline
+	if end.IsZero() {
+		end = lastESS
+	}
+	coefficients := make([]float64, len(entries))
+	minCoefficient := 0.0
+	for i, entry := range entries {
+		if !entry.Result.Started {
+			continue
+		}
+		pilotEnd := end
+		if pilotEnd.IsZero() && len(entry.Trace) > 0 {
+			pilotEnd = entry.Trace[len(entry.Trace)-1].Time
+		}
+		coefficients[i] = leadingCoefficient(entry.Trace, first, pilotEnd, ssDistance)
+		if coefficients[i] > 0 && (minCoefficient == 0 || coefficients[i] < minCoefficient) {
+			minCoefficient = coefficients[i]
+		}
+	}
+
+	// Arrival order at ESS
+	arrivals := []time.Time{}
+	for _, entry := range entries {
+		if entry.Result.ESS {
+			arrivals = append(arrivals, *entry.Result.ESSTime)
+		}
+	}
+	sort.Slice(arrivals, func(i, j int) bool { return arrivals[i].Before(arrivals[j]) })
+
+	for i, entry := range entries {
+		result := entry.Result
+		score := PilotScore{
+			TrackID:          entry.Track.ID,
+			Pilot:            entry.Track.Pilot,
+			Distance:         result.Distance,
+			ESS:              result.ESS,
+			Goal:             result.Goal,
+			SpeedSectionTime: result.SpeedSectionTime,
+		}
+		if bestDistance > 0 {
+			score.DistancePoints = result.Distance / bestDistance * weights.Distance * available
+		}
+
+		if result.ESS && bestTime > 0 {
+			hours := (result.SpeedSectionTime - bestTime) / 3600
+			speed := math.Max(0, 1-math.Pow(hours/math.Sqrt(bestTime/3600), 2.0/3))
+			score.TimePoints = speed * weights.Time * available
+
+			position := sort.Search(len(arrivals), func(k int) bool { return !arrivals[k].Before(*result.ESSTime) })
+			arrival := 1 - float64(position)/float64(len(arrivals))
+			factor := 0.2 + 0.037*arrival + 0.13*arrival*arrival + 0.633*arrival*arrival*arrival
+			score.ArrivalPoints = factor * weights.Arrival * available
+		}
+		if coefficients[i] > 0 {
+			leading := math.Max(0, 1-math.Pow((coefficients[i]-minCoefficient)/math.Sqrt(minCoefficient), 2.0/3))
+			score.LeadingPoints = leading * weights.Leading * available
+		}
+
+		score.Total = score.DistancePoints + score.TimePoints + score.LeadingPoints + score.ArrivalPoints
+		scores.Results = append(scores.Results, score)
+	}
+
+	sort.SliceStable(scores.Results, func(i, j int) bool {
+		return scores.Results[i].Total > scores.Results[j].Total
+	})
+	for i := range scores.Results {
+		scores.Results[i].Rank = i + 1
+		if i > 0 && scores.Results[i].Total == scores.Results[i-1].Total {
+			scores.Results[i].Rank = scores.Results[i-1].Rank
+		}
+	}
+	return scores
+}
+
+// POST /paragliding/api/task/{id}/tracks submits a stored track for a
+// task, given as its id in a JSON string. GET lists the submitted tracks.
+func taskTracksHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	id := parts[len(parts)-2]
+
+	task, err := taskDataBase.Get(id)
+	if err != nil {
+		errorStore(w, err)
+		return
+	}
+	if r.Method == "GET" {
+		writeJSON(w, append([]string{}, task.Tracks...))
+		return
+	} else if r.Method != "POST" {
+		error400(w)
+		return
+	}
+
+	var trackID string
+	if err := json.NewDecoder(r.Body).Decode(&trackID); err != nil {
+		error400(w)
+		return
+	}
+	if _, err := trackDataBase.Get(trackID); err != nil {
+		errorStore(w, err)
+		return
+	}
+	task, err = taskDataBase.AddTrack(id, trackID)
+	if err != nil {
+		errorStore(w, err)
+		return
+	}
+	if len(subscribers(eventTaskResults)) > 0 {
+		if scores, err := taskScores(task); err != nil {
+			log.Printf("scoring task %v: %v", task.ID, err)
+		} else {
+			emitEvent(eventTaskResults, TaskResultsEvent{task.ID, trackID, scores})
+		}
+	}
+	writeJSON(w, task.Tracks)
+}
+
+// GET /paragliding/api/task/{id}/results scores every track submitted for
+// the task
+func resultsHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	id := parts[len(parts)-2]
+
+	task, err := taskDataBase.Get(id)
+	if err != nil {
+		errorStore(w, err)
+		return
+	}
+	scores, err := taskScores(task)
+	if errors.Is(err, ErrNotFound) || errors.Is(err, ErrUnavailable) {
+		errorStore(w, err)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, scores)
+}
+
+// Scores every track submitted for the task. Tracks deleted since they
+// were submitted are listed as missing.
+func taskScores(task Task) (TaskScores, error) {
+	if err := task.Scoring.validate(); err != nil {
+		return TaskScores{}, err
+	}
+
+	entries := []gapEntry{}
+	missing := []string{}
+	for _, trackID := range task.Tracks {
+		track, err := trackDataBase.Get(trackID)
+		if errors.Is(err, ErrNotFound) {
+			missing = append(missing, trackID)
+			continue
+		}
+		if err != nil {
+			return TaskScores{}, err
+		}
+		content, err := trackDataBase.GetIGC(trackID)
+		if errors.Is(err, ErrNotFound) {
+			missing = append(missing, trackID)
+			continue
+		}
+		if err != nil {
+			return TaskScores{}, err
+		}
+		flight, err := parseTrack(content)
+		if err != nil {
+			return TaskScores{}, err
+		}
+		result, trace := followTask(task, flight)
+		entries = append(entries, gapEntry{Track: track, Result: result, Trace: trace})
+	}
+	scores := scoreTask(task, entries)
+	if len(missing) > 0 {
+		scores.Missing = missing
+	}
+	return scores, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestScoreTask(t *testing.T) {
+	a, b := [2]float64{60, 10}, [2]float64{60, 10.2}
+	task := Task{
+		ID:      "task1",
+		Start:   TaskPoint{Name: "Start", Lat: 60, Lon: 10, Radius: 1000},
+		Goal:    TaskPoint{Name: "Goal", Lat: 60, Lon: 10.2, Radius: 400},
+		Scoring: GAPParams{NominalDistance: 10, MinimumDistance: 2, NominalTime: 10},
+	}
+	if err := task.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	flights := map[string][][2]float64{
+		"fast":  {a, b},
+		"slow":  {a, {60, 10.1}, b}, // twice as many fixes
+		"short": {a, {60, 10.12}},
+	}
+	entries := []gapEntry{}
+	for _, pilot := range []string{"short", "slow", "fast"} {
+		result, trace := followTask(task, cornersTrack(flights[pilot]...))
+		entries = append(entries, gapEntry{Track: Track{ID: pilot, Pilot: pilot}, Result: result, Trace: trace})
+	}
+	scores := scoreTask(task, entries)
+
+	if len(scores.Results) != 3 || scores.Results[0].Pilot != "fast" || scores.Results[1].Pilot != "slow" || scores.Results[2].Pilot != "short" {
+		t.Fatalf("ranking %+v", scores.Results)
+	}
+	weights := scores.Weights
+	if math.Abs(weights.Distance+weights.Time+weights.Leading+weights.Arrival-1) > 1e-9 || weights.Leading == 0 || weights.Arrival == 0 {
+		t.Errorf("weights %+v", weights)
+	}
+	validity := scores.Validity
+	if validity.Task <= 0 || validity.Task > 1 || scores.AvailablePoints != 1000*validity.Task {
+		t.Errorf("validity %+v, %v points", validity, scores.AvailablePoints)
+	}
+
+	fast, slow, short := scores.Results[0], scores.Results[1], scores.Results[2]
+	available := scores.AvailablePoints
+	if math.Abs(fast.DistancePoints-weights.Distance*available) > 1e-6 || math.Abs(fast.TimePoints-weights.Time*available) > 1e-6 ||
+		math.Abs(fast.ArrivalPoints-weights.Arrival*available) > 1e-6 || math.Abs(fast.LeadingPoints-weights.Leading*available) > 1e-6 {
+		t.Errorf("winner %+v of %v points", fast, available)
+	}
+	if slow.DistancePoints != fast.DistancePoints || slow.TimePoints >= fast.TimePoints || slow.ArrivalPoints >= fast.ArrivalPoints {
+		t.Errorf("slower pilot %+v", slow)
+	}
+	if short.Goal || short.TimePoints != 0 || short.ArrivalPoints != 0 || short.Distance > 8 || short.DistancePoints >= slow.DistancePoints {
+		t.Errorf("pilot landing short %+v", short)
+	}
+	if fast.Rank != 1 || short.Rank != 3 {
+		t.Errorf("ranks %d, %d", fast.Rank, short.Rank)
+	}
+}
+
+func TestGAPParamsValidate(t *testing.T) {
+	params := GAPParams{}
+	if err := params.validate(); err != nil || params != defaultGAPParams {
+		t.Errorf("defaults %+v, %v", params, err)
+	}
+	for _, params := range []GAPParams{
+		{NominalDistance: 5, MinimumDistance: 10},
+		{NominalGoal: 1.5},
+		{NominalTime: -1},
+	} {
+		if err := params.validate(); err == nil {
+			t.Errorf("%+v passed validation", params)
+		}
+	}
+}
+
+func TestResultsHandler(t *testing.T) {
+	setupMemStores(t)
+	trackID := postIGC(t, readTestData(t, "sample.igc"))
+	task := Task{
+		Start: TaskPoint{Name: "Start", Lat: 60.795, Lon: 10.69, Radius: 400},
+		Goal:  TaskPoint{Name: "Goal", Lat: 60.8139, Lon: 10.73198, Radius: 400},
+	}
+	task.validate()
+	task.ID, task.Tracks = "task1", []string{}
+	taskDataBase.Add(task)
+
+	submit := func(id string) int {
+		w := httptest.NewRecorder()
+		taskTracksHandler(w, httptest.NewRequest("POST", "/paragliding/api/task/task1/tracks", strings.NewReader(`"`+id+`"`)))
+		return w.Code
+	}
+	if code := submit(trackID); code != http.StatusOK {
+		t.Errorf("submitting a track gave %d", code)
+	}
+	if code := submit(trackID); code != http.StatusConflict {
+		t.Errorf("submitting a track twice gave %d, want 409", code)
+	}
+	if code := submit("igc99"); code != http.StatusNotFound {
+		t.Errorf("submitting a missing track gave %d, want 404", code)
+	}
+
+	w := httptest.NewRecorder()
+	resultsHandler(w, httptest.NewRequest("GET", "/paragliding/api/task/task1/results", nil))
+	var scores TaskScores
+	json.Unmarshal(w.Body.Bytes(), &scores)
+	if w.Code != http.StatusOK || len(scores.Results) != 1 || !scores.Results[0].Goal || scores.Results[0].Pilot != "Gerd Gliding" {
+		t.Errorf("results gave %d %q", w.Code, w.Body.String())
+	}
+
+	// Tracks purged after being submitted are left out
+	taskDataBase.AddTrack("task1", "igc99")
+	w = httptest.NewRecorder()
+	resultsHandler(w, httptest.NewRequest("GET", "/paragliding/api/task/task1/results", nil))
+	scores = TaskScores{}
+	json.Unmarshal(w.Body.Bytes(), &scores)
+	if w.Code != http.StatusOK || len(scores.Results) != 1 || len(scores.Missing) != 1 || scores.Missing[0] != "igc99" {
+		t.Errorf("results with a missing track gave %d %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	resultsHandler(w, httptest.NewRequest("GET", "/paragliding/api/task/task9/results", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("results of a missing task gave %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Status of a Job
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// Job is a track upload or import being worked on in the background by
+// the Instance that accepted it. TrackID is the track that was added, or
+// that was already stored if Duplicate is set. Imports fill in Report
+// instead.
+type Job struct {
+	ID        string        `json:"id"` // an ObjectId, so ids sort by creation
+	Instance  string        `json:"instance"`
+	Status    string        `json:"status"`
+	Created   time.Time     `json:"created"`
+	Updated   time.Time     `json:"updated"`
+	TrackID   string        `json:"track_id,omitempty"`
+	Duplicate bool          `json:"duplicate,omitempty"`
+	Error     string        `json:"error,omitempty"`
+	ErrorCode string        `json:"error_code,omitempty"` // one of the fetch* codes
+	Report    *ImportReport `json:"report,omitempty"`
+}
+
+// The work of a job, filling in the outcome in result
+type jobWork func(result *Job) error
+
+type queuedJob struct {
+	job  Job
+	work jobWork
+}
+
+// jobQueue runs jobs on a fixed number of workers. The work waits in
+// memory, while the jobs are kept in the track store for jobRetention
+// after their last update, so every replica can report them.
+type jobQueue struct {
+	mutex   sync.Mutex
+	cleaned time.Time // when old jobs were last deleted
+	queue   chan queuedJob
+}
+
+var jobRetention = getEnvDuration("JOB_RETENTION", time.Hour)
+
+// Name of this replica in the jobs it runs. It must be unique, and the
+// same after a restart to clean up after the jobs the restart stopped.
+var instanceID = getEnv("INSTANCE_ID", hostname())
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "localhost"
+	}
+	return name
+}
+
+// Directory of the import archives waiting for the jobs of this instance
+func importDir() string {
+	return filepath.Join(os.TempDir(), "paragliding-import-"+filepath.Base(instanceID))
+}
+
+// The queue of track uploads. INGEST_QUEUE jobs may wait for one of the
+// INGEST_WORKERS workers, more are turned away.
+var jobs = newJobQueue(getEnvInt("INGEST_WORKERS", 4), getEnvInt("INGEST_QUEUE", 100))
+
+func newJobQueue(workers int, capacity int) *jobQueue {
+	q := &jobQueue{queue: make(chan queuedJob, capacity)}
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+func (q *jobQueue) work() {
+	for next := range q.queue {
+		job := next.job
+		job.Status = jobRunning
+		q.save(&job)
+
+		result := Job{}
+		err := next.work(&result)
+		job.TrackID, job.Duplicate, job.Report = result.TrackID, result.Duplicate, result.Report
+		job.Status = jobDone
+		if err != nil {
+			job.Status, job.Error = jobFailed, err.Error()
+		}
+		var fetchErr *fetchError
+		if errors.As(err, &fetchErr) {
+			job.ErrorCode = fetchErr.Code
+		}
+		q.save(&job)
+	}
+}
+
+// Stores the changed job. Failures are only logged, the work goes on and
+// the next update may be stored.
+func (q *jobQueue) save(job *Job) {
+	job.Updated = time.Now().UTC()
+	if err := trackDataBase.UpdateJob(*job); err != nil {
+		log.Printf("updating job %v: %v", job.ID, err)
+	}
+}
+
+// Queues work as a new job. The error is ErrUnavailable when the queue is
+// full.
+func (q *jobQueue) submit(work jobWork) (Job, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	now := time.Now().UTC()
+	if now.Sub(q.cleaned) > time.Minute {
+		if _, err := trackDataBase.DeleteJobs(now.Add(-jobRetention)); err != nil {
+			log.Println("deleting old jobs:", err)
+		}
+		q.cleaned = now
+	}
+
+	// Stored first, since a worker may update it right away
+	job := Job{ID: bson.NewObjectId().Hex(), Instance: instanceID, Status: jobQueued, Created: now, Updated: now}
+	if err := trackDataBase.AddJob(job); err != nil {
+		return Job{}, err
+	}
+	select {
+	case q.queue <- queuedJob{job, work}:
+		return job, nil
+	default:
+		job.Status, job.Error = jobFailed, "job queue is full"
+		q.save(&job)
+		return Job{}, fmt.Errorf("job queue is full: %w", ErrUnavailable)
+	}
+}
+
+// Returns the job, or ErrNotFound. It may have been queued by another
+// replica.
+func (q *jobQueue) get(id string) (Job, error) {
+	return trackDataBase.GetJob(id)
+}
+
+// Fails the jobs this instance had not finished when it stopped, and
+// removes the archives they were waiting on
+func (q *jobQueue) recover() error {
+	for _, status := range []string{jobQueued, jobRunning} {
+		stopped, err := trackDataBase.FindJobs(instanceID, status)
+		if err != nil {
+			return err
+		}
+		for _, job := range stopped {
+			job.Status, job.Error = jobFailed, "stopped by a restart, submit the track again"
+			q.save(&job)
+		}
+	}
+	return os.RemoveAll(importDir())
+}
+
+// Answers a request that queued a job with 202 Accepted and the job, or
+// with 503 and a hint to retry if the queue is full. Reports whether the
+// job was queued.
+func submitJob(w http.ResponseWriter, work jobWork) bool {
+	job, err := jobs.submit(work)
+	if err != nil {
+		w.Header().Set("Retry-After", "10")
+		errorStore(w, err)
+		return false
+	}
+	w.Header().Set("Location", "/paragliding/api/jobs/"+job.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+	return true
+}
+
+// GET /paragliding/api/jobs/{id}
+func jobHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	job, err := jobs.get(parts[len(parts)-1])
+	if err != nil {
+		errorStore(w, err)
+		return
+	}
+	writeJSON(w, job)
+}
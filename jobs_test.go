@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Waits for a job to finish
+func waitJob(t *testing.T, id string) Job {
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		job, err := jobs.get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status == jobDone || job.Status == jobFailed {
+			return job
+		}
+	}
+	t.Fatalf("job %v did not finish", id)
+	return Job{}
+}
+
+func TestJobQueue(t *testing.T) {
+	setupMemStores(t)
+	q := newJobQueue(1, 1)
+	release := make(chan bool)
+	block := func(result *Job) error {
+		<-release
+		result.TrackID = "igc1"
+		return nil
+	}
+
+	// Waits for a job of q to get beyond the given statuses
+	waitFor := func(id string, statuses ...string) Job {
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			job, _ := q.get(id)
+			if job.Status != statuses[0] && (len(statuses) == 1 || job.Status != statuses[1]) {
+				return job
+			}
+		}
+		t.Fatalf("job %v stayed %v", id, statuses)
+		return Job{}
+	}
+
+	running, _ := q.submit(block)
+	waitFor(running.ID, jobQueued)
+	queued, err := q.submit(func(result *Job) error { return errors.New("broken") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.submit(block); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("submit to a full queue gave %v, want ErrUnavailable", err)
+	}
+	if job, _ := q.get(queued.ID); job.Status != jobQueued {
+		t.Errorf("second job is %v, want %v", job.Status, jobQueued)
+	}
+
+	close(release)
+	if job := waitFor(running.ID, jobRunning); job.Status != jobDone || job.TrackID != "igc1" {
+		t.Errorf("first job is %+v", job)
+	}
+	if job := waitFor(queued.ID, jobQueued, jobRunning); job.Status != jobFailed || job.Error != "broken" {
+		t.Errorf("second job is %+v", job)
+	}
+}
+
+func TestJobHandler(t *testing.T) {
+	setupMemStores(t)
+	w := postTrack(t, readTestData(t, "sample.igc"))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("POST track gave %d, want 202", w.Code)
+	}
+	location := w.Header().Get("Location")
+
+	var job Job
+	for deadline := time.Now().Add(10 * time.Second); job.Status != jobDone && time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		w = httptest.NewRecorder()
+		jobHandler(w, httptest.NewRequest("GET", location, nil))
+		job = Job{}
+		json.Unmarshal(w.Body.Bytes(), &job)
+	}
+	if _, err := trackDataBase.Get(job.TrackID); err != nil || job.Duplicate {
+		t.Errorf("job ended as %+v", job)
+	}
+
+	// Jobs queued by other replicas are reported too
+	other := Job{ID: bson.NewObjectId().Hex(), Instance: "other", Status: jobRunning}
+	trackDataBase.AddJob(other)
+	w = httptest.NewRecorder()
+	jobHandler(w, httptest.NewRequest("GET", "/paragliding/api/jobs/"+other.ID, nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"instance":"other"`) {
+		t.Errorf("GET of a job of another replica gave %d %v", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	jobHandler(w, httptest.NewRequest("GET", "/paragliding/api/jobs/job0", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("GET of an unknown job gave %d, want 404", w.Code)
+	}
+}
+
+func TestJobRecover(t *testing.T) {
+	setupMemStores(t)
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", t.TempDir())
+	os.MkdirAll(importDir(), 0700)
+	ioutil.WriteFile(filepath.Join(importDir(), "import-1"), []byte("archive"), 0600)
+
+	// Jobs left behind when this instance stopped
+	stopped := []Job{
+		{ID: bson.NewObjectId().Hex(), Instance: instanceID, Status: jobQueued},
+		{ID: bson.NewObjectId().Hex(), Instance: instanceID, Status: jobRunning},
+		{ID: bson.NewObjectId().Hex(), Instance: instanceID, Status: jobDone},
+		{ID: bson.NewObjectId().Hex(), Instance: "other", Status: jobRunning},
+	}
+	for _, job := range stopped {
+		trackDataBase.AddJob(job)
+	}
+	if err := newJobQueue(0, 1).recover(); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{jobFailed, jobFailed, jobDone, jobRunning} {
+		if job, _ := trackDataBase.GetJob(stopped[i].ID); job.Status != want {
+			t.Errorf("job %d is %+v after a restart, want %v", i, job, want)
+		}
+	}
+	if _, err := os.Stat(importDir()); !os.IsNotExist(err) {
+		t.Errorf("archives left after a restart: %v", err)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/marni/goigc"
+)
+
+// Climb rates the path is colored by, in m/s: below the first bound is
+// the first color, above the last the last one. Colors are KML's aabbggrr.
+var (
+	climbBounds = []float64{-3, -1.5, -0.5, 0.5, 1.5, 3}
+	climbColors = []string{
+		"ff8b0000", // dark blue, strong sink
+		"ffff0000", // blue
+		"ffffff00", // cyan
+		"ff00ff00", // green, about level
+		"ff00ffff", // yellow
+		"ff0080ff", // orange
+		"ff0000ff", // red, strong climb
+	}
+)
+
+// Subset of KML 2.2 used for tracks
+type kmlDocument struct {
+	XMLName xml.Name    `xml:"http://www.opengis.net/kml/2.2 kml"`
+	Name    string      `xml:"Document>name"`
+	Styles  []kmlStyle  `xml:"Document>Style"`
+	Folders []kmlFolder `xml:"Document>Folder"`
+}
+
+type kmlStyle struct {
+	ID        string        `xml:"id,attr"`
+	LineColor string        `xml:"LineStyle>color,omitempty"`
+	LineWidth int           `xml:"LineStyle>width,omitempty"`
+	Icon      *kmlIconStyle `xml:"IconStyle,omitempty"`
+}
+
+type kmlIconStyle struct {
+	Href string `xml:"Icon>href"`
+}
+
+type kmlFolder struct {
+	Name       string         `xml:"name"`
+	Placemarks []kmlPlacemark `xml:"Placemark"`
+}
+
+type kmlPlacemark struct {
+	Name        string       `xml:"name,omitempty"`
+	Description string       `xml:"description,omitempty"`
+	Begin       string       `xml:"TimeSpan>begin,omitempty"`
+	End         string       `xml:"TimeSpan>end,omitempty"`
+	StyleURL    string       `xml:"styleUrl,omitempty"`
+	Point       *kmlGeometry `xml:"Point,omitempty"`
+	LineString  *kmlGeometry `xml:"LineString,omitempty"`
+}
+
+type kmlGeometry struct {
+	Extrude      int    `xml:"extrude,omitempty"`
+	AltitudeMode string `xml:"altitudeMode"`
+	Coordinates  string `xml:"coordinates"`
+}
+
+// Index into climbColors of a climb rate
+func climbClass(climb float64) int {
+	class := 0
+	for class < len(climbBounds) && climb >= climbBounds[class] {
+		class++
+	}
+	return class
+}
+
+// Climb rate at every fix, averaged over the varioWindow that follows it
+func fixClimbs(track igc.Track, times []time.Time) []float64 {
+	points := track.Points
+	climbs := make([]float64, len(points))
+	for i := range points {
+		j := windowEnd(times, i, varioWindow)
+		if j < 0 {
+			j = len(points) - 1
+		}
+		if seconds := times[j].Sub(times[i]).Seconds(); seconds > 0 {
+			climbs[i] = float64(points[j].GNSSAltitude-points[i].GNSSAltitude) / seconds
+		} else if i > 0 {
+			climbs[i] = climbs[i-1]
+		}
+	}
+	return climbs
+}
+
+func kmlCoordinates(lat, lon float64, altitude int64) string {
+	return fmt.Sprintf("%.6f,%.6f,%d", lon, lat, altitude)
+}
+
+func kmlPoint(name, description, style string, fix Fix) kmlPlacemark {
+	return kmlPlacemark{
+		Name:        name,
+		Description: description,
+		StyleURL:    style,
+		Point: &kmlGeometry{
+			AltitudeMode: "absolute",
+			Coordinates:  kmlCoordinates(fix.Lat, fix.Lon, fix.Altitude),
+		},
+	}
+}
+
+// Renders a flight as a 3D line at GNSS altitude, split into pieces of the
+// same climb class, with placemarks for takeoff, landing, thermals and the
+// turnpoints of the declared task
+func trackKML(meta Track, track igc.Track) kmlDocument {
+	doc := kmlDocument{Name: meta.ID + " " + meta.Pilot}
+	for class, color := range climbColors {
+		doc.Styles = append(doc.Styles, kmlStyle{ID: fmt.Sprintf("climb%d", class), LineColor: color, LineWidth: 3})
+	}
+	icon := "http://maps.google.com/mapfiles/kml/shapes/"
+	doc.Styles = append(doc.Styles,
+		kmlStyle{ID: "takeoff", Icon: &kmlIconStyle{icon + "airports.png"}},
+		kmlStyle{ID: "landing", Icon: &kmlIconStyle{icon + "flag.png"}},
+		kmlStyle{ID: "thermal", Icon: &kmlIconStyle{icon + "arrow.png"}},
+		kmlStyle{ID: "turnpoint", Icon: &kmlIconStyle{icon + "target.png"}},
+	)
+
+	times := fixTimes(track)
+	climbs := fixClimbs(track, times)
+	flight := kmlFolder{Name: "Flight"}
+	coordinates := []string{}
+	for i, point := range track.Points {
+		coordinates = append(coordinates, kmlCoordinates(point.Lat.Degrees(), point.Lng.Degrees(), point.GNSSAltitude))
+		class := climbClass(climbs[i])
+		// A piece ends where the next fix changes class, and the next one
+		// starts at the same fix so the line has no gaps
+		last := i == len(track.Points)-1
+		if last || len(coordinates) > 1 && climbClass(climbs[i+1]) != class {
+			flight.Placemarks = append(flight.Placemarks, kmlPlacemark{
+				Begin:    times[i+1-len(coordinates)].Format(time.RFC3339),
+				End:      times[i].Format(time.RFC3339),
+				StyleURL: fmt.Sprintf("#climb%d", class),
+				LineString: &kmlGeometry{
+					Extrude:      1,
+					AltitudeMode: "absolute",
+					Coordinates:  strings.Join(coordinates, " "),
+				},
+			})
+			coordinates = coordinates[len(coordinates)-1:]
+		}
+	}
+	doc.Folders = append(doc.Folders, flight)
+
+	events := kmlFolder{Name: "Events"}
+	events.Placemarks = append(events.Placemarks,
+		kmlPoint("Takeoff", meta.Stats.Takeoff.Time.Format(time.RFC3339), "#takeoff", meta.Stats.Takeoff),
+		kmlPoint("Landing", meta.Stats.Landing.Time.Format(time.RFC3339), "#landing", meta.Stats.Landing))
+	for i, thermal := range detectThermals(track) {
+		description := fmt.Sprintf("%v to %v, %d m to %d m, %.1f m/s, %v",
+			thermal.Entry.Format("15:04:05"), thermal.Exit.Format("15:04:05"),
+			thermal.Base, thermal.Top, thermal.Climb, thermal.Direction)
+		fix := Fix{Lat: thermal.Lat, Lon: thermal.Lon, Altitude: thermal.Top}
+		events.Placemarks = append(events.Placemarks, kmlPoint(fmt.Sprintf("Thermal %d", i+1), description, "#thermal", fix))
+	}
+	doc.Folders = append(doc.Folders, events)
+
+	if task, ok := declaredTask(track.Task); ok {
+		turnpoints := kmlFolder{Name: "Task"}
+		for _, point := range append([]TaskPoint{task.Start}, task.route()...) {
+			placemark := kmlPoint(point.Name, "", "#turnpoint", Fix{Lat: point.Lat, Lon: point.Lon})
+			placemark.Point.AltitudeMode = "clampToGround" // turnpoints have no altitude
+			turnpoints.Placemarks = append(turnpoints.Placemarks, placemark)
+		}
+		doc.Folders = append(doc.Folders, turnpoints)
+	}
+	return doc
+}
+
+// GET /paragliding/api/track/{id}.kml and .kmz render the stored flight for
+// Google Earth
+func kmlHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	name := parts[len(parts)-1]
+	format := path.Ext(name)
+	id := strings.TrimSuffix(name, format)
+
+	meta, track, ok := storedFlight(w, id)
+	if !ok {
+		return
+	}
+	writeKML(w, meta, track, format == ".kmz")
+}
+
+// Writes the KML of a flight, zipped as a KMZ if kmz is set
+func writeKML(w http.ResponseWriter, meta Track, track igc.Track, kmz bool) {
+	kml, err := xml.MarshalIndent(trackKML(meta, track), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	kml = append([]byte(xml.Header), kml...)
+
+	if kmz {
+		// A KMZ is a zip archive with the document as doc.kml
+		var archive bytes.Buffer
+		zipped := zip.NewWriter(&archive)
+		file, err := zipped.Create("doc.kml")
+		if err == nil {
+			_, err = file.Write(kml)
+		}
+		if err == nil {
+			err = zipped.Close()
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", mediaKMZ)
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+meta.ID+".kmz\"")
+		w.WriteHeader(http.StatusOK)
+		w.Write(archive.Bytes())
+		return
+	}
+	w.Header().Set("Content-Type", mediaKML)
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+meta.ID+".kml\"")
+	w.WriteHeader(http.StatusOK)
+	w.Write(kml)
+}
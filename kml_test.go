@@ -0,0 +1,76 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClimbClass(t *testing.T) {
+	tests := map[float64]int{-5: 0, -3: 1, -1: 2, 0: 3, 1: 4, 2: 5, 3: 6, 8: 6}
+	for climb, want := range tests {
+		if class := climbClass(climb); class != want {
+			t.Errorf("climbClass(%v) = %d, want %d", climb, class, want)
+		}
+	}
+}
+
+func TestKMLHandler(t *testing.T) {
+	setupMemStores(t)
+	id := postIGC(t, readTestData(t, "sample.igc"))
+
+	w := httptest.NewRecorder()
+	kmlHandler(w, httptest.NewRequest("GET", "/paragliding/api/track/"+id+".kml", nil))
+	var doc kmlDocument
+	if err := xml.Unmarshal(w.Body.Bytes(), &doc); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("GET .kml gave %d: %v", w.Code, err)
+	}
+	if len(doc.Folders) != 2 {
+		t.Fatalf("%d folders, want flight and events", len(doc.Folders))
+	}
+
+	// The pieces of the path join up and cover every fix
+	fixes, classes := 0, map[string]bool{}
+	for i, piece := range doc.Folders[0].Placemarks {
+		coordinates := strings.Fields(piece.LineString.Coordinates)
+		fixes += len(coordinates) - 1
+		classes[piece.StyleURL] = true
+		if i > 0 {
+			previous := strings.Fields(doc.Folders[0].Placemarks[i-1].LineString.Coordinates)
+			if previous[len(previous)-1] != coordinates[0] {
+				t.Errorf("piece %d does not start where piece %d ends", i, i-1)
+			}
+		}
+	}
+	if fixes != 229 || len(classes) < 3 {
+		t.Errorf("path has %d legs in %d colors, want 229 in several", fixes, len(classes))
+	}
+
+	events := doc.Folders[1].Placemarks
+	if len(events) != 3 || events[0].Name != "Takeoff" || events[1].Name != "Landing" || events[2].Name != "Thermal 1" {
+		t.Errorf("events are %+v", events)
+	}
+
+	w = httptest.NewRecorder()
+	kmlHandler(w, httptest.NewRequest("GET", "/paragliding/api/track/"+id+".kmz", nil))
+	archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil || len(archive.File) != 1 || archive.File[0].Name != "doc.kml" {
+		t.Fatalf("GET .kmz gave %d, not a KMZ: %v", w.Code, err)
+	}
+	file, _ := archive.File[0].Open()
+	kml, _ := ioutil.ReadAll(file)
+	if err := xml.Unmarshal(kml, &doc); err != nil {
+		t.Errorf("doc.kml: %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	kmlHandler(w, httptest.NewRequest("GET", "/paragliding/api/track/igc999.kml", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown track gave %d, want 404", w.Code)
+	}
+}
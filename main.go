@@ -1,182 +1,27 @@
 package main
 
 import (
-	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"os"
 
 	"github.com/gorilla/mux"
-	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 	"github.com/marni/goigc"
 )
 
-type trackDB struct {
-	HostURL             string
-	DatabaseName        string
-	TrackCollectionName string
-}
-
-type webhookDB struct {
-	HostURL               string
-	DatabaseName          string
-	WebhookCollectionName string
-}
-
-func (db *trackDB) Init() {
-	session, err := mgo.Dial(db.HostURL)
-	if err != nil {
-		panic(err)
-	}
-
-	defer session.Close()
-
-}
-
-func (db *webhookDB) Init() {
-	session, err := mgo.Dial(db.HostURL)
-	if err != nil {
-		panic(err)
-	}
-
-	defer session.Close()
-
-}
-
-func (db *trackDB) Add(s Track) {
-	session, err := mgo.Dial(db.HostURL)
-	if err != nil {
-		panic(err)
-	}
-
-	defer session.Close()
-
-	err = session.DB(db.DatabaseName).C(db.TrackCollectionName).Insert(s)
-	if err != nil {
-		fmt.Printf("error in Insert(): %v", err.Error())
-	}
-}
-
-func (db *webhookDB) Add(s Webhook) {
-	session, err := mgo.Dial(db.HostURL)
-	if err != nil {
-		panic(err)
-	}
-
-	defer session.Close()
-
-	err = session.DB(db.DatabaseName).C(db.WebhookCollectionName).Insert(s)
-	if err != nil {
-		fmt.Printf("error in Insert(): %v", err.Error())
-	}
-}
-
-func (db *trackDB) Count() int {
-	session, err := mgo.Dial(db.HostURL)
-	if err != nil {
-		panic(err)
-	}
-
-	defer session.Close()
-
-	count, err := session.DB(db.DatabaseName).C(db.TrackCollectionName).Count()
-	if err != nil {
-		fmt.Printf("error in Count(): %v", err.Error())
-		return -1
-	}
-	return count
-
-}
-
-func (db *webhookDB) Count() int {
-	session, err := mgo.Dial(db.HostURL)
-	if err != nil {
-		panic(err)
-	}
-
-	defer session.Close()
-
-	count, err := session.DB(db.DatabaseName).C(db.WebhookCollectionName).Count()
-	if err != nil {
-		fmt.Printf("error in Count(): %v", err.Error())
-		return -1
-	}
-	return count
-
-}
-
-func (db *trackDB) Get(keyID string) (Track, bool) {
-	session, err := mgo.Dial(db.HostURL)
-	if err != nil {
-		panic(err)
-	}
-
-	defer session.Close()
-
-	track := Track{}
-	err = session.DB(db.DatabaseName).C(db.TrackCollectionName).Find(bson.M{"id": keyID}).One(&track)
-	if err != nil {
-		return track, false
-	}
-
-	return track, true
-}
-
-func (db *webhookDB) Get(keyID string) (Webhook, bool) {
-	session, err := mgo.Dial(db.HostURL)
-	if err != nil {
-		panic(err)
-	}
-
-	defer session.Close()
-
-	Hook := Webhook{}
-	err = session.DB(db.DatabaseName).C(db.WebhookCollectionName).Find(bson.M{"id": keyID}).One(&Hook)
-	if err != nil {
-		return Hook, false
-	}
-
-	return Hook, true
-}
-
-func (db *trackDB) Delete() (int, bool) {
-	session, err := mgo.Dial(db.HostURL)
-	if err != nil {
-		panic(err)
-	}
-
-	defer session.Close()
-	tracks := session.DB(db.DatabaseName).C(db.TrackCollectionName)
-
-	count, err := tracks.Count()
-	if err != nil {
-		return 0, false
-	}
-
-	tracks.RemoveAll(nil)
-	return count, true
-}
-
-func (db *webhookDB) Delete(keyID string) bool {
-	session, err := mgo.Dial(db.HostURL)
-	if err != nil {
-		panic(err)
-	}
-
-	defer session.Close()
-	err = session.DB(db.DatabaseName).C(db.WebhookCollectionName).Remove(bson.M{"id": keyID})
-	if err != nil {
-		return false
-	}
-
-	return true
-}
 // Some .igc files URLs for use in testing
 // http://skypolaris.org/wp-content/uploads/IGS%20Files/Madrid%20to%20Jerez.igc
 // http://skypolaris.org/wp-content/uploads/IGS%20Files/Jarez%20to%20Senegal.igc
@@ -191,7 +36,7 @@ type MetaInfo struct {
 }
 
 //Track stores data about the track
-type URLTrack struct {
+type Track struct {
 	ID          string
 	HDate       time.Time `json:"H_Date"`
 	Pilot       string    `json:"pilot"`
@@ -200,6 +45,13 @@ type URLTrack struct {
 	TrackLength float64   `json:"track_length"`
 	URL         string    `json:"track_src_url"`
 	TimeStamp bson.ObjectId
+	SHA256      string    `json:"sha256"` // digest of the original IGC file
+	ContentHash string    `json:"content_hash" bson:"contenthash,omitempty"` // see canonicalHash
+	Stats       FlightStats `json:"stats"`
+	XC          []XCScore   `json:"xc"` // best first
+	Airspace    []Violation `json:"airspace"`
+	Validation  string      `json:"validation"` // G record check, see validateIGC
+	Format      string      `json:"format"`     // of the original file, see sourceFormat
 }
 
 //Ticker stores info used for ticker
@@ -215,9 +67,22 @@ type Ticker struct {
 type Webhook struct {
 	ID       string
 	URL      string `json:"webhookURL"`
-	Value    int    `json:"minTriggerValue"`
-	TrackAdd int
+	Value     int    `json:"minTriggerValue"`
+	LastTrack bson.ObjectId // TimeStamp of the last track the webhook was told about
+
+	// Event types the webhook subscribes to, see emitEvent. Without any it
+	// is told about new tracks by sendWebhook instead.
+	Events []string `json:"events,omitempty"`
 
+	// Only tracks passing the filter count towards the trigger and cause
+	// track events
+	Filter WebhookFilter `json:"filter"`
+
+	// Deliveries are signed with Secret, and with OldSecret until
+	// OldSecretUntil after a rotation, see signDelivery
+	Secret         string    `json:"secret,omitempty"`
+	OldSecret      string    `json:"old_secret,omitempty"`
+	OldSecretUntil time.Time `json:"old_secret_until"`
 }
 
 //WebhookMessage stores data for the webhook to send
@@ -231,35 +96,26 @@ type WebHookSend struct {
 	Message WebhookMessage `json:"text"`
 }
 
+// The largest IGC file accepted by trackHandler
+const maxUploadSize = 10 << 20
+
+// Info and Version are reported by the meta endpoint
+const (
+	Info    = "Service for Paragliding tracks."
+	Version = "v1"
+)
+
+// Number of tracks in a ticker response
+const tickerCap = 5
+
 // VARIABLES:
 // timestamp when the service started
 var timeStarted time.Time
-// Keep count of the number of igc files added to the system
-var igcCount int
-// Map where the igcFiles are in-memory stored
-var igcFiles = make(map[string]URLTrack) // map["URL"]urlTrack
-// Keep count of the number of webhooks
-var webhookAmount int
 
 //var clockSaved int
-var deletedTracks int
-
-
-// makes sure that the same track isn't added twice
-func urlInMap(url string) bool {
-	for urlInMap := range igcFiles {
-		if urlInMap == url {
-			return true
-		}
-	}
-	return false
-}
 
 func init() {
-	igcCount = 0
-	webhookAmount = 0
 	//clockSaved = 0
-	deletedTracks = 0
 	timeStarted = time.Now()
 }
 
@@ -316,15 +172,149 @@ func error400(w http.ResponseWriter) {
 	http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 }
 
+//Maps errors from the stores to a status code: 404 for missing documents,
+//409 for duplicates, 503 when the database is down and 500 for the rest
+func errorStore(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrDuplicate):
+		status = http.StatusConflict
+	case errors.Is(err, ErrUnavailable):
+		status = http.StatusServiceUnavailable
+	}
+	http.Error(w, http.StatusText(status), status)
+}
+
 // Calculate the total distance of the track
-func calculateTotalDistance(track igc.Track) string {
+func calculateTotalDistance(track igc.Track) float64 {
 	totDistance := 0.0
 	// For each point of the track, calculate the distance between 2 points in the Point array
 	for i := 0; i < len(track.Points)-1; i++ {
 		totDistance += track.Points[i].Distance(track.Points[i+1])
 	}
-	// Parse it to a string value
-	return strconv.FormatFloat(totDistance, 'f', 2, 64)
+	return totDistance
+}
+
+// Fields returned by fieldHandler may not be empty
+func errorCheck(field string) (string, error) {
+	if field == "" {
+		return "", errors.New("field is empty")
+	}
+	return field, nil
+}
+
+// Hash of the header and fixes of an IGC file, used to recognise the same
+// flight when it is submitted again. Other records, line endings and
+// surrounding whitespace are ignored, so copies from different mirrors or
+// re-signed files still match.
+func canonicalHash(content []byte) string {
+	hash := sha256.New()
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "H") || strings.HasPrefix(line, "B") {
+			hash.Write([]byte(line))
+			hash.Write([]byte{'\n'})
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Answers a POST of a track that is already stored. Depending on
+// DUPLICATE_TRACKS this is either the id of the existing track, as if it
+// had just been added, or a 409 Conflict pointing to it.
+func duplicateTrack(w http.ResponseWriter, existing Track) {
+	if getEnv("DUPLICATE_TRACKS", "ok") == "conflict" {
+		w.Header().Set("Location", "/paragliding/api/track/"+existing.ID)
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"id": existing.ID})
+		return
+	}
+
+	addJSON, err := json.Marshal(existing.ID)
+	if err != nil {
+		error400(w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(addJSON)
+}
+
+// lineError is a parse error in a given line of a file, counted from 1
+type lineError struct {
+	Line int
+	Err  error
+}
+
+func (e *lineError) Error() string {
+	return "line " + strconv.Itoa(e.Line) + ": " + e.Err.Error()
+}
+
+func (e *lineError) Unwrap() error {
+	return e.Err
+}
+
+// Parses the content of an uploaded IGC file, which has to hold at least one fix
+func parseIGC(content []byte) (igc.Track, error) {
+	track, err := igc.Parse(string(content))
+	if err != nil {
+		// The igc library ends its errors with the offending line, but
+		// doesn't say where it is
+		message := err.Error()
+		if i := strings.LastIndex(message, " :: "); i >= 0 {
+			for n, line := range strings.Split(string(content), "\n") {
+				if strings.TrimSpace(line) == message[i+4:] {
+					return track, &lineError{n + 1, err}
+				}
+			}
+		}
+		return track, err
+	}
+	if len(track.Points) == 0 {
+		return track, errors.New("no B records in IGC file")
+	}
+	return track, nil
+}
+
+// Reads the track file POSTed to /track/. The body is either a JSON string
+// with the URL of the file, the file itself (application/octet-stream,
+// text/plain or the GPX and FIT types) or a multipart form with the file in
+// the "igc" field.
+// Either the content of an upload or the URL of the file is returned.
+func readTrack(w http.ResponseWriter, r *http.Request) ([]byte, string, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "application/json" // URLs used to be posted without a content type
+	}
+
+	switch mediaType {
+	case "multipart/form-data":
+		file, _, err := r.FormFile("igc")
+		if err != nil {
+			return nil, "", err
+		}
+		defer file.Close()
+
+		content, err := ioutil.ReadAll(file)
+		return content, "", err
+	case "application/octet-stream", "text/plain", mediaGPX, "application/xml", "text/xml", mediaFIT:
+		content, err := ioutil.ReadAll(r.Body)
+		return content, "", err
+	default:
+		var data string // POST body is of content-type: JSON; the result can be stored in a string
+
+		err := json.NewDecoder(r.Body).Decode(&data)
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err := remote.check(data); err != nil {
+			return nil, "", err
+		}
+		return nil, data, nil // fetched by the job adding the track
+	}
 }
 
 func paraglideHandler(w http.ResponseWriter, r *http.Request) {
@@ -351,74 +341,128 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(metaJSON)
 }
 
+// Stores a parsed track file with its metadata, unless the same flight is
+// already stored. Either the new or the existing track is returned, with
+// duplicate telling which.
+func addTrack(content []byte, track igc.Track, url string) (Track, bool, error) {
+	contentHash := flightHash(content, track)
+	existing, err := trackDataBase.FindByHash(contentHash)
+	if err == nil {
+		return existing, true, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return Track{}, false, err
+	}
+	sequence, err := trackDataBase.NextSequence()
+	if err != nil {
+		return Track{}, false, err
+	}
+	nID := "igc" + strconv.Itoa(sequence)
+
+	digest := sha256.Sum256(content)
+
+	newTrack := Track{
+		ID:          nID,
+		HDate:       track.Date,
+		Pilot:       track.Pilot,
+		Glider:      track.GliderType,
+		GliderID:    track.GliderID,
+		TrackLength: calculateTotalDistance(track),
+		URL:         url,
+		TimeStamp:   bson.NewObjectId(),
+		SHA256:      hex.EncodeToString(digest[:]),
+		ContentHash: contentHash,
+		Stats:       computeStats(track),
+		XC:          scoreXC(track),
+		Airspace:    airspaces.check(track),
+		Validation:  validateIGC(content),
+		Format:      sourceFormat(content),
+	}
+
+	if err := trackDataBase.AddIGC(nID, content); err != nil {
+		return Track{}, false, err
+	}
+	if err := trackDataBase.Add(newTrack); err != nil {
+		if err := trackDataBase.DeleteIGC(nID); err != nil {
+			log.Printf("deleting the file of unstored track %v: %v", nID, err)
+		}
+		// Another worker stored the same flight since the check above
+		if errors.Is(err, ErrDuplicate) {
+			if existing, err := trackDataBase.FindByHash(contentHash); err == nil {
+				return existing, true, nil
+			}
+		}
+		return Track{}, false, err
+	}
+	announceTrack(newTrack)
+	return newTrack, false, nil
+}
+
 func trackHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	if r.Method == "POST" { // If method is POST, user has entered the URL
+	if r.Method == "POST" { // If method is POST, user has entered the URL or uploaded the file
 		if r.Body == nil {
 			error400(w)
 			return
 		}
 
-		var data string // POST body is of content-type: JSON; the result can be stored in a map
-
-		err := json.NewDecoder(r.Body).Decode(&data)
-		if err != nil {
-			error400(w)
-			return
-		}
-
-		track, err := igc.ParseLocation(data) // call the igc library
-		if err != nil {
-			error400(w)
+		content, data, err := readTrack(w, r)
+		var fetchErr *fetchError
+		if errors.As(err, &fetchErr) {
+			http.Error(w, fetchErr.Error(), http.StatusBadRequest)
 			return
 		}
-		igcCount++            // Increase the count
-		nID := "igc" + strconv.Itoa(igcCount)
-
-		newTrack := Track{
-			ID,
-			track.HDate,
-			track.Pilot,
-			track.GliderType,
-			track.GliderID,
-			parseTimeDifference(track),
-			data,
-			bson.NewObjectIdWithTime(time.Now())}
-
-		trackDataBase.Add(newTrack)
-
-		addJSON, err := json.Marshal(newTrack.ID)
 		if err != nil {
 			error400(w)
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
-		w.Write(addJSON)
-
-		sendWebhook(w)
-
-	} else if r.Method == "GET" { // If the method is GET
-		w.Header().Set("Content-Type", "application/json") // Set response content-type to JSON
-
-		response := []string{}
-		for i := deletedTracks + 1; i <= total; i++ {
-			tempTrack, ok := trackDataBase.Get("igc" + strconv.Itoa(i))
-			if !ok {
+		// Uploads are checked right away, so broken files and flights that
+		// are already stored are answered at once. Files given by URL are
+		// fetched by the job. The same flight may still be stored by another
+		// job meanwhile, which addTrack reports as a duplicate.
+		var track igc.Track
+		if content != nil {
+			track, err = parseTrack(content) // IGC, GPX or FIT
+			if err != nil {
 				error400(w)
 				return
 			}
-			response = append(response, tempTrack.ID)
+			existing, err := trackDataBase.FindByHash(flightHash(content, track))
+			if err == nil {
+				duplicateTrack(w, existing)
+				return
+			}
+			if !errors.Is(err, ErrNotFound) {
+				errorStore(w, err)
+				return
+			}
 		}
 
-		IDJSON, err := json.Marshal(response)
-		if err != nil {
-			error400(w)
-			return
-		}
-		w.WriteHeader(http.StatusOK)
-		w.Write(IDJSON)
+		submitJob(w, func(result *Job) error {
+			var err error
+			if content == nil {
+				if content, err = remote.fetch(data); err != nil {
+					return err
+				}
+				if track, err = parseTrack(content); err != nil {
+					return err
+				}
+			}
+			newTrack, duplicate, err := addTrack(content, track, data)
+			if err != nil {
+				return err
+			}
+			result.TrackID, result.Duplicate = newTrack.ID, duplicate
+			if !duplicate {
+				sendWebhook()
+			}
+			return nil
+		})
+
+	} else if r.Method == "GET" { // If the method is GET
+		listTracks(w, r)
 
 	} else {
 		error400(w)
@@ -444,10 +488,22 @@ func idHandler(w http.ResponseWriter, r *http.Request) {
 	track := parts[len(parts)-1]
 	if track != "" {
 
-		tempTrack, ok := trackDataBase.Get(track)
+		// Other representations than the JSON metadata, see trackMediaTypes
+		w.Header().Set("Vary", "Accept")
+		switch mediaType := negotiateTrack(r.Header.Get("Accept")); mediaType {
+		case "":
+			http.Error(w, "acceptable types are "+strings.Join(trackMediaTypes, ", "), http.StatusNotAcceptable)
+			return
+		case mediaJSON:
+		default:
+			writeTrackAs(w, track, mediaType)
+			return
+		}
+
+		tempTrack, err := trackDataBase.Get(track)
 
-		if !ok {
-			error400(w)
+		if err != nil {
+			errorStore(w, err)
 			return
 		}
 
@@ -466,6 +522,28 @@ func idHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Returns the IGC file of a track exactly as it was submitted
+func igcHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	id := parts[len(parts)-2]
+
+	content, err := trackDataBase.GetIGC(id)
+	if err != nil {
+		errorStore(w, err)
+		return
+	}
+
+	// The original file, which for tracks added from GPX or FIT is not IGC
+	format := sourceFormat(content)
+
+	digest := sha256.Sum256(content)
+	w.Header().Set("Content-Type", sourceMediaTypes[format])
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+id+"."+format+"\"")
+	w.Header().Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(digest[:]))
+	w.WriteHeader(http.StatusOK)
+	w.Write(content)
+}
+
 func fieldHandler(w http.ResponseWriter, r *http.Request) {
 	parts := strings.Split(r.URL.Path, "/")
 
@@ -474,10 +552,11 @@ func fieldHandler(w http.ResponseWriter, r *http.Request) {
 
 	if id != "" && field != "" {
 
-		tempTrack, ok := trackDataBase.Get(id)
+		tempTrack, err := trackDataBase.Get(id)
 
-		if !ok {
-			error400(w)
+		if err != nil {
+			errorStore(w, err)
+			return
 		}
 
 		switch field {
@@ -527,39 +606,54 @@ func fieldHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 			fmt.Fprint(w, response)
+		default: // One of the flight statistics
+			response, err := errorCheck(tempTrack.Stats.field(field))
+			if err != nil {
+				error400(w)
+				return
+			}
+			fmt.Fprint(w, response)
 		}
 	} else {
 		errRouter(w, r)
 	}
 }
 
-func ticker(w http.ResponseWriter, r *http.Request) {
-	processStart := time.Now().UnixNano() / int64(time.Millisecond)
-	arrayCap := 5
+func tickerLast(w http.ResponseWriter, r *http.Request) {
+	lastTrack, err := trackDataBase.Latest()
+	if err != nil {
+		errorStore(w, err)
+		return
+	}
+
+	fmt.Fprint(w, lastTrack.TimeStamp.Hex())
+}
 
+// Writes the ticker for the tracks added after the given timestamp
+func writeTicker(w http.ResponseWriter, after bson.ObjectId, processStart int64) {
 	var startTime bson.ObjectId
 	var stopTime bson.ObjectId
 
-	tracks := []string{}
+	tempTracks, err := trackDataBase.List(after, tickerCap)
+	if err != nil {
+		errorStore(w, err)
+		return
+	}
 
-	for i := deletedTracks + 1; i <= arrayCap + deletedTracks; i++ {
-		tempTimeStamp, ok := trackDataBase.Get("igc" + strconv.Itoa(i))
-		if !ok {
-			break
-		}
+	tracks := []string{}
+	for i, tempTimeStamp := range tempTracks {
 		tracks = append(tracks, tempTimeStamp.ID)
 
-		if i == 1 {
+		if i == 0 {
 			startTime = tempTimeStamp.TimeStamp
 		}
 		//Defined here many times in case there are less than 5 tracks
 		stopTime = tempTimeStamp.TimeStamp
 	}
 
-	trackTotal := trackDataBase.Count()
-	lastTimeStamp, ok := trackDataBase.Get("igc" + strconv.Itoa(trackTotal))
-	if !ok {
-		error400(w)
+	lastTimeStamp, err := trackDataBase.Latest()
+	if err != nil {
+		errorStore(w, err)
 		return
 	}
 
@@ -581,75 +675,29 @@ func ticker(w http.ResponseWriter, r *http.Request) {
 	w.Write(tickerJSON)
 }
 
-func tickerTimeStamp(w http.ResponseWriter, r *http.Request) {
+func ticker(w http.ResponseWriter, r *http.Request) {
 	processStart := time.Now().UnixNano() / int64(time.Millisecond)
-	arrayCap := 5
-
-	parts := strings.Split(r.URL.Path, "/")
-	stamp := bson.ObjectIdHex(parts[len(parts)-1])
-
-	var startTime bson.ObjectId
-	var stopTime bson.ObjectId
-
-	low := 1
-
-	for {
-		tempTimeStamp, ok := trackDataBase.Get("igc" + strconv.Itoa(low))
-		if !ok {
-			error400(w)
-			return
-		}
-
-		if stamp > tempTimeStamp.TimeStamp {
-			break
-		}
-		low++
-	}
-
-	tracks := []string{}
-
-	for i := low; i <= arrayCap+low; i++ {
-		tempTimeStamp, ok := trackDataBase.Get("igc" + strconv.Itoa(i))
-		if !ok {
-			break
-		}
-		tracks = append(tracks, tempTimeStamp.ID)
-
-		if i == 1 {
-			startTime = tempTimeStamp.TimeStamp
-		}
-		//Defined here many times in case there are less than 5 tracks
-		stopTime = tempTimeStamp.TimeStamp
-	}
-
-	trackTotal := trackDataBase.Count()
-	lastTimeStamp, ok := trackDataBase.Get("igc" + strconv.Itoa(trackTotal))
-	if !ok {
-		error400(w)
-		return
-	}
 
-	latest := lastTimeStamp.TimeStamp
-
-	process := (time.Now().UnixNano() / int64(time.Millisecond)) - processStart
-	processString := strconv.FormatInt(process, 10)
+	writeTicker(w, "", processStart)
+}
 
-	response := Ticker{latest, startTime, stopTime, tracks, processString}
+func tickerTimeStamp(w http.ResponseWriter, r *http.Request) {
+	processStart := time.Now().UnixNano() / int64(time.Millisecond)
 
-	tickerJSON, err := json.Marshal(response)
-	if err != nil {
+	parts := strings.Split(r.URL.Path, "/")
+	if !bson.IsObjectIdHex(parts[len(parts)-1]) {
 		error400(w)
 		return
 	}
+	stamp := bson.ObjectIdHex(parts[len(parts)-1])
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(tickerJSON)
+	writeTicker(w, stamp, processStart)
 }
 
 func newWebhook(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		error400(w)
+		return
 	}
 
 	var newWebhook Webhook
@@ -664,44 +712,88 @@ func newWebhook(w http.ResponseWriter, r *http.Request) {
 		newWebhook.Value = 1
 	}
 
-	webhookAmount++
-	newWebhook.ID = strconv.Itoa(webhookAmount)
-	newWebhook.TrackAdd = igcCount
+	if err := checkEventTypes(newWebhook.Events); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := newWebhook.Filter.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The secret may be chosen by the client, and is shown only now
+	newWebhook.OldSecret, newWebhook.OldSecretUntil = "", time.Time{}
+	if newWebhook.Secret == "" {
+		newWebhook.Secret, err = newSecret()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else if err := checkSecret(newWebhook.Secret); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sequence, err := webhookDataBase.NextSequence()
+	if err != nil {
+		errorStore(w, err)
+		return
+	}
+	newWebhook.ID = strconv.Itoa(sequence)
 
-	webhookDataBase.Add(newWebhook)
+	// Only tracks added from now on count towards the trigger
+	lastTrack, err := trackDataBase.Latest()
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		errorStore(w, err)
+		return
+	}
+	newWebhook.LastTrack = lastTrack.TimeStamp
 
-	fmt.Fprintf(w, newWebhook.ID)
+	err = webhookDataBase.Add(newWebhook)
+	if err != nil {
+		errorStore(w, err)
+		return
+	}
+
+	w.Header().Set(secretHeader, newWebhook.Secret)
+	fmt.Fprint(w, newWebhook.ID)
 }
 
-func sendWebhook(w http.ResponseWriter) {
+// Serializes sendWebhook, which jobs call from several workers
+var webhookMutex sync.Mutex
+
+// Queues a delivery for every webhook that has enough new tracks, see
+// webhookDispatcher. This runs in the background, so failures are only
+// logged.
+func sendWebhook() {
+	webhookMutex.Lock()
+	defer webhookMutex.Unlock()
 	processStart := time.Now().UnixNano() / int64(time.Millisecond)
 
-	hooks := webhookDataBase.Count()
-	if hooks == 0 {
+	hooks, err := webhookDataBase.List()
+	if err != nil {
+		log.Println("listing webhooks:", err)
 		return
 	}
 
-	for i := deletedTracks + 1; i <= hooks + deletedTracks; i++ {
-		tempWH, ok := webhookDataBase.Get(strconv.Itoa(i))
-		if !ok {
-			error400(w)
-			return
+	for _, tempWH := range hooks {
+		if len(tempWH.Events) > 0 {
+			continue
 		}
-		if tempWH.TrackAdd + tempWH.Value == igcCount + deletedTracks {
-			tempTimeStamp, ok := trackDataBase.Get("igc" + strconv.Itoa(igcCount))
-			if !ok {
-				error400(w)
-				return
-			}
-			tracks := []string{}
-			for i := tempWH.TrackAdd + 1; i <= igcCount + deletedTracks; i++ {
-				track, ok := trackDataBase.Get("igc" + strconv.Itoa(i))
-				if !ok {
-					error400(w)
-					return
-				}
+		newTracks, err := trackDataBase.List(tempWH.LastTrack, 0)
+		if err != nil {
+			log.Printf("listing new tracks for webhook %v: %v", tempWH.ID, err)
+			continue
+		}
+		tracks := []string{}
+		for _, track := range newTracks {
+			if tempWH.Filter.match(track) {
 				tracks = append(tracks, track.ID)
 			}
+		}
+		if len(tracks) > 0 && len(tracks) >= tempWH.Value {
+			// Past the filtered out tracks too, they are never counted
+			tempTimeStamp := newTracks[len(newTracks)-1]
 
 			process := (time.Now().UnixNano() / int64(time.Millisecond)) - processStart
 			processString := strconv.FormatInt(process, 10)
@@ -713,27 +805,21 @@ func sendWebhook(w http.ResponseWriter) {
 			messageJSON, err := json.Marshal(message)
 
 			if err != nil {
-				error400(w)
-				return
+				log.Println(err)
+				continue
 			}
 
-			tempWH.TrackAdd = igcCount + deletedTracks
-			ok = webhookDataBase.Delete("igc" + strconv.Itoa(i))
-			if !ok {
-				error400(w)
-				return
+			// Stored before the webhook moves on, so the tracks are
+			// announced at least once
+			if _, err := queueDelivery(tempWH.ID, messageJSON); err != nil {
+				log.Printf("queueing delivery for webhook %v: %v", tempWH.ID, err)
+				continue
 			}
 
-			webhookDataBase.Add(tempWH)
-
-			resp, err := http.Post(tempWH.URL, "application/json", bytes.NewBuffer(messageJSON))
-
-			var result map[string]interface{}
-
-			json.NewDecoder(resp.Body).Decode(&result)
-
-			log.Println(result)
-			log.Println(result["data"])
+			tempWH.LastTrack = tempTimeStamp.TimeStamp
+			if err := webhookDataBase.Update(tempWH); err != nil {
+				log.Printf("updating webhook %v: %v", tempWH.ID, err)
+			}
 		}
 	}
 }
@@ -744,13 +830,13 @@ func manageWebhook(w http.ResponseWriter, r *http.Request) {
 	ID := parts[len(parts)-1]
 
 	if r.Method == "GET" {
-		tempWH, ok := webhookDataBase.Get(ID)
-		if !ok {
-			error400(w)
+		tempWH, err := webhookDataBase.Get(ID)
+		if err != nil {
+			errorStore(w, err)
 			return
 		}
 
-		resp, err := json.Marshal(tempWH)
+		resp, err := json.Marshal(publicWebhook(tempWH))
 		if err != nil {
 			error400(w)
 			return
@@ -759,19 +845,19 @@ func manageWebhook(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write(resp)
 	} else if r.Method == "DELETE" {
-		tempWH, ok := webhookDataBase.Get(ID)
-		if !ok {
-			error400(w)
+		tempWH, err := webhookDataBase.Get(ID)
+		if err != nil {
+			errorStore(w, err)
 			return
 		}
 
-		ok = webhookDataBase.Delete(ID)
-		if !ok {
-			error400(w)
+		err = webhookDataBase.Delete(ID)
+		if err != nil {
+			errorStore(w, err)
 			return
 		}
 
-		resp, err := json.Marshal(tempWH)
+		resp, err := json.Marshal(publicWebhook(tempWH))
 		if err != nil {
 			error400(w)
 			return
@@ -825,16 +911,34 @@ func manageWebhook(w http.ResponseWriter, r *http.Request) {
 }*/
 
 func adminGet(w http.ResponseWriter, r *http.Request) {
-	count := trackDataBase.Count()
+	count, err := trackDataBase.Count()
+	if err != nil {
+		errorStore(w, err)
+		return
+	}
 	fmt.Fprint(w, count)
 }
 
 func adminDelete(w http.ResponseWriter, r *http.Request) {
-	count, ok := trackDataBase.Delete()
-	if !ok {
-		error400(w)
+	// Read first, for the track.deleted events
+	var purged []Track
+	if len(subscribers(eventTrackDeleted)) > 0 {
+		var err error
+		if purged, err = trackDataBase.List("", 0); err != nil {
+			errorStore(w, err)
+			return
+		}
+	}
+
+	count, err := trackDataBase.Delete()
+	if err != nil {
+		errorStore(w, err)
 		return
 	}
+	for _, track := range purged {
+		emitTrackEvent(eventTrackDeleted, track, trackEventOf(track))
+	}
+	emitEvent(eventTracksPurged, PurgeEvent{count})
 	fmt.Fprint(w, count)
 }
 
@@ -843,22 +947,68 @@ func errRouter(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
-	trackDataBase.Init()
-	webhookDataBase.Init()
+	var err error
+	trackDataBase, webhookDataBase, taskDataBase, err = openStores(os.Getenv("DB_BACKEND"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := trackDataBase.Init(); err != nil {
+		log.Fatal(err)
+	}
+	if err := webhookDataBase.Init(); err != nil {
+		log.Fatal(err)
+	}
+	if err := taskDataBase.Init(); err != nil {
+		log.Fatal(err)
+	}
+	if err := jobs.recover(); err != nil {
+		log.Fatal(err)
+	}
+	registerValidatorsFromEnv()
+	go dispatcher.run()
+	if airspaceDir != "" {
+		if err := airspaces.loadDir(airspaceDir); err != nil {
+			log.Fatal(err)
+		}
+		go airspaces.watchDir(airspaceDir, airspaceReload)
+	}
 	router := mux.NewRouter()
 
 	router.HandleFunc("/", errRouter)
 	router.HandleFunc("/paragliding/", paraglideHandler)
 	router.HandleFunc("/paragliding/api/", apiHandler)
 	router.HandleFunc("/paragliding/api/track/", trackHandler)
-	router.HandleFunc("/paragliding/api/track/[a-zA-Z0-9]{3,10}/", idHandler)
-	router.HandleFunc("/paragliding/api/track/[a-zA-Z0-9]{3,10}/(pilot|glider|glider_id|track_length|H_date)/", fieldHandler)
+	router.HandleFunc("/paragliding/api/track/import", importHandler) // before {id}, which would match it
+	router.HandleFunc("/paragliding/api/track/{id:[a-zA-Z0-9]{3,10}}", idHandler)
+	router.HandleFunc("/paragliding/api/track/{id:[a-zA-Z0-9]{3,10}}.{format:kml|kmz}", kmlHandler)
+	router.HandleFunc("/paragliding/api/track/{id:[a-zA-Z0-9]{3,10}}/igc", igcHandler)
+	router.HandleFunc("/paragliding/api/track/{id:[a-zA-Z0-9]{3,10}}/gpx", gpxHandler)
+	router.HandleFunc("/paragliding/api/track/{id:[a-zA-Z0-9]{3,10}}/geojson", geojsonHandler)
+	router.HandleFunc("/paragliding/api/track/{id:[a-zA-Z0-9]{3,10}}/thermals", thermalsHandler)
+	router.HandleFunc("/paragliding/api/track/{id:[a-zA-Z0-9]{3,10}}/task", declaredTaskHandler)
+	router.HandleFunc("/paragliding/api/track/{id:[a-zA-Z0-9]{3,10}}/airspace", airspaceHandler)
+	router.HandleFunc("/paragliding/api/track/{id:[a-zA-Z0-9]{3,10}}/{field:pilot|glider|glider_id|track_length|H_date|track_src_url|"+strings.Join(statsFields, "|")+"}", fieldHandler)
+	router.HandleFunc("/paragliding/api/task/", taskHandler)
+	router.HandleFunc("/paragliding/api/task/{id:[a-zA-Z0-9]{3,10}}", manageTask)
+	router.HandleFunc("/paragliding/api/task/{id:[a-zA-Z0-9]{3,10}}/verify/{track:[a-zA-Z0-9]{3,10}}", verifyHandler)
+	router.HandleFunc("/paragliding/api/task/{id:[a-zA-Z0-9]{3,10}}/tracks", taskTracksHandler)
+	router.HandleFunc("/paragliding/api/task/{id:[a-zA-Z0-9]{3,10}}/results", resultsHandler)
+	router.HandleFunc("/paragliding/api/jobs/{id:[a-zA-Z0-9]{3,24}}", jobHandler)
 	router.HandleFunc("/paragliding/api/ticker/latest", tickerLast)
 	router.HandleFunc("/paragliding/api/ticker/", ticker)
-	router.HandleFunc("/paragliding/api/ticker/{[0-9A-Za-z]}", tickerTimeStamp)
+	router.HandleFunc("/paragliding/api/ticker/{timestamp:[0-9A-Za-z]+}", tickerTimeStamp)
+	router.HandleFunc("/paragliding/api/webhook/", newWebhook)
+	router.HandleFunc("/paragliding/api/webhook/{id:[0-9A-Za-z]+}", manageWebhook)
+	router.HandleFunc("/paragliding/api/webhook/{id:[0-9A-Za-z]+}/deliveries", deliveriesHandler)
+	router.HandleFunc("/paragliding/api/webhook/{id:[0-9A-Za-z]+}/secret", secretHandler)
 	router.HandleFunc("/paragliding/api/webhook/new_track/", newWebhook)
-	router.HandleFunc("/paragliding/api/webhook/new_track/{[0-9A-Za-z]}", manageWebhook)
+	router.HandleFunc("/paragliding/api/webhook/new_track/{id:[0-9A-Za-z]+}", manageWebhook)
+	router.HandleFunc("/paragliding/api/webhook/new_track/{id:[0-9A-Za-z]+}/deliveries", deliveriesHandler)
+	router.HandleFunc("/paragliding/api/webhook/new_track/{id:[0-9A-Za-z]+}/secret", secretHandler)
 	router.HandleFunc("/UnexpectedURL/admin/api/tracks_count", adminGet)
 	router.HandleFunc("/UnexpectedURL/admin/api/tracks", adminDelete)
-	log.Fatal(http.ListenAndServe(":" + os.Getenv("PORT"), nil))
+	router.HandleFunc("/UnexpectedURL/admin/api/airspace", adminAirspace)
+	router.HandleFunc("/UnexpectedURL/admin/api/webhook_deadletters", deadLettersHandler)
+	router.HandleFunc("/UnexpectedURL/admin/api/webhook_secret/{id:[0-9A-Za-z]+}", adminSecretHandler)
+	log.Fatal(http.ListenAndServe(":" + os.Getenv("PORT"), router))
 }
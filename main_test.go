@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Uses fresh in-memory stores for the handlers
+func setupMemStores(t *testing.T) {
+	trackDataBase, webhookDataBase, taskDataBase = newTrackMemDB(), newWebhookMemDB(), newTaskMemDB()
+}
+
+// TrackStore whose database is always down
+type downTrackDB struct{ trackMemDB }
+
+func (db *downTrackDB) Get(keyID string) (Track, error) {
+	return Track{}, ErrUnavailable
+}
+
+// TrackStore whose FindByHash misses the next stale tracks, like a check
+// made just before another worker stored the same flight
+type staleHashTrackDB struct {
+	*trackMemDB
+	stale int
+}
+
+func (db *staleHashTrackDB) FindByHash(hash string) (Track, error) {
+	if db.stale > 0 {
+		db.stale--
+		return Track{}, ErrNotFound
+	}
+	return db.trackMemDB.FindByHash(hash)
+}
+
+func TestIdHandler_Status(t *testing.T) {
+	setupMemStores(t)
+	trackDataBase.Add(Track{ID: "igc1", Pilot: "Gerd"})
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/paragliding/api/track/igc1", http.StatusOK},
+		{"/paragliding/api/track/igc2", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		idHandler(w, httptest.NewRequest("GET", test.path, nil))
+		if w.Code != test.status {
+			t.Errorf("GET %v gave %d, want %d", test.path, w.Code, test.status)
+		}
+	}
+
+	trackDataBase = &downTrackDB{}
+	w := httptest.NewRecorder()
+	idHandler(w, httptest.NewRequest("GET", "/paragliding/api/track/igc1", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET with the database down gave %d, want 503", w.Code)
+	}
+}
+
+func TestErrorStore(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{ErrNotFound, http.StatusNotFound},
+		{ErrDuplicate, http.StatusConflict},
+		{ErrUnavailable, http.StatusServiceUnavailable},
+		{fmt.Errorf("%w: no reachable servers", ErrUnavailable), http.StatusServiceUnavailable},
+		{errors.New("something else"), http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		errorStore(w, test.err)
+		if w.Code != test.status {
+			t.Errorf("errorStore(%v) gave %d, want %d", test.err, w.Code, test.status)
+		}
+	}
+}
+
+// Reads a file from testdata
+func readTestData(t *testing.T, name string) []byte {
+	content, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func TestTrackHandler_Upload(t *testing.T) {
+	content := readTestData(t, "sample.igc")
+
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	part, _ := writer.CreateFormFile("igc", "sample.igc")
+	part.Write(content)
+	writer.Close()
+
+	tests := []struct {
+		contentType string
+		body        []byte
+		status      int
+	}{
+		{"application/octet-stream", content, http.StatusAccepted},
+		{"text/plain; charset=utf-8", content, http.StatusAccepted},
+		{writer.FormDataContentType(), form.Bytes(), http.StatusAccepted},
+		{"application/octet-stream", []byte("not an igc file"), http.StatusBadRequest},
+		{"text/plain", []byte{}, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		setupMemStores(t) // so the same file can be added again
+		r := httptest.NewRequest("POST", "/paragliding/api/track/", bytes.NewReader(test.body))
+		r.Header.Set("Content-Type", test.contentType)
+		w := httptest.NewRecorder()
+		trackHandler(w, r)
+		if w.Code != test.status {
+			t.Errorf("POST %v gave %d, want %d", test.contentType, w.Code, test.status)
+			continue
+		}
+		if test.status != http.StatusAccepted {
+			continue
+		}
+
+		var job Job
+		if err := json.Unmarshal(w.Body.Bytes(), &job); err != nil || w.Header().Get("Location") != "/paragliding/api/jobs/"+job.ID {
+			t.Errorf("POST %v did not return a job: %v", test.contentType, err)
+		}
+		id := waitJob(t, job.ID).TrackID
+		track, err := trackDataBase.Get(id)
+		if err != nil {
+			t.Errorf("uploaded track %v not stored: %v", id, err)
+		}
+		if track.Pilot != "Gerd Gliding" || track.Glider != "Ozone Rush 5" || track.URL != "" {
+			t.Errorf("uploaded track stored as %+v", track)
+		}
+	}
+}
+
+func TestIgcHandler(t *testing.T) {
+	setupMemStores(t)
+	content := readTestData(t, "sample.igc")
+
+	id := postIGC(t, content)
+	track, err := trackDataBase.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(content)
+	if track.SHA256 != hex.EncodeToString(digest[:]) {
+		t.Errorf("stored digest %v does not match the file", track.SHA256)
+	}
+
+	w := httptest.NewRecorder()
+	igcHandler(w, httptest.NewRequest("GET", "/paragliding/api/track/"+id+"/igc", nil))
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), content) {
+		t.Errorf("GET igc gave %d and a different file", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	igcHandler(w, httptest.NewRequest("GET", "/paragliding/api/track/igc99/igc", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("GET igc of a missing track gave %d, want 404", w.Code)
+	}
+}
+
+// POSTs an IGC file to trackHandler
+func postTrack(t *testing.T, content []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/paragliding/api/track/", bytes.NewReader(content))
+	r.Header.Set("Content-Type", "application/octet-stream")
+	w := httptest.NewRecorder()
+	trackHandler(w, r)
+	return w
+}
+
+// POSTs an IGC file to trackHandler and waits for the track to be added,
+// returning its id
+func postIGC(t *testing.T, content []byte) string {
+	w := postTrack(t, content)
+	var id string
+	switch w.Code {
+	case http.StatusOK: // a duplicate
+		json.Unmarshal(w.Body.Bytes(), &id)
+	case http.StatusAccepted:
+		var job Job
+		json.Unmarshal(w.Body.Bytes(), &job)
+		job = waitJob(t, job.ID)
+		if job.Status != jobDone {
+			t.Fatalf("adding the track failed: %v", job.Error)
+		}
+		id = job.TrackID
+	default:
+		t.Fatalf("POST track gave %d %q", w.Code, w.Body.String())
+	}
+	return id
+}
+
+func TestCanonicalHash(t *testing.T) {
+	content := readTestData(t, "sample.igc")
+	unix := bytes.Replace(content, []byte("\r\n"), []byte("\n"), -1)
+	logged := append(append([]byte(nil), content...), []byte("LXXXsome comment\r\nGABCDEF\r\n")...)
+	edited := bytes.Replace(content, []byte("Gerd Gliding"), []byte("Someone Else"), 1)
+
+	hash := canonicalHash(content)
+	if canonicalHash(unix) != hash || canonicalHash(logged) != hash {
+		t.Error("line endings or L/G records changed the hash")
+	}
+	if canonicalHash(edited) == hash {
+		t.Error("changing the pilot did not change the hash")
+	}
+}
+
+func TestTrackHandler_Duplicate(t *testing.T) {
+	setupMemStores(t)
+	content := readTestData(t, "sample.igc")
+
+	var second string
+	first := postIGC(t, content)
+	w := postTrack(t, bytes.Replace(content, []byte("\r\n"), []byte("\n"), -1))
+	json.Unmarshal(w.Body.Bytes(), &second)
+	if w.Code != http.StatusOK || first != second {
+		t.Errorf("second upload gave %d %q, want 200 %q", w.Code, second, first)
+	}
+	if count, _ := trackDataBase.Count(); count != 1 {
+		t.Errorf("%d tracks stored, want 1", count)
+	}
+
+	os.Setenv("DUPLICATE_TRACKS", "conflict")
+	defer os.Unsetenv("DUPLICATE_TRACKS")
+	w = postTrack(t, content)
+	if w.Code != http.StatusConflict || w.Header().Get("Location") != "/paragliding/api/track/"+first {
+		t.Errorf("duplicate with DUPLICATE_TRACKS=conflict gave %d, Location %q", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestAddTrack_Race(t *testing.T) {
+	setupMemStores(t)
+	db := &staleHashTrackDB{trackMemDB: newTrackMemDB()}
+	trackDataBase = db
+	content := readTestData(t, "sample.igc")
+	track, err := parseTrack(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, duplicate, err := addTrack(content, track, "")
+	if err != nil || duplicate {
+		t.Fatalf("first addTrack() gave %+v, %v, %v", first, duplicate, err)
+	}
+	db.stale = 1
+	second, duplicate, err := addTrack(content, track, "")
+	if err != nil || !duplicate || second.ID != first.ID {
+		t.Errorf("racing addTrack() gave %+v, %v, %v, want %v", second.ID, duplicate, err, first.ID)
+	}
+	if count, _ := db.Count(); count != 1 || len(db.files) != 1 {
+		t.Errorf("%d tracks and %d files stored, want 1", count, len(db.files))
+	}
+}
+
+func TestTicker(t *testing.T) {
+	setupMemStores(t)
+	content := readTestData(t, "sample.igc")
+
+	ids := []string{}
+	for _, pilot := range []string{"Anne", "Bob", "Carl"} {
+		edited := bytes.Replace(content, []byte("Gerd Gliding"), []byte(pilot), 1)
+		ids = append(ids, postIGC(t, edited))
+	}
+	first, _ := trackDataBase.Get(ids[0])
+
+	w := httptest.NewRecorder()
+	ticker(w, httptest.NewRequest("GET", "/paragliding/api/ticker/", nil))
+	var response Ticker
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if len(response.Tracks) != 3 || response.Tracks[0] != ids[0] || response.TStart != first.TimeStamp {
+		t.Errorf("ticker gave %+v", response)
+	}
+
+	w = httptest.NewRecorder()
+	tickerTimeStamp(w, httptest.NewRequest("GET", "/paragliding/api/ticker/"+first.TimeStamp.Hex(), nil))
+	response = Ticker{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if len(response.Tracks) != 2 || response.Tracks[0] != ids[1] {
+		t.Errorf("ticker after %v gave %+v", ids[0], response)
+	}
+
+	w = httptest.NewRecorder()
+	tickerTimeStamp(w, httptest.NewRequest("GET", "/paragliding/api/ticker/nonsense", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("ticker with a bad timestamp gave %d, want 400", w.Code)
+	}
+}
+
+func TestTrackHandler_List(t *testing.T) {
+	setupMemStores(t)
+	content := readTestData(t, "sample.igc")
+
+	ids := []string{}
+	for _, pilot := range []string{"Anne", "Bob", "Carl"} {
+		edited := bytes.Replace(content, []byte("Gerd Gliding"), []byte(pilot), 1)
+		ids = append(ids, postIGC(t, edited))
+	}
+
+	// Follow the Link headers two at a time
+	listed := []string{}
+	path := "/paragliding/api/track/?limit=2"
+	for pages := 0; path != ""; pages++ {
+		if pages > 3 {
+			t.Fatal("listing did not end")
+		}
+		w := httptest.NewRecorder()
+		trackHandler(w, httptest.NewRequest("GET", path, nil))
+		var page []string
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("GET %v gave %d %q", path, w.Code, w.Body.String())
+		}
+		listed = append(listed, page...)
+
+		path = ""
+		if link := w.Header().Get("Link"); link != "" {
+			path = strings.TrimSuffix(strings.TrimPrefix(link, "<"), ">; rel=\"next\"")
+		}
+	}
+	if strings.Join(listed, " ") != strings.Join(ids, " ") {
+		t.Errorf("paged listing gave %v, want %v", listed, ids)
+	}
+
+	w := httptest.NewRecorder()
+	trackHandler(w, httptest.NewRequest("GET", "/paragliding/api/track/?pilot=Bob", nil))
+	if w.Body.String() != `["`+ids[1]+`"]` {
+		t.Errorf("listing by pilot gave %v", w.Body.String())
+	}
+
+	for _, query := range []string{"limit=0", "limit=1001", "after=nonsense", "from=yesterday", "min_length=far", "validation=ok", "sort=pilot"} {
+		w := httptest.NewRecorder()
+		trackHandler(w, httptest.NewRequest("GET", "/paragliding/api/track/?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("GET with %v gave %d, want 400", query, w.Code)
+		}
+	}
+}
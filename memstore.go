@@ -0,0 +1,421 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// In-memory stores, handy for running without any database at all.
+// Everything is lost when the process stops.
+
+type trackMemDB struct {
+	mutex    sync.RWMutex
+	tracks   map[string]Track
+	files    map[string][]byte
+	jobs     map[string]Job
+	sequence int
+}
+
+type webhookMemDB struct {
+	mutex      sync.RWMutex
+	webhooks   map[string]Webhook
+	deliveries map[string]Delivery
+	sequence   int
+}
+
+type taskMemDB struct {
+	mutex    sync.RWMutex
+	tasks    map[string]Task
+	sequence int
+}
+
+func newTrackMemDB() *trackMemDB {
+	return &trackMemDB{tracks: make(map[string]Track), files: make(map[string][]byte), jobs: make(map[string]Job)}
+}
+
+func newWebhookMemDB() *webhookMemDB {
+	return &webhookMemDB{webhooks: make(map[string]Webhook), deliveries: make(map[string]Delivery)}
+}
+
+func newTaskMemDB() *taskMemDB {
+	return &taskMemDB{tasks: make(map[string]Task)}
+}
+
+func (db *trackMemDB) Init() error { return nil }
+
+func (db *webhookMemDB) Init() error { return nil }
+
+func (db *taskMemDB) Init() error { return nil }
+
+func (db *trackMemDB) Add(s Track) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if _, ok := db.tracks[s.ID]; ok {
+		return ErrDuplicate
+	}
+	for _, track := range db.tracks {
+		if s.ContentHash != "" && track.ContentHash == s.ContentHash {
+			return ErrDuplicate
+		}
+	}
+	db.tracks[s.ID] = s
+	return nil
+}
+
+func (db *webhookMemDB) Add(s Webhook) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if _, ok := db.webhooks[s.ID]; ok {
+		return ErrDuplicate
+	}
+	db.webhooks[s.ID] = s
+	return nil
+}
+
+func (db *trackMemDB) Count() (int, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return len(db.tracks), nil
+}
+
+func (db *webhookMemDB) Count() (int, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return len(db.webhooks), nil
+}
+
+func (db *trackMemDB) Get(keyID string) (Track, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	track, ok := db.tracks[keyID]
+	if !ok {
+		return track, ErrNotFound
+	}
+	return track, nil
+}
+
+func (db *trackMemDB) FindByHash(hash string) (Track, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	for _, track := range db.tracks {
+		if track.ContentHash == hash {
+			return track, nil
+		}
+	}
+	return Track{}, ErrNotFound
+}
+
+func (db *trackMemDB) NextSequence() (int, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.sequence++
+	return db.sequence, nil
+}
+
+func (db *webhookMemDB) NextSequence() (int, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.sequence++
+	return db.sequence, nil
+}
+
+// All tracks ordered by TimeStamp, the caller must hold the lock
+func (db *trackMemDB) sorted() []Track {
+	tracks := make([]Track, 0, len(db.tracks))
+	for _, track := range db.tracks {
+		tracks = append(tracks, track)
+	}
+	sort.Slice(tracks, func(i, j int) bool {
+		return tracks[i].TimeStamp < tracks[j].TimeStamp
+	})
+	return tracks
+}
+
+func (db *trackMemDB) List(after bson.ObjectId, limit int) ([]Track, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	tracks := []Track{}
+	for _, track := range db.sorted() {
+		if limit > 0 && len(tracks) == limit {
+			break
+		}
+		if track.TimeStamp > after {
+			tracks = append(tracks, track)
+		}
+	}
+	return tracks, nil
+}
+
+func (db *trackMemDB) Latest() (Track, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	tracks := db.sorted()
+	if len(tracks) == 0 {
+		return Track{}, ErrNotFound
+	}
+	return tracks[len(tracks)-1], nil
+}
+
+func (db *trackMemDB) Find(q TrackQuery) ([]Track, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return q.apply(db.sorted()), nil
+}
+
+func (db *webhookMemDB) List() ([]Webhook, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	hooks := make([]Webhook, 0, len(db.webhooks))
+	for _, hook := range db.webhooks {
+		hooks = append(hooks, hook)
+	}
+	sort.Slice(hooks, func(i, j int) bool {
+		return idNumber(hooks[i].ID) < idNumber(hooks[j].ID)
+	})
+	return hooks, nil
+}
+
+func (db *webhookMemDB) Get(keyID string) (Webhook, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	hook, ok := db.webhooks[keyID]
+	if !ok {
+		return hook, ErrNotFound
+	}
+	return hook, nil
+}
+
+func (db *trackMemDB) Delete() (int, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	count := len(db.tracks)
+	db.tracks = make(map[string]Track)
+	db.files = make(map[string][]byte)
+	return count, nil
+}
+
+func (db *trackMemDB) AddIGC(keyID string, content []byte) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if _, ok := db.files[keyID]; ok {
+		return ErrDuplicate
+	}
+	db.files[keyID] = append([]byte(nil), content...)
+	return nil
+}
+
+func (db *trackMemDB) GetIGC(keyID string) ([]byte, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	content, ok := db.files[keyID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), content...), nil
+}
+
+func (db *trackMemDB) DeleteIGC(keyID string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if _, ok := db.files[keyID]; !ok {
+		return ErrNotFound
+	}
+	delete(db.files, keyID)
+	return nil
+}
+
+func (db *webhookMemDB) Delete(keyID string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if _, ok := db.webhooks[keyID]; !ok {
+		return ErrNotFound
+	}
+	delete(db.webhooks, keyID)
+	return nil
+}
+
+func (db *webhookMemDB) Update(s Webhook) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if _, ok := db.webhooks[s.ID]; !ok {
+		return ErrNotFound
+	}
+	db.webhooks[s.ID] = s
+	return nil
+}
+
+func (db *trackMemDB) AddJob(j Job) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if _, ok := db.jobs[j.ID]; ok {
+		return ErrDuplicate
+	}
+	db.jobs[j.ID] = j
+	return nil
+}
+
+func (db *trackMemDB) UpdateJob(j Job) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if _, ok := db.jobs[j.ID]; !ok {
+		return ErrNotFound
+	}
+	db.jobs[j.ID] = j
+	return nil
+}
+
+func (db *trackMemDB) GetJob(keyID string) (Job, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	job, ok := db.jobs[keyID]
+	if !ok {
+		return Job{}, ErrNotFound
+	}
+	return job, nil
+}
+
+func (db *trackMemDB) FindJobs(instance string, status string) ([]Job, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	jobs := []Job{}
+	for _, job := range db.jobs {
+		if (instance == "" || job.Instance == instance) && (status == "" || job.Status == status) {
+			jobs = append(jobs, job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].ID < jobs[j].ID
+	})
+	return jobs, nil
+}
+
+func (db *trackMemDB) DeleteJobs(before time.Time) (int, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	count := 0
+	for id, job := range db.jobs {
+		if job.Updated.Before(before) {
+			delete(db.jobs, id)
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (db *webhookMemDB) AddDelivery(d Delivery) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if _, ok := db.deliveries[d.ID]; ok {
+		return ErrDuplicate
+	}
+	db.deliveries[d.ID] = d
+	return nil
+}
+
+func (db *webhookMemDB) UpdateDelivery(d Delivery) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if _, ok := db.deliveries[d.ID]; !ok {
+		return ErrNotFound
+	}
+	db.deliveries[d.ID] = d
+	return nil
+}
+
+func (db *webhookMemDB) FindDeliveries(webhookID string, status string) ([]Delivery, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	deliveries := []Delivery{}
+	for _, delivery := range db.deliveries {
+		if (webhookID == "" || delivery.WebhookID == webhookID) && (status == "" || delivery.Status == status) {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].ID < deliveries[j].ID
+	})
+	return deliveries, nil
+}
+
+func (db *taskMemDB) Add(s Task) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if _, ok := db.tasks[s.ID]; ok {
+		return ErrDuplicate
+	}
+	db.tasks[s.ID] = s
+	return nil
+}
+
+func (db *taskMemDB) Count() (int, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return len(db.tasks), nil
+}
+
+func (db *taskMemDB) Get(keyID string) (Task, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	task, ok := db.tasks[keyID]
+	if !ok {
+		return task, ErrNotFound
+	}
+	return task, nil
+}
+
+func (db *taskMemDB) AddTrack(taskID string, trackID string) (Task, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	task, ok := db.tasks[taskID]
+	if !ok {
+		return task, ErrNotFound
+	}
+	for _, submitted := range task.Tracks {
+		if submitted == trackID {
+			return task, ErrDuplicate
+		}
+	}
+	// A new slice, since callers may hold on to the old one
+	task.Tracks = append(append([]string{}, task.Tracks...), trackID)
+	db.tasks[taskID] = task
+	return task, nil
+}
+
+func (db *taskMemDB) NextSequence() (int, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.sequence++
+	return db.sequence, nil
+}
+
+func (db *taskMemDB) List() ([]Task, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	tasks := make([]Task, 0, len(db.tasks))
+	for _, task := range db.tasks {
+		tasks = append(tasks, task)
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		return idNumber(tasks[i].ID) < idNumber(tasks[j].ID)
+	})
+	return tasks, nil
+}
+
+func (db *taskMemDB) Delete(keyID string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if _, ok := db.tasks[keyID]; !ok {
+		return ErrNotFound
+	}
+	delete(db.tasks, keyID)
+	return nil
+}
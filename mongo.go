@@ -0,0 +1,906 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// mongoConfig holds the connection settings shared by the MongoDB stores
+type mongoConfig struct {
+	PoolLimit     int           // max sockets per server, 0 keeps the mgo default
+	DialTimeout   time.Duration // time allowed for each dial attempt
+	SocketTimeout time.Duration // time allowed for each operation
+	DialRetries   int           // dial attempts before giving up
+	RetryDelay    time.Duration // wait after the first failed dial, doubled every attempt
+}
+
+// Default settings, overridden through the MONGODB_* environment variables
+var defaultMongoConfig = mongoConfig{
+	PoolLimit:     0,
+	DialTimeout:   10 * time.Second,
+	SocketTimeout: time.Minute,
+	DialRetries:   5,
+	RetryDelay:    500 * time.Millisecond,
+}
+
+// mongoSession is the long-lived session dialed once by the first Init()
+// of the stores sharing it. Every operation works on a copy of it, which
+// takes a socket from the pool.
+type mongoSession struct {
+	HostURL string
+	Config  mongoConfig
+
+	mutex   sync.Mutex
+	session *mgo.Session
+}
+
+type trackDB struct {
+	*mongoSession
+	DatabaseName        string
+	TrackCollectionName string
+}
+
+type webhookDB struct {
+	*mongoSession
+	DatabaseName          string
+	WebhookCollectionName string
+}
+
+type taskDB struct {
+	*mongoSession
+	DatabaseName       string
+	TaskCollectionName string
+}
+
+// Dials the server, retrying with a growing delay when it isn't reachable
+func (m *mongoSession) dial(attempts int) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.session != nil {
+		return nil
+	}
+
+	if attempts < 1 {
+		attempts = 1
+	}
+	delay := m.Config.RetryDelay
+
+	var err error
+	for i := 1; i <= attempts; i++ {
+		var session *mgo.Session
+		session, err = mgo.DialWithTimeout(m.HostURL, m.Config.DialTimeout)
+		if err == nil {
+			if m.Config.PoolLimit > 0 {
+				session.SetPoolLimit(m.Config.PoolLimit)
+			}
+			session.SetSocketTimeout(m.Config.SocketTimeout)
+			m.session = session
+			return nil
+		}
+		log.Printf("dial %v failed (attempt %d of %d): %v", m.HostURL, i, attempts, err)
+		if i < attempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	return err
+}
+
+// Returns a copy of the shared session, dialing once more if Init() never
+// got through. The copy must be closed by the caller.
+func (m *mongoSession) copy() (*mgo.Session, error) {
+	if err := m.dial(1); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.session == nil { // closed since
+		return nil, fmt.Errorf("%w: session closed", ErrUnavailable)
+	}
+	return m.session.Copy(), nil
+}
+
+// Reports whether the error is a connection failure rather than an error
+// of the server or of the document. mgo makes some of them with
+// errors.New, so those are known by their text.
+func isNetworkError(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	switch err.Error() {
+	case "no reachable servers", "Closed explicitly":
+		return true
+	}
+	return false
+}
+
+// Translates mgo errors into the store errors. Connection failures reset
+// the shared session, so the next copy gets fresh sockets instead of the
+// broken ones. Other errors are returned as they are.
+func (m *mongoSession) wrap(err error) error {
+	if err == nil {
+		return nil
+	}
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	if mgo.IsDup(err) {
+		return ErrDuplicate
+	}
+	if !isNetworkError(err) {
+		return err
+	}
+
+	log.Printf("mongo operation failed, refreshing session: %v", err)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.session != nil {
+		m.session.Refresh()
+	}
+	return fmt.Errorf("%w: %v", ErrUnavailable, err)
+}
+
+// Close releases the shared session
+func (m *mongoSession) Close() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.session != nil {
+		m.session.Close()
+		m.session = nil
+	}
+}
+
+// Dials the shared session and makes sure ids are unique in the collection.
+// Returns the documents that had to be renumbered for that.
+func (m *mongoSession) init(databaseName string, collectionName string, indexes ...mgo.Index) ([]renumbering, error) {
+	if err := m.dial(m.Config.DialRetries); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	session, err := m.copy()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	collection := session.DB(databaseName).C(collectionName)
+
+	for _, index := range indexes {
+		if err := collection.EnsureIndex(index); err != nil {
+			return nil, m.wrap(err)
+		}
+	}
+	idIndex := mgo.Index{Key: []string{"id"}, Unique: true}
+	err = collection.EnsureIndex(idIndex)
+	if !mgo.IsDup(err) {
+		return nil, m.wrap(err)
+	}
+	// Only the first start on a collection with duplicate ids gets here
+	renumbered, err := m.renumberDuplicates(databaseName, collectionName)
+	if err != nil {
+		return renumbered, err
+	}
+	return renumbered, m.wrap(collection.EnsureIndex(idIndex))
+}
+
+// A document given a new id, because an older one has the same
+type renumbering struct {
+	DocID interface{} // _id of the document
+	From  string
+	To    string
+}
+
+// Gives every document whose id an older document already has a new id
+// from the sequence, keeping its prefix. Before there were sequences, the
+// counter started again on every restart and handed out the same ids.
+func (m *mongoSession) renumberDuplicates(databaseName string, collectionName string) ([]renumbering, error) {
+	session, err := m.copy()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	collection := session.DB(databaseName).C(collectionName)
+
+	var groups []struct {
+		ID   string        `bson:"_id"`
+		Docs []interface{} `bson:"docs"`
+	}
+	pipeline := []bson.M{
+		{"$sort": bson.M{"_id": 1}},
+		{"$group": bson.M{"_id": "$id", "docs": bson.M{"$push": "$_id"}, "count": bson.M{"$sum": 1}}},
+		{"$match": bson.M{"count": bson.M{"$gt": 1}}},
+	}
+	if err := collection.Pipe(pipeline).AllowDiskUse().All(&groups); err != nil {
+		return nil, m.wrap(err)
+	}
+
+	renumbered := []renumbering{}
+	for _, group := range groups {
+		prefix := strings.TrimRight(group.ID, "0123456789")
+		// The oldest keeps its id
+		for _, docID := range group.Docs[1:] {
+			number, err := m.nextSequence(databaseName, collectionName)
+			if err != nil {
+				return renumbered, err
+			}
+			to := prefix + strconv.Itoa(number)
+			if err := collection.UpdateId(docID, bson.M{"$set": bson.M{"id": to}}); err != nil {
+				return renumbered, m.wrap(err)
+			}
+			log.Printf("%v: renumbered %v to %v, its id was taken", collectionName, group.ID, to)
+			renumbered = append(renumbered, renumbering{DocID: docID, From: group.ID, To: to})
+		}
+	}
+	return renumbered, nil
+}
+
+// Documents of the "counters" collection, one per sequence
+type counter struct {
+	ID  string `bson:"_id"`
+	Seq int    `bson:"seq"`
+}
+
+// Hands out the next number of the sequence named after collectionName.
+// A new sequence continues after the highest id already in the collection.
+func (m *mongoSession) nextSequence(databaseName string, collectionName string) (int, error) {
+	session, err := m.copy()
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+	counters := session.DB(databaseName).C("counters")
+
+	n, err := counters.FindId(collectionName).Count()
+	if err != nil {
+		return 0, m.wrap(err)
+	}
+	if n == 0 {
+		seed := counter{ID: collectionName}
+		var doc struct{ ID string }
+		iter := session.DB(databaseName).C(collectionName).Find(nil).Select(bson.M{"id": 1}).Iter()
+		for iter.Next(&doc) {
+			if number := idNumber(doc.ID); number > seed.Seq {
+				seed.Seq = number
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return 0, m.wrap(err)
+		}
+		// Another replica may have seeded it meanwhile, that's fine
+		if err := counters.Insert(seed); err != nil && !mgo.IsDup(err) {
+			return 0, m.wrap(err)
+		}
+	}
+
+	next := counter{}
+	change := mgo.Change{Update: bson.M{"$inc": bson.M{"seq": 1}}, ReturnNew: true}
+	_, err = counters.FindId(collectionName).Apply(change, &next)
+	return next.Seq, m.wrap(err)
+}
+
+func (db *trackDB) Init() error {
+	// Sparse, since tracks stored before deduplication have no hash
+	hashIndex := mgo.Index{Key: []string{"contenthash"}, Unique: true, Sparse: true}
+	orderIndex := mgo.Index{Key: []string{"timestamp"}}
+	// Indexes for the filters and sort orders of Find()
+	findIndexes := []mgo.Index{
+		{Key: []string{"pilot", "timestamp"}},
+		{Key: []string{"glider", "timestamp"}},
+		{Key: []string{"gliderid", "timestamp"}},
+		{Key: []string{"hdate", "timestamp"}},
+		{Key: []string{"tracklength", "timestamp"}},
+		{Key: []string{"validation", "timestamp"}},
+	}
+	renumbered, err := db.init(db.DatabaseName, db.TrackCollectionName, append(findIndexes, hashIndex, orderIndex)...)
+	if err != nil {
+		return err
+	}
+	if err := db.moveIGC(renumbered); err != nil {
+		return err
+	}
+	// For FindJobs() and DeleteJobs()
+	jobIndexes := []mgo.Index{
+		{Key: []string{"instance", "status", "id"}},
+		{Key: []string{"updated"}},
+	}
+	_, err = db.init(db.DatabaseName, db.jobCollection(), jobIndexes...)
+	return err
+}
+
+// Renames the original files of renumbered tracks. The files of tracks
+// sharing an id have the same name, so the one with the track's digest
+// is picked.
+func (db *trackDB) moveIGC(renumbered []renumbering) error {
+	if len(renumbered) == 0 {
+		return nil
+	}
+	session, err := db.copy()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	gridFS := db.gridFS(session)
+
+	for _, r := range renumbered {
+		track := Track{}
+		if err := session.DB(db.DatabaseName).C(db.TrackCollectionName).FindId(r.DocID).One(&track); err != nil {
+			return db.wrap(err)
+		}
+		if track.SHA256 == "" { // stored before the files were kept
+			continue
+		}
+		var file *mgo.GridFile
+		iter := gridFS.Find(bson.M{"filename": r.From}).Iter()
+		for gridFS.OpenNext(iter, &file) {
+			content, err := ioutil.ReadAll(file)
+			if err != nil {
+				file.Close()
+				iter.Close()
+				return db.wrap(err)
+			}
+			if digest := sha256.Sum256(content); hex.EncodeToString(digest[:]) == track.SHA256 {
+				file.Close()
+				if err := gridFS.Files.UpdateId(file.Id(), bson.M{"$set": bson.M{"filename": r.To}}); err != nil {
+					iter.Close()
+					return db.wrap(err)
+				}
+				break
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return db.wrap(err)
+		}
+	}
+	return nil
+}
+
+func (db *webhookDB) Init() error {
+	if _, err := db.init(db.DatabaseName, db.WebhookCollectionName); err != nil {
+		return err
+	}
+	// For the dispatcher and the listings of FindDeliveries()
+	deliveryIndexes := []mgo.Index{
+		{Key: []string{"status", "id"}},
+		{Key: []string{"webhookid", "id"}},
+	}
+	_, err := db.init(db.DatabaseName, db.deliveryCollection(), deliveryIndexes...)
+	return err
+}
+
+// The collection of the jobs adding tracks
+func (db *trackDB) jobCollection() string {
+	return db.TrackCollectionName + ".jobs"
+}
+
+// The collection of the deliveries to the webhooks
+func (db *webhookDB) deliveryCollection() string {
+	return db.WebhookCollectionName + ".deliveries"
+}
+
+func (db *trackDB) Add(s Track) error {
+	session, err := db.copy()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	err = session.DB(db.DatabaseName).C(db.TrackCollectionName).Insert(s)
+	return db.wrap(err)
+}
+
+func (db *webhookDB) Add(s Webhook) error {
+	session, err := db.copy()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	err = session.DB(db.DatabaseName).C(db.WebhookCollectionName).Insert(s)
+	return db.wrap(err)
+}
+
+func (db *trackDB) Count() (int, error) {
+	session, err := db.copy()
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+
+	count, err := session.DB(db.DatabaseName).C(db.TrackCollectionName).Count()
+	return count, db.wrap(err)
+}
+
+func (db *webhookDB) Count() (int, error) {
+	session, err := db.copy()
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+
+	count, err := session.DB(db.DatabaseName).C(db.WebhookCollectionName).Count()
+	return count, db.wrap(err)
+}
+
+func (db *trackDB) Get(keyID string) (Track, error) {
+	track := Track{}
+	session, err := db.copy()
+	if err != nil {
+		return track, err
+	}
+	defer session.Close()
+
+	err = session.DB(db.DatabaseName).C(db.TrackCollectionName).Find(bson.M{"id": keyID}).One(&track)
+	return track, db.wrap(err)
+}
+
+func (db *trackDB) FindByHash(hash string) (Track, error) {
+	track := Track{}
+	session, err := db.copy()
+	if err != nil {
+		return track, err
+	}
+	defer session.Close()
+
+	err = session.DB(db.DatabaseName).C(db.TrackCollectionName).Find(bson.M{"contenthash": hash}).One(&track)
+	return track, db.wrap(err)
+}
+
+func (db *trackDB) NextSequence() (int, error) {
+	return db.nextSequence(db.DatabaseName, db.TrackCollectionName)
+}
+
+func (db *webhookDB) NextSequence() (int, error) {
+	return db.nextSequence(db.DatabaseName, db.WebhookCollectionName)
+}
+
+func (db *trackDB) List(after bson.ObjectId, limit int) ([]Track, error) {
+	tracks := []Track{}
+	session, err := db.copy()
+	if err != nil {
+		return tracks, err
+	}
+	defer session.Close()
+
+	query := bson.M{}
+	if after != "" {
+		query["timestamp"] = bson.M{"$gt": after}
+	}
+	err = session.DB(db.DatabaseName).C(db.TrackCollectionName).Find(query).Sort("timestamp").Limit(limit).All(&tracks)
+	return tracks, db.wrap(err)
+}
+
+func (db *trackDB) Latest() (Track, error) {
+	track := Track{}
+	session, err := db.copy()
+	if err != nil {
+		return track, err
+	}
+	defer session.Close()
+
+	err = session.DB(db.DatabaseName).C(db.TrackCollectionName).Find(nil).Sort("-timestamp").One(&track)
+	return track, db.wrap(err)
+}
+
+// Translates a TrackQuery into a mongo query and sort order
+func mongoTrackQuery(q TrackQuery) (bson.M, []string) {
+	filters := []bson.M{}
+	if q.Pilot != "" {
+		filters = append(filters, bson.M{"pilot": q.Pilot})
+	}
+	if q.Glider != "" {
+		filters = append(filters, bson.M{"glider": q.Glider})
+	}
+	if q.GliderID != "" {
+		filters = append(filters, bson.M{"gliderid": q.GliderID})
+	}
+	if q.Validation != "" {
+		filters = append(filters, bson.M{"validation": q.Validation})
+	}
+	if !q.From.IsZero() {
+		filters = append(filters, bson.M{"hdate": bson.M{"$gte": q.From}})
+	}
+	if !q.To.IsZero() {
+		filters = append(filters, bson.M{"hdate": bson.M{"$lte": q.To}})
+	}
+	if q.MinLength > 0 {
+		filters = append(filters, bson.M{"tracklength": bson.M{"$gte": q.MinLength}})
+	}
+
+	field := q.SortBy
+	if field == "" {
+		field = sortTimeStamp
+	}
+	next, prefix := "$gt", ""
+	if q.Desc {
+		next, prefix = "$lt", "-"
+	}
+
+	if q.After != nil {
+		switch field {
+		case sortHDate:
+			filters = append(filters, bson.M{"$or": []bson.M{
+				{"hdate": bson.M{next: q.After.HDate}},
+				{"hdate": q.After.HDate, "timestamp": bson.M{next: q.After.TimeStamp}},
+			}})
+		case sortTrackLength:
+			filters = append(filters, bson.M{"$or": []bson.M{
+				{"tracklength": bson.M{next: q.After.TrackLength}},
+				{"tracklength": q.After.TrackLength, "timestamp": bson.M{next: q.After.TimeStamp}},
+			}})
+		default:
+			filters = append(filters, bson.M{"timestamp": bson.M{next: q.After.TimeStamp}})
+		}
+	}
+
+	query := bson.M{}
+	if len(filters) > 0 {
+		query["$and"] = filters
+	}
+	order := []string{prefix + field}
+	if field != sortTimeStamp {
+		order = append(order, prefix+sortTimeStamp)
+	}
+	return query, order
+}
+
+func (db *trackDB) Find(q TrackQuery) ([]Track, error) {
+	tracks := []Track{}
+	session, err := db.copy()
+	if err != nil {
+		return tracks, err
+	}
+	defer session.Close()
+
+	query, order := mongoTrackQuery(q)
+	err = session.DB(db.DatabaseName).C(db.TrackCollectionName).Find(query).Sort(order...).Limit(q.Limit).All(&tracks)
+	return tracks, db.wrap(err)
+}
+
+func (db *webhookDB) List() ([]Webhook, error) {
+	hooks := []Webhook{}
+	session, err := db.copy()
+	if err != nil {
+		return hooks, err
+	}
+	defer session.Close()
+
+	err = session.DB(db.DatabaseName).C(db.WebhookCollectionName).Find(nil).All(&hooks)
+	sort.Slice(hooks, func(i, j int) bool {
+		return idNumber(hooks[i].ID) < idNumber(hooks[j].ID)
+	})
+	return hooks, db.wrap(err)
+}
+
+func (db *webhookDB) Get(keyID string) (Webhook, error) {
+	Hook := Webhook{}
+	session, err := db.copy()
+	if err != nil {
+		return Hook, err
+	}
+	defer session.Close()
+
+	err = session.DB(db.DatabaseName).C(db.WebhookCollectionName).Find(bson.M{"id": keyID}).One(&Hook)
+	return Hook, db.wrap(err)
+}
+
+func (db *trackDB) Delete() (int, error) {
+	session, err := db.copy()
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+
+	info, err := session.DB(db.DatabaseName).C(db.TrackCollectionName).RemoveAll(nil)
+	if err != nil {
+		return 0, db.wrap(err)
+	}
+
+	files := db.gridFS(session)
+	if _, err := files.Files.RemoveAll(nil); err != nil {
+		return 0, db.wrap(err)
+	}
+	if _, err := files.Chunks.RemoveAll(nil); err != nil {
+		return 0, db.wrap(err)
+	}
+	return info.Removed, nil
+}
+
+// The GridFS holding the original IGC files, named after the track id
+func (db *trackDB) gridFS(session *mgo.Session) *mgo.GridFS {
+	return session.DB(db.DatabaseName).GridFS(db.TrackCollectionName + ".igc")
+}
+
+func (db *trackDB) AddIGC(keyID string, content []byte) error {
+	session, err := db.copy()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	file, err := db.gridFS(session).Create(keyID)
+	if err != nil {
+		return db.wrap(err)
+	}
+	file.SetContentType(sourceMediaTypes[sourceFormat(content)])
+	if _, err := file.Write(content); err != nil {
+		file.Abort()
+		file.Close()
+		return db.wrap(err)
+	}
+	return db.wrap(file.Close())
+}
+
+func (db *trackDB) GetIGC(keyID string) ([]byte, error) {
+	session, err := db.copy()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	file, err := db.gridFS(session).Open(keyID)
+	if err != nil {
+		return nil, db.wrap(err)
+	}
+	defer file.Close()
+
+	content, err := ioutil.ReadAll(file)
+	return content, db.wrap(err)
+}
+
+func (db *trackDB) DeleteIGC(keyID string) error {
+	session, err := db.copy()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	gridFS := db.gridFS(session)
+	count, err := gridFS.Find(bson.M{"filename": keyID}).Count()
+	if err != nil {
+		return db.wrap(err)
+	}
+	if count == 0 {
+		return ErrNotFound
+	}
+	return db.wrap(gridFS.Remove(keyID))
+}
+
+func (db *webhookDB) Delete(keyID string) error {
+	session, err := db.copy()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	err = session.DB(db.DatabaseName).C(db.WebhookCollectionName).Remove(bson.M{"id": keyID})
+	return db.wrap(err)
+}
+
+func (db *webhookDB) Update(s Webhook) error {
+	session, err := db.copy()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	err = session.DB(db.DatabaseName).C(db.WebhookCollectionName).Update(bson.M{"id": s.ID}, s)
+	return db.wrap(err)
+}
+
+func (db *trackDB) AddJob(j Job) error {
+	session, err := db.copy()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	err = session.DB(db.DatabaseName).C(db.jobCollection()).Insert(j)
+	return db.wrap(err)
+}
+
+func (db *trackDB) UpdateJob(j Job) error {
+	session, err := db.copy()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	err = session.DB(db.DatabaseName).C(db.jobCollection()).Update(bson.M{"id": j.ID}, j)
+	return db.wrap(err)
+}
+
+func (db *trackDB) GetJob(keyID string) (Job, error) {
+	job := Job{}
+	session, err := db.copy()
+	if err != nil {
+		return job, err
+	}
+	defer session.Close()
+
+	err = session.DB(db.DatabaseName).C(db.jobCollection()).Find(bson.M{"id": keyID}).One(&job)
+	return job, db.wrap(err)
+}
+
+func (db *trackDB) FindJobs(instance string, status string) ([]Job, error) {
+	jobs := []Job{}
+	session, err := db.copy()
+	if err != nil {
+		return jobs, err
+	}
+	defer session.Close()
+
+	query := bson.M{}
+	if instance != "" {
+		query["instance"] = instance
+	}
+	if status != "" {
+		query["status"] = status
+	}
+	err = session.DB(db.DatabaseName).C(db.jobCollection()).Find(query).Sort("id").All(&jobs)
+	return jobs, db.wrap(err)
+}
+
+func (db *trackDB) DeleteJobs(before time.Time) (int, error) {
+	session, err := db.copy()
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+
+	info, err := session.DB(db.DatabaseName).C(db.jobCollection()).RemoveAll(bson.M{"updated": bson.M{"$lt": before}})
+	if err != nil {
+		return 0, db.wrap(err)
+	}
+	return info.Removed, nil
+}
+
+func (db *webhookDB) AddDelivery(d Delivery) error {
+	session, err := db.copy()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	err = session.DB(db.DatabaseName).C(db.deliveryCollection()).Insert(d)
+	return db.wrap(err)
+}
+
+func (db *webhookDB) UpdateDelivery(d Delivery) error {
+	session, err := db.copy()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	err = session.DB(db.DatabaseName).C(db.deliveryCollection()).Update(bson.M{"id": d.ID}, d)
+	return db.wrap(err)
+}
+
+func (db *webhookDB) FindDeliveries(webhookID string, status string) ([]Delivery, error) {
+	deliveries := []Delivery{}
+	session, err := db.copy()
+	if err != nil {
+		return deliveries, err
+	}
+	defer session.Close()
+
+	query := bson.M{}
+	if webhookID != "" {
+		query["webhookid"] = webhookID
+	}
+	if status != "" {
+		query["status"] = status
+	}
+	err = session.DB(db.DatabaseName).C(db.deliveryCollection()).Find(query).Sort("id").All(&deliveries)
+	return deliveries, db.wrap(err)
+}
+
+func (db *taskDB) Init() error {
+	_, err := db.init(db.DatabaseName, db.TaskCollectionName)
+	return err
+}
+
+func (db *taskDB) Add(s Task) error {
+	session, err := db.copy()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	err = session.DB(db.DatabaseName).C(db.TaskCollectionName).Insert(s)
+	return db.wrap(err)
+}
+
+func (db *taskDB) Count() (int, error) {
+	session, err := db.copy()
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+
+	count, err := session.DB(db.DatabaseName).C(db.TaskCollectionName).Count()
+	return count, db.wrap(err)
+}
+
+func (db *taskDB) Get(keyID string) (Task, error) {
+	task := Task{}
+	session, err := db.copy()
+	if err != nil {
+		return task, err
+	}
+	defer session.Close()
+
+	err = session.DB(db.DatabaseName).C(db.TaskCollectionName).Find(bson.M{"id": keyID}).One(&task)
+	return task, db.wrap(err)
+}
+
+// $addToSet leaves the task alone when the track is already there, which
+// shows in the task as it was before
+func (db *taskDB) AddTrack(taskID string, trackID string) (Task, error) {
+	task := Task{}
+	session, err := db.copy()
+	if err != nil {
+		return task, err
+	}
+	defer session.Close()
+
+	change := mgo.Change{Update: bson.M{"$addToSet": bson.M{"tracks": trackID}}}
+	_, err = session.DB(db.DatabaseName).C(db.TaskCollectionName).Find(bson.M{"id": taskID}).Apply(change, &task)
+	if err != nil {
+		return task, db.wrap(err)
+	}
+	for _, submitted := range task.Tracks {
+		if submitted == trackID {
+			return task, ErrDuplicate
+		}
+	}
+	task.Tracks = append(task.Tracks, trackID)
+	return task, nil
+}
+
+func (db *taskDB) NextSequence() (int, error) {
+	return db.nextSequence(db.DatabaseName, db.TaskCollectionName)
+}
+
+func (db *taskDB) List() ([]Task, error) {
+	tasks := []Task{}
+	session, err := db.copy()
+	if err != nil {
+		return tasks, err
+	}
+	defer session.Close()
+
+	err = session.DB(db.DatabaseName).C(db.TaskCollectionName).Find(nil).All(&tasks)
+	sort.Slice(tasks, func(i, j int) bool {
+		return idNumber(tasks[i].ID) < idNumber(tasks[j].ID)
+	})
+	return tasks, db.wrap(err)
+}
+
+func (db *taskDB) Delete(keyID string) error {
+	session, err := db.copy()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	err = session.DB(db.DatabaseName).C(db.TaskCollectionName).Remove(bson.M{"id": keyID})
+	return db.wrap(err)
+}
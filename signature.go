@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers of every delivery to a webhook with a secret. The signature is
+// "sha256=" and the hex HMAC-SHA256 of the timestamp, a dot and the body,
+// keyed with the secret. Right after a rotation there is a second one, made
+// with the old secret, separated by a comma.
+const (
+	signatureHeader = "X-Paragliding-Signature"
+	timestampHeader = "X-Paragliding-Timestamp" // Unix seconds
+)
+
+// Header of the answer to newWebhook holding the secret
+const secretHeader = "X-Paragliding-Secret"
+
+// Shortest secret a webhook may bring along
+const minSecretLength = 16
+
+// How long the old secret keeps signing deliveries after a rotation, unless
+// the rotation asks for another overlap
+var secretOverlap = getEnvDuration("WEBHOOK_SECRET_OVERLAP", 24*time.Hour)
+
+// A random secret, 32 bytes in hex
+func newSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// Checks a secret given by the client
+func checkSecret(secret string) error {
+	if len(secret) < minSecretLength {
+		return fmt.Errorf("secret must have at least %d characters", minSecretLength)
+	}
+	return nil
+}
+
+func signPayload(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Adds the signature headers to a delivery of payload at the given time.
+// Webhooks registered before deliveries were signed have no secret until
+// it is rotated, and get no signature.
+func signDelivery(r *http.Request, hook Webhook, at time.Time, payload []byte) {
+	if hook.Secret == "" {
+		return
+	}
+	timestamp := at.Unix()
+	signatures := []string{signPayload(hook.Secret, timestamp, payload)}
+	if hook.OldSecret != "" && at.Before(hook.OldSecretUntil) {
+		signatures = append(signatures, signPayload(hook.OldSecret, timestamp, payload))
+	}
+	r.Header.Set(timestampHeader, strconv.FormatInt(timestamp, 10))
+	r.Header.Set(signatureHeader, strings.Join(signatures, ","))
+}
+
+// The webhook without its secrets, for the answers of manageWebhook
+func publicWebhook(hook Webhook) Webhook {
+	hook.Secret, hook.OldSecret = "", ""
+	return hook
+}
+
+// SecretRotation is the body of POST .../secret. Secret is generated if
+// empty, Overlap is a duration such as "1h".
+type SecretRotation struct {
+	CurrentSecret string `json:"current_secret"`
+	Secret        string `json:"secret"`
+	Overlap       string `json:"overlap"`
+}
+
+// POST /paragliding/api/webhook/new_track/{id}/secret gives the webhook a
+// new secret, given in the body or generated, and answers with it. The
+// current secret must be given. The old secret keeps signing deliveries
+// alongside the new one for the overlap, so the receiver can switch over
+// without missing any.
+func secretHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	rotateWebhookSecret(w, r, parts[len(parts)-2], false)
+}
+
+// POST /UnexpectedURL/admin/api/webhook_secret/{id} is secretHandler without
+// the current secret. Webhooks registered before deliveries were signed get
+// their first secret here, since their ids are easily guessed.
+func adminSecretHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	rotateWebhookSecret(w, r, parts[len(parts)-1], true)
+}
+
+func rotateWebhookSecret(w http.ResponseWriter, r *http.Request, id string, admin bool) {
+	if r.Method != "POST" {
+		error400(w)
+		return
+	}
+	var rotation SecretRotation
+	if err := json.NewDecoder(r.Body).Decode(&rotation); err != nil {
+		error400(w)
+		return
+	}
+	overlap := secretOverlap
+	if rotation.Overlap != "" {
+		var err error
+		if overlap, err = time.ParseDuration(rotation.Overlap); err != nil || overlap < 0 {
+			http.Error(w, "overlap must be a duration such as 24h", http.StatusBadRequest)
+			return
+		}
+	}
+	if rotation.Secret == "" {
+		var err error
+		if rotation.Secret, err = newSecret(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else if err := checkSecret(rotation.Secret); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// sendWebhook must not write back a webhook read before the rotation
+	webhookMutex.Lock()
+	defer webhookMutex.Unlock()
+
+	hook, err := webhookDataBase.Get(id)
+	if err != nil {
+		errorStore(w, err)
+		return
+	}
+	if !admin && hook.Secret == "" {
+		http.Error(w, "the webhook has no secret yet, ask the admin for one", http.StatusForbidden)
+		return
+	}
+	if !admin && !hmac.Equal([]byte(rotation.CurrentSecret), []byte(hook.Secret)) {
+		http.Error(w, "current_secret does not match", http.StatusForbidden)
+		return
+	}
+
+	hook.OldSecret, hook.OldSecretUntil = "", time.Time{}
+	if hook.Secret != "" && overlap > 0 {
+		hook.OldSecret, hook.OldSecretUntil = hook.Secret, time.Now().UTC().Add(overlap)
+	}
+	hook.Secret = rotation.Secret
+	if err := webhookDataBase.Update(hook); err != nil {
+		errorStore(w, err)
+		return
+	}
+	answer := map[string]interface{}{"secret": hook.Secret}
+	if hook.OldSecret != "" {
+		answer["old_secret_until"] = hook.OldSecretUntil
+	}
+	writeJSON(w, answer)
+}
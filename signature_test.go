@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Receiver checking signatures the way a client of the webhooks would
+type signedReceiver struct {
+	mutex   sync.Mutex
+	headers []http.Header
+	bodies  [][]byte
+}
+
+func (h *signedReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	h.headers = append(h.headers, r.Header.Clone())
+	h.bodies = append(h.bodies, body)
+}
+
+// Reports whether the last delivery carries a valid signature made with
+// the secret
+func (h *signedReceiver) signedWith(t *testing.T, secret string) bool {
+	t.Helper()
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	header, body := h.headers[len(h.headers)-1], h.bodies[len(h.bodies)-1]
+	timestamp, err := strconv.ParseInt(header.Get(timestampHeader), 10, 64)
+	if err != nil || time.Since(time.Unix(timestamp, 0)) > time.Minute {
+		t.Errorf("bad timestamp %q", header.Get(timestampHeader))
+		return false
+	}
+	for _, signature := range strings.Split(header.Get(signatureHeader), ",") {
+		if signature == signPayload(secret, timestamp, body) {
+			return true
+		}
+	}
+	return false
+}
+
+func postWebhook(t *testing.T, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	newWebhook(w, httptest.NewRequest("POST", "/paragliding/api/webhook/new_track/", strings.NewReader(body)))
+	return w
+}
+
+func rotateSecret(t *testing.T, id string, rotation SecretRotation) *httptest.ResponseRecorder {
+	t.Helper()
+	body, _ := json.Marshal(rotation)
+	w := httptest.NewRecorder()
+	secretHandler(w, httptest.NewRequest("POST", "/paragliding/api/webhook/new_track/"+id+"/secret", strings.NewReader(string(body))))
+	return w
+}
+
+func TestNewWebhook_Secret(t *testing.T) {
+	setupMemStores(t)
+	w := postWebhook(t, `{"webhookURL": "http://example.com/hook"}`)
+	secret := w.Header().Get(secretHeader)
+	if w.Code != http.StatusOK || len(secret) != 64 {
+		t.Fatalf("new webhook gave %d with secret %q", w.Code, secret)
+	}
+	if hook, _ := webhookDataBase.Get(w.Body.String()); hook.Secret != secret {
+		t.Errorf("stored secret %q, answered %q", hook.Secret, secret)
+	}
+
+	w = postWebhook(t, `{"webhookURL": "http://example.com/hook", "secret": "my own secret value"}`)
+	if w.Header().Get(secretHeader) != "my own secret value" {
+		t.Errorf("chosen secret was answered as %q", w.Header().Get(secretHeader))
+	}
+	if w = postWebhook(t, `{"webhookURL": "http://example.com/hook", "secret": "short"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("short secret gave %d, want 400", w.Code)
+	}
+
+	// The secret is not shown again
+	w = httptest.NewRecorder()
+	manageWebhook(w, httptest.NewRequest("GET", "/paragliding/api/webhook/new_track/1", nil))
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), secret) {
+		t.Errorf("GET webhook gave %d %v", w.Code, w.Body.String())
+	}
+}
+
+func TestSignedDelivery(t *testing.T) {
+	setupMemStores(t)
+	receiver := &signedReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	w := postWebhook(t, `{"webhookURL": "`+server.URL+`"}`)
+	id, secret := w.Body.String(), w.Header().Get(secretHeader)
+	d := testDispatcher()
+	deliver := func() {
+		t.Helper()
+		queued, err := queueDelivery(id, []byte(`{"text":"hello"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if delivery := dispatchUntilDone(t, d, queued.ID); delivery.Status != deliveryDelivered {
+			t.Fatalf("delivery ended as %+v", delivery)
+		}
+	}
+
+	deliver()
+	if !receiver.signedWith(t, secret) || receiver.signedWith(t, "some other secret") {
+		t.Errorf("delivery is not signed with the secret: %v", receiver.headers[0])
+	}
+
+	if w = rotateSecret(t, id, SecretRotation{CurrentSecret: "wrong"}); w.Code != http.StatusForbidden {
+		t.Errorf("rotation with the wrong secret gave %d, want 403", w.Code)
+	}
+	if w = rotateSecret(t, id, SecretRotation{CurrentSecret: secret, Overlap: "soon"}); w.Code != http.StatusBadRequest {
+		t.Errorf("rotation with a bad overlap gave %d, want 400", w.Code)
+	}
+	w = rotateSecret(t, id, SecretRotation{CurrentSecret: secret, Overlap: "1h"})
+	var rotated struct {
+		Secret         string    `json:"secret"`
+		OldSecretUntil time.Time `json:"old_secret_until"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &rotated); err != nil || w.Code != http.StatusOK || len(rotated.Secret) != 64 ||
+		time.Until(rotated.OldSecretUntil) < 59*time.Minute {
+		t.Fatalf("rotation gave %d %v", w.Code, w.Body.String())
+	}
+
+	// Both secrets sign during the overlap
+	deliver()
+	if !receiver.signedWith(t, rotated.Secret) || !receiver.signedWith(t, secret) {
+		t.Errorf("delivery during the overlap is signed %v", receiver.headers[1].Get(signatureHeader))
+	}
+
+	// A rotation without overlap retires the old secret right away
+	w = rotateSecret(t, id, SecretRotation{CurrentSecret: rotated.Secret, Secret: "the newest secret of all", Overlap: "0s"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("second rotation gave %d %v", w.Code, w.Body.String())
+	}
+	deliver()
+	if !receiver.signedWith(t, "the newest secret of all") || receiver.signedWith(t, rotated.Secret) {
+		t.Errorf("delivery after the overlap is signed %v", receiver.headers[2].Get(signatureHeader))
+	}
+
+	if w = rotateSecret(t, "99", SecretRotation{}); w.Code != http.StatusNotFound {
+		t.Errorf("rotating a missing webhook gave %d, want 404", w.Code)
+	}
+}
+
+func TestSecretRotation_Legacy(t *testing.T) {
+	setupMemStores(t)
+	webhookDataBase.Add(Webhook{ID: "1", URL: "http://example.com/hook", Value: 1})
+
+	// Only the admin gives a webhook without secret its first one
+	if w := rotateSecret(t, "1", SecretRotation{}); w.Code != http.StatusForbidden {
+		t.Errorf("first secret through the public URL gave %d, want 403", w.Code)
+	}
+	body, _ := json.Marshal(SecretRotation{Secret: "the first secret of all"})
+	w := httptest.NewRecorder()
+	adminSecretHandler(w, httptest.NewRequest("POST", "/UnexpectedURL/admin/api/webhook_secret/1", strings.NewReader(string(body))))
+	if hook, _ := webhookDataBase.Get("1"); w.Code != http.StatusOK || hook.Secret != "the first secret of all" || hook.OldSecret != "" || hook.Value != 1 {
+		t.Errorf("admin rotation gave %d %v, stored %+v", w.Code, w.Body.String(), hook)
+	}
+	if w := rotateSecret(t, "1", SecretRotation{CurrentSecret: "the first secret of all"}); w.Code != http.StatusOK {
+		t.Errorf("rotation after the first secret gave %d", w.Code)
+	}
+}
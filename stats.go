@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/marni/goigc"
+)
+
+// Ground speed above which the glider is taken to be flying, in m/s
+const flyingSpeed = 3.0
+
+// Windows over which climb, sink and ground speed are averaged, so that
+// single noisy fixes don't end up as the best climb of the day
+var (
+	varioWindow = getEnvDuration("STATS_VARIO_WINDOW", 10*time.Second)
+	speedWindow = getEnvDuration("STATS_SPEED_WINDOW", 30*time.Second)
+)
+
+// Fix is a position at a moment of the flight
+type Fix struct {
+	Time     time.Time `json:"time"`
+	Lat      float64   `json:"lat"`
+	Lon      float64   `json:"lon"`
+	Altitude int64     `json:"altitude"` // GNSS altitude in m
+}
+
+// FlightStats is computed from the B records when a track is added.
+// Altitudes are in m, rates in m/s, speeds in km/h and distances in km.
+type FlightStats struct {
+	Takeoff             Fix     `json:"takeoff"`
+	Landing             Fix     `json:"landing"`
+	Duration            float64 `json:"duration"` // takeoff to landing, in s
+	MaxAltitude         int64   `json:"max_altitude"`
+	MinAltitude         int64   `json:"min_altitude"`
+	MaxPressureAltitude int64   `json:"max_pressure_altitude"`
+	MinPressureAltitude int64   `json:"min_pressure_altitude"`
+	AltitudeGain        int64   `json:"altitude_gain"` // sum of all climbs
+	MaxClimb            float64 `json:"max_climb"`
+	MaxSink             float64 `json:"max_sink"` // negative, like a vario shows it
+	MaxSpeed            float64 `json:"max_speed"`
+	AvgSpeed            float64 `json:"avg_speed"`
+	StraightDistance    float64 `json:"straight_distance"` // takeoff to landing
+}
+
+// Fields of FlightStats served by fieldHandler
+var statsFields = []string{
+	"takeoff_time", "takeoff_position", "landing_time", "landing_position",
+	"duration", "max_altitude", "min_altitude", "max_pressure_altitude",
+	"min_pressure_altitude", "altitude_gain", "max_climb", "max_sink",
+	"max_speed", "avg_speed", "straight_distance",
+}
+
+// Returns one of statsFields as text, or "" if it isn't known
+func (s FlightStats) field(name string) string {
+	position := func(fix Fix) string {
+		if fix.Time.IsZero() {
+			return ""
+		}
+		return fmt.Sprintf("%.6f,%.6f", fix.Lat, fix.Lon)
+	}
+	timeOf := func(fix Fix) string {
+		if fix.Time.IsZero() {
+			return ""
+		}
+		return fix.Time.Format(time.RFC3339)
+	}
+
+	switch name {
+	case "takeoff_time":
+		return timeOf(s.Takeoff)
+	case "takeoff_position":
+		return position(s.Takeoff)
+	case "landing_time":
+		return timeOf(s.Landing)
+	case "landing_position":
+		return position(s.Landing)
+	case "duration":
+		return fmt.Sprint(s.Duration)
+	case "max_altitude":
+		return fmt.Sprint(s.MaxAltitude)
+	case "min_altitude":
+		return fmt.Sprint(s.MinAltitude)
+	case "max_pressure_altitude":
+		return fmt.Sprint(s.MaxPressureAltitude)
+	case "min_pressure_altitude":
+		return fmt.Sprint(s.MinPressureAltitude)
+	case "altitude_gain":
+		return fmt.Sprint(s.AltitudeGain)
+	case "max_climb":
+		return fmt.Sprint(s.MaxClimb)
+	case "max_sink":
+		return fmt.Sprint(s.MaxSink)
+	case "max_speed":
+		return fmt.Sprint(s.MaxSpeed)
+	case "avg_speed":
+		return fmt.Sprint(s.AvgSpeed)
+	case "straight_distance":
+		return fmt.Sprint(s.StraightDistance)
+	}
+	return ""
+}
+
+// B records only carry the time of day, this puts them on the flight date
+// and moves fixes after midnight UTC to the next day
+func fixTimes(track igc.Track) []time.Time {
+	times := make([]time.Time, len(track.Points))
+	day := time.Date(track.Date.Year(), track.Date.Month(), track.Date.Day(), 0, 0, 0, 0, time.UTC)
+	for i, point := range track.Points {
+		clock := point.Time.Sub(point.Time.Truncate(24 * time.Hour))
+		times[i] = day.Add(clock)
+		if i > 0 && times[i].Before(times[i-1]) {
+			day = day.AddDate(0, 0, 1)
+			times[i] = day.Add(clock)
+		}
+	}
+	return times
+}
+
+// Cumulative distance along the track up to each point, in km
+func pathDistances(track igc.Track) []float64 {
+	distances := make([]float64, len(track.Points))
+	for i := 1; i < len(track.Points); i++ {
+		distances[i] = distances[i-1] + track.Points[i-1].Distance(track.Points[i])
+	}
+	return distances
+}
+
+// Index of the first fix at least window after fix i, or -1
+func windowEnd(times []time.Time, i int, window time.Duration) int {
+	for j := i + 1; j < len(times); j++ {
+		if times[j].Sub(times[i]) >= window {
+			return j
+		}
+	}
+	return -1
+}
+
+// Index of the last fix at least window before fix j, or -1
+func windowStart(times []time.Time, j int, window time.Duration) int {
+	for i := j - 1; i >= 0; i-- {
+		if times[j].Sub(times[i]) >= window {
+			return i
+		}
+	}
+	return -1
+}
+
+func fixOf(point igc.Point, at time.Time) Fix {
+	return Fix{
+		Time:     at,
+		Lat:      point.Lat.Degrees(),
+		Lon:      point.Lng.Degrees(),
+		Altitude: point.GNSSAltitude,
+	}
+}
+
+func computeStats(track igc.Track) FlightStats {
+	stats := FlightStats{}
+	points := track.Points
+	if len(points) == 0 {
+		return stats
+	}
+	times := fixTimes(track)
+	distances := pathDistances(track)
+
+	// Take off at the first fix the glider moves faster than flyingSpeed,
+	// both to the next fix and over the window that follows, and land at
+	// the last one where the same holds looking backwards
+	speed := func(i, j int) float64 {
+		return (distances[j] - distances[i]) * 1000 / times[j].Sub(times[i]).Seconds()
+	}
+	takeoff, landing := 0, len(points)-1
+	for i := 0; i+1 < len(points); i++ {
+		j := windowEnd(times, i, varioWindow)
+		if j >= 0 && speed(i, i+1) > flyingSpeed && speed(i, j) > flyingSpeed {
+			takeoff = i
+			break
+		}
+	}
+	for j := len(points) - 1; j > takeoff; j-- {
+		i := windowStart(times, j, varioWindow)
+		if i >= 0 && speed(j-1, j) > flyingSpeed && speed(i, j) > flyingSpeed {
+			landing = j
+			break
+		}
+	}
+
+	stats.Takeoff = fixOf(points[takeoff], times[takeoff])
+	stats.Landing = fixOf(points[landing], times[landing])
+	stats.Duration = times[landing].Sub(times[takeoff]).Seconds()
+	stats.StraightDistance = points[takeoff].Distance(points[landing])
+	if stats.Duration > 0 {
+		stats.AvgSpeed = (distances[landing] - distances[takeoff]) / stats.Duration * 3600
+	}
+
+	stats.MaxAltitude, stats.MinAltitude = points[0].GNSSAltitude, points[0].GNSSAltitude
+	stats.MaxPressureAltitude, stats.MinPressureAltitude = points[0].PressureAltitude, points[0].PressureAltitude
+	for i, point := range points {
+		if point.GNSSAltitude > stats.MaxAltitude {
+			stats.MaxAltitude = point.GNSSAltitude
+		}
+		if point.GNSSAltitude < stats.MinAltitude {
+			stats.MinAltitude = point.GNSSAltitude
+		}
+		if point.PressureAltitude > stats.MaxPressureAltitude {
+			stats.MaxPressureAltitude = point.PressureAltitude
+		}
+		if point.PressureAltitude < stats.MinPressureAltitude {
+			stats.MinPressureAltitude = point.PressureAltitude
+		}
+		if i > 0 && point.GNSSAltitude > points[i-1].GNSSAltitude {
+			stats.AltitudeGain += point.GNSSAltitude - points[i-1].GNSSAltitude
+		}
+	}
+
+	for i := range points {
+		if j := windowEnd(times, i, varioWindow); j >= 0 {
+			rate := float64(points[j].GNSSAltitude-points[i].GNSSAltitude) / times[j].Sub(times[i]).Seconds()
+			if rate > stats.MaxClimb {
+				stats.MaxClimb = rate
+			}
+			if rate < stats.MaxSink {
+				stats.MaxSink = rate
+			}
+		}
+		if j := windowEnd(times, i, speedWindow); j >= 0 {
+			if kmh := speed(i, j) * 3.6; kmh > stats.MaxSpeed {
+				stats.MaxSpeed = kmh
+			}
+		}
+	}
+	return stats
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/marni/goigc"
+)
+
+func TestComputeStats(t *testing.T) {
+	track, err := igc.Parse(string(readTestData(t, "sample.igc")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := computeStats(track)
+
+	day := time.Date(2018, 9, 2, 11, 0, 0, 0, time.UTC)
+	if !stats.Takeoff.Time.Equal(day.Add(8*time.Second)) || !stats.Landing.Time.Equal(day.Add(7*time.Minute+28*time.Second)) {
+		t.Errorf("flight from %v to %v", stats.Takeoff.Time, stats.Landing.Time)
+	}
+	if stats.Duration != 440 {
+		t.Errorf("duration %v, want 440", stats.Duration)
+	}
+	if stats.MaxAltitude != 620 || stats.MinAltitude != 260 || stats.MaxPressureAltitude != 608 || stats.MinPressureAltitude != 248 {
+		t.Errorf("altitudes %+v", stats)
+	}
+	if stats.AltitudeGain != 240 {
+		t.Errorf("altitude gain %v, want 240", stats.AltitudeGain)
+	}
+	// 2 m/s in the thermals, 1.2 m/s sink on glide
+	if math.Abs(stats.MaxClimb-2) > 0.01 || math.Abs(stats.MaxSink+1.2) > 0.01 {
+		t.Errorf("climb %v, sink %v", stats.MaxClimb, stats.MaxSink)
+	}
+	if stats.MaxSpeed < 45 || stats.MaxSpeed > 60 || stats.AvgSpeed < 35 || stats.AvgSpeed > stats.MaxSpeed {
+		t.Errorf("max speed %v, average %v", stats.MaxSpeed, stats.AvgSpeed)
+	}
+	if stats.StraightDistance < 3 || stats.StraightDistance > 3.2 {
+		t.Errorf("straight distance %v", stats.StraightDistance)
+	}
+}
+
+func TestFixTimes_Midnight(t *testing.T) {
+	track := igc.NewTrack()
+	track.Date = time.Date(2018, 9, 2, 0, 0, 0, 0, time.UTC)
+	for _, clock := range []string{"235958", "000000", "000002"} {
+		at, _ := time.Parse(igc.TimeFormat, clock)
+		point := igc.NewPoint()
+		point.Time = at
+		track.Points = append(track.Points, point)
+	}
+
+	times := fixTimes(track)
+	if !times[1].Equal(time.Date(2018, 9, 3, 0, 0, 0, 0, time.UTC)) || times[2].Sub(times[0]) != 4*time.Second {
+		t.Errorf("fix times across midnight %v", times)
+	}
+}
+
+func TestFieldHandler_Stats(t *testing.T) {
+	setupMemStores(t)
+	track, _ := igc.Parse(string(readTestData(t, "sample.igc")))
+	trackDataBase.Add(Track{ID: "igc1", Stats: computeStats(track)})
+	trackDataBase.Add(Track{ID: "igc2"})
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/paragliding/api/track/igc1/max_altitude", http.StatusOK, "620"},
+		{"/paragliding/api/track/igc1/takeoff_time", http.StatusOK, "2018-09-02T11:00:08Z"},
+		{"/paragliding/api/track/igc2/takeoff_time", http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		fieldHandler(w, httptest.NewRequest("GET", test.path, nil))
+		if w.Code != test.status || (test.body != "" && w.Body.String() != test.body) {
+			t.Errorf("GET %v gave %d %q", test.path, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Errors returned by the stores. Backend specific errors are wrapped in
+// ErrUnavailable when the database can't be reached, check with errors.Is
+var (
+	ErrNotFound    = errors.New("not found")
+	ErrDuplicate   = errors.New("already exists")
+	ErrUnavailable = errors.New("database unavailable")
+)
+
+// TrackStore is implemented by every backend that can hold tracks
+type TrackStore interface {
+	Init() error
+	Add(s Track) error
+	Count() (int, error)
+	Get(keyID string) (Track, error)
+	Delete() (int, error)
+
+	// Next number of the persistent sequence track ids are made from.
+	// Never repeats, not even after Delete()
+	NextSequence() (int, error)
+
+	// Tracks in the order they were added, starting after the track with
+	// the given TimeStamp (from the first if empty). limit 0 means no limit
+	List(after bson.ObjectId, limit int) ([]Track, error)
+
+	// The track added last
+	Latest() (Track, error)
+
+	// Tracks passing the filters of the query, in its order
+	Find(q TrackQuery) ([]Track, error)
+
+	// The track whose IGC file has the given canonical hash
+	FindByHash(hash string) (Track, error)
+
+	// The original IGC file of a track, stored as uploaded. The file is
+	// stored before its track, and deleted if the track can't be added.
+	AddIGC(keyID string, content []byte) error
+	GetIGC(keyID string) ([]byte, error)
+	DeleteIGC(keyID string) error
+
+	// The jobs adding tracks in the background, see Job, kept in the store
+	// so every replica can report them. UpdateJob replaces the stored job
+	// with the same id.
+	AddJob(j Job) error
+	UpdateJob(j Job) error
+	GetJob(keyID string) (Job, error)
+
+	// Jobs of the instance with the given status, oldest first. Empty
+	// arguments match any instance or status.
+	FindJobs(instance string, status string) ([]Job, error)
+
+	// Deletes the jobs last updated before the given time
+	DeleteJobs(before time.Time) (int, error)
+}
+
+// WebhookStore is implemented by every backend that can hold webhooks
+type WebhookStore interface {
+	Init() error
+	Add(s Webhook) error
+	Count() (int, error)
+	Get(keyID string) (Webhook, error)
+	Delete(keyID string) error
+
+	// Replaces the stored webhook with the same id, ErrNotFound if there
+	// is none
+	Update(s Webhook) error
+
+	// Like TrackStore.NextSequence, for webhook ids
+	NextSequence() (int, error)
+
+	// All webhooks, ordered by id
+	List() ([]Webhook, error)
+
+	// The notifications sent to the webhooks, see Delivery. Deliveries
+	// are not deleted with their webhook.
+	AddDelivery(d Delivery) error
+	UpdateDelivery(d Delivery) error
+
+	// Deliveries of the webhook with the given status, oldest first. Empty
+	// arguments match any webhook or status.
+	FindDeliveries(webhookID string, status string) ([]Delivery, error)
+}
+
+// TaskStore is implemented by every backend that can hold competition tasks
+type TaskStore interface {
+	Init() error
+	Add(s Task) error
+	Count() (int, error)
+	Get(keyID string) (Task, error)
+	Delete(keyID string) error
+
+	// Adds trackID to the tracks submitted for the task in one step, so
+	// concurrent submissions are all kept, and returns the updated task.
+	// ErrDuplicate if the track was already submitted.
+	AddTrack(taskID string, trackID string) (Task, error)
+
+	// Like TrackStore.NextSequence, for task ids
+	NextSequence() (int, error)
+
+	// All tasks, ordered by id
+	List() ([]Task, error)
+}
+
+// Number at the end of an id such as "igc12", 0 if there is none. Used to
+// seed the sequences from ids stored before there were any.
+func idNumber(id string) int {
+	i := len(id)
+	for i > 0 && id[i-1] >= '0' && id[i-1] <= '9' {
+		i--
+	}
+	n, _ := strconv.Atoi(id[i:])
+	return n
+}
+
+// The stores used by the handlers, set up in main() by openStores
+var trackDataBase TrackStore
+var webhookDataBase WebhookStore
+var taskDataBase TaskStore
+
+// Returns the value of the environment variable key, or def if it is not set
+func getEnv(key string, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
+
+// Like getEnv, for whole numbers
+func getEnvInt(key string, def int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		if os.Getenv(key) != "" {
+			log.Printf("ignoring %v: %v", key, err)
+		}
+		return def
+	}
+	return value
+}
+
+// Like getEnv, for durations such as "5s" or "250ms"
+func getEnvDuration(key string, def time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		if os.Getenv(key) != "" {
+			log.Printf("ignoring %v: %v", key, err)
+		}
+		return def
+	}
+	return value
+}
+
+// Like getEnv, for decimal numbers
+func getEnvFloat(key string, def float64) float64 {
+	value, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		if os.Getenv(key) != "" {
+			log.Printf("ignoring %v: %v", key, err)
+		}
+		return def
+	}
+	return value
+}
+
+// Reads the MongoDB connection settings from the environment
+func mongoConfigFromEnv() mongoConfig {
+	config := defaultMongoConfig
+	config.PoolLimit = getEnvInt("MONGODB_POOL_LIMIT", config.PoolLimit)
+	config.DialTimeout = getEnvDuration("MONGODB_DIAL_TIMEOUT", config.DialTimeout)
+	config.SocketTimeout = getEnvDuration("MONGODB_SOCKET_TIMEOUT", config.SocketTimeout)
+	config.DialRetries = getEnvInt("MONGODB_DIAL_RETRIES", config.DialRetries)
+	config.RetryDelay = getEnvDuration("MONGODB_RETRY_DELAY", config.RetryDelay)
+	return config
+}
+
+// Picks the storage backend from the DB_BACKEND environment variable.
+// "mongo" (default) uses MongoDB, "memory" keeps everything in-process and
+// "bolt" uses a single embedded database file at BOLT_PATH.
+func openStores(backend string) (TrackStore, WebhookStore, TaskStore, error) {
+	switch backend {
+	case "memory":
+		return newTrackMemDB(), newWebhookMemDB(), newTaskMemDB(), nil
+	case "bolt":
+		file := &boltFile{Path: getEnv("BOLT_PATH", "paragliding.db")}
+		return &trackBoltDB{file}, &webhookBoltDB{file}, &taskBoltDB{file}, nil
+	case "", "mongo":
+		// One session, and pool of connections, for all the stores
+		session := &mongoSession{HostURL: getEnv("MONGODB_URL", "mongodb://localhost"), Config: mongoConfigFromEnv()}
+		databaseName := getEnv("MONGODB_DATABASE", "paragliding")
+		return &trackDB{
+			mongoSession:        session,
+			DatabaseName:        databaseName,
+			TrackCollectionName: "tracks",
+		}, &webhookDB{
+			mongoSession:          session,
+			DatabaseName:          databaseName,
+			WebhookCollectionName: "webhooks",
+		}, &taskDB{
+			mongoSession:       session,
+			DatabaseName:       databaseName,
+			TaskCollectionName: "tasks",
+		}, nil
+	default:
+		return nil, nil, nil, fmt.Errorf("unknown DB_BACKEND %q, use mongo, memory or bolt", backend)
+	}
+}
+
+// TrackQuery selects and orders tracks for TrackStore.Find
+type TrackQuery struct {
+	Pilot      string
+	Glider     string
+	GliderID   string
+	From       time.Time // H_date range, both ends inclusive, zero for open ends
+	To         time.Time
+	MinLength  float64
+	Validation string // one of the validation* statuses, any if empty
+
+	SortBy string // one of the sort* constants, sortTimeStamp if empty
+	Desc   bool
+
+	After *TrackCursor // position to continue after, nil for the first page
+	Limit int          // 0 means no limit
+}
+
+// Fields tracks can be sorted by. Ties are broken by TimeStamp.
+const (
+	sortTimeStamp   = "timestamp"
+	sortHDate       = "hdate"
+	sortTrackLength = "tracklength"
+)
+
+// TrackCursor is the position of a track in a listing, made from the
+// fields the listing can be sorted by
+type TrackCursor struct {
+	TimeStamp   bson.ObjectId `json:"t"`
+	HDate       time.Time     `json:"d"`
+	TrackLength float64       `json:"l"`
+}
+
+// Cursor pointing at the track
+func cursorOf(track Track) *TrackCursor {
+	return &TrackCursor{track.TimeStamp, track.HDate, track.TrackLength}
+}
+
+// Reports whether the track passes the filters of the query
+func (q TrackQuery) match(track Track) bool {
+	return (q.Pilot == "" || track.Pilot == q.Pilot) &&
+		(q.Glider == "" || track.Glider == q.Glider) &&
+		(q.GliderID == "" || track.GliderID == q.GliderID) &&
+		(q.From.IsZero() || !track.HDate.Before(q.From)) &&
+		(q.To.IsZero() || !track.HDate.After(q.To)) &&
+		track.TrackLength >= q.MinLength &&
+		(q.Validation == "" || track.Validation == q.Validation)
+}
+
+// Negative when a comes before b in the order of the query, positive when
+// it comes after
+func (q TrackQuery) compare(a *TrackCursor, b *TrackCursor) int {
+	result := 0
+	switch q.SortBy {
+	case sortHDate:
+		if a.HDate.Before(b.HDate) {
+			result = -1
+		} else if a.HDate.After(b.HDate) {
+			result = 1
+		}
+	case sortTrackLength:
+		if a.TrackLength < b.TrackLength {
+			result = -1
+		} else if a.TrackLength > b.TrackLength {
+			result = 1
+		}
+	}
+	if result == 0 && a.TimeStamp != b.TimeStamp {
+		result = -1
+		if a.TimeStamp > b.TimeStamp {
+			result = 1
+		}
+	}
+	if q.Desc {
+		result = -result
+	}
+	return result
+}
+
+// Runs the query over tracks in memory, for the backends without a query
+// language of their own
+func (q TrackQuery) apply(tracks []Track) []Track {
+	result := []Track{}
+	for _, track := range tracks {
+		if q.match(track) && (q.After == nil || q.compare(cursorOf(track), q.After) > 0) {
+			result = append(result, track)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return q.compare(cursorOf(result[i]), cursorOf(result[j])) < 0
+	})
+	if q.Limit > 0 && len(result) > q.Limit {
+		result = result[:q.Limit]
+	}
+	return result
+}
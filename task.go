@@ -0,0 +1,463 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/marni/goigc"
+)
+
+// Kinds of task points
+const (
+	taskCylinder = "cylinder"
+	taskLine     = "line" // start and goal only
+)
+
+// Ways of taking the start
+const (
+	startExit  = "exit"
+	startEnter = "enter"
+)
+
+// Radius of the turnpoints of tasks declared in C records, in m
+const declaredRadius = 400
+
+// TaskPoint is a turnpoint of a task. A line is 2*Radius long, centred on
+// the point and square to the leg it closes or opens.
+type TaskPoint struct {
+	Name   string  `json:"name"`
+	Lat    float64 `json:"lat"`
+	Lon    float64 `json:"lon"`
+	Radius float64 `json:"radius"` // in m
+	Type   string  `json:"type"`   // taskCylinder (default) or taskLine
+}
+
+// Task is a competition task: start, turnpoints taken in order, an
+// optional end of speed section (ESS) and goal
+type Task struct {
+	ID             string      `json:"id"`
+	Name           string      `json:"name"`
+	Start          TaskPoint   `json:"start"`
+	StartDirection string      `json:"start_direction"` // startExit (default) or startEnter
+	Turnpoints     []TaskPoint `json:"turnpoints"`
+	ESS            *TaskPoint  `json:"ess,omitempty"` // goal if not set
+	Goal           TaskPoint   `json:"goal"`
+	StartOpen      time.Time   `json:"start_open"` // zero for no limit
+	StartClose     time.Time   `json:"start_close"`
+	Deadline       time.Time   `json:"deadline"`
+	Scoring        GAPParams   `json:"scoring"`
+	Tracks         []string    `json:"tracks"` // ids of the tracks submitted for the task
+}
+
+// TurnpointResult tells when a turnpoint was reached, if it was
+type TurnpointResult struct {
+	Name    string     `json:"name"`
+	Reached bool       `json:"reached"`
+	Time    *time.Time `json:"time,omitempty"`
+}
+
+// TaskResult is the outcome of verifying a track against a task
+type TaskResult struct {
+	TaskID           string            `json:"task"`
+	TrackID          string            `json:"track"`
+	Started          bool              `json:"started"`
+	StartTime        *time.Time        `json:"start_time,omitempty"`
+	Turnpoints       []TurnpointResult `json:"turnpoints"` // after the start, up to goal
+	ESS              bool              `json:"ess"`
+	ESSTime          *time.Time        `json:"ess_time,omitempty"`
+	Goal             bool              `json:"goal"`
+	GoalTime         *time.Time        `json:"goal_time,omitempty"`
+	SpeedSectionTime float64           `json:"speed_section_time,omitempty"` // start to ESS, in s
+	Distance         float64           `json:"distance"`                     // along the task, in km
+}
+
+// Checks a task sent by a client, filling in the defaults
+func (task *Task) validate() error {
+	if task.StartDirection == "" {
+		task.StartDirection = startExit
+	}
+	if task.StartDirection != startExit && task.StartDirection != startEnter {
+		return fmt.Errorf("unknown start direction %q", task.StartDirection)
+	}
+
+	points := []*TaskPoint{&task.Start, &task.Goal}
+	for i := range task.Turnpoints {
+		points = append(points, &task.Turnpoints[i])
+	}
+	if task.ESS != nil {
+		points = append(points, task.ESS)
+	}
+	for _, point := range points {
+		if point.Type == "" {
+			point.Type = taskCylinder
+		}
+		if point.Type != taskCylinder && point.Type != taskLine {
+			return fmt.Errorf("unknown turnpoint type %q", point.Type)
+		}
+		if point.Radius <= 0 {
+			return fmt.Errorf("turnpoint %q needs a radius", point.Name)
+		}
+		if math.Abs(point.Lat) > 90 || math.Abs(point.Lon) > 180 {
+			return fmt.Errorf("turnpoint %q is off the map", point.Name)
+		}
+	}
+	for _, point := range task.Turnpoints {
+		if point.Type == taskLine {
+			return errors.New("only start and goal can be lines")
+		}
+	}
+	if task.ESS != nil && task.ESS.Type == taskLine {
+		return errors.New("only start and goal can be lines")
+	}
+
+	if !task.StartOpen.IsZero() && !task.StartClose.IsZero() && task.StartClose.Before(task.StartOpen) {
+		return errors.New("start closes before it opens")
+	}
+	if !task.StartOpen.IsZero() && !task.Deadline.IsZero() && task.Deadline.Before(task.StartOpen) {
+		return errors.New("deadline is before the start opens")
+	}
+	return task.Scoring.validate()
+}
+
+// The points to take after the start, in order
+func (task Task) route() []TaskPoint {
+	route := append([]TaskPoint(nil), task.Turnpoints...)
+	if task.ESS != nil {
+		route = append(route, *task.ESS)
+	}
+	return append(route, task.Goal)
+}
+
+// Makes a task of the one declared in the C records of a track, with
+// cylinders of declaredRadius
+func declaredTask(declared igc.Task) (Task, bool) {
+	// Tracks without C records have a zero task
+	if len(declared.Turnpoints) == 0 && declared.Start.LatLng == declared.Finish.LatLng {
+		return Task{}, false
+	}
+	point := func(p igc.Point) TaskPoint {
+		return TaskPoint{
+			Name:   strings.TrimSpace(p.Description),
+			Lat:    p.Lat.Degrees(),
+			Lon:    p.Lng.Degrees(),
+			Radius: declaredRadius,
+			Type:   taskCylinder,
+		}
+	}
+	task := Task{
+		Name:           strings.TrimSpace(declared.Description),
+		Start:          point(declared.Start),
+		StartDirection: startExit,
+		Goal:           point(declared.Finish),
+	}
+	for _, turnpoint := range declared.Turnpoints {
+		task.Turnpoints = append(task.Turnpoints, point(turnpoint))
+	}
+	return task, true
+}
+
+// Metres east and north of origin, close enough for crossing lines
+func localXY(origin TaskPoint, lat, lon float64) (float64, float64) {
+	const earthRadius = 6371000.0
+	x := (lon - origin.Lon) * math.Pi / 180 * earthRadius * math.Cos(origin.Lat*math.Pi/180)
+	y := (lat - origin.Lat) * math.Pi / 180 * earthRadius
+	return x, y
+}
+
+// Distance from a fix to the centre of a task point, in m
+func distanceTo(point TaskPoint, fix igc.Point) float64 {
+	centre := igc.NewPointFromLatLng(point.Lat, point.Lon)
+	return centre.Distance(fix) * 1000
+}
+
+// Whether the move from a to b crosses the line of point, heading the way
+// of the leg from "from" to "to"
+func crossesLine(point, from, to TaskPoint, a, b igc.Point) bool {
+	dx, dy := localXY(from, to.Lat, to.Lon)
+	length := math.Hypot(dx, dy)
+	if length == 0 {
+		return false
+	}
+	dx, dy = dx/length, dy/length
+
+	ax, ay := localXY(point, a.Lat.Degrees(), a.Lng.Degrees())
+	bx, by := localXY(point, b.Lat.Degrees(), b.Lng.Degrees())
+	// Along the leg the line is at 0, across it from -Radius to Radius
+	alongA, alongB := ax*dx+ay*dy, bx*dx+by*dy
+	if alongA >= 0 || alongB < 0 {
+		return false
+	}
+	f := alongA / (alongA - alongB)
+	across := (ax+f*(bx-ax))*-dy + (ay+f*(by-ay))*dx
+	return math.Abs(across) <= point.Radius
+}
+
+// Distances along the task from the start, in km: the first is the start,
+// the others the points of route(), centre to centre
+func (task Task) distances() []float64 {
+	route := task.route()
+	distances := make([]float64, len(route)+1)
+	previous := igc.NewPointFromLatLng(task.Start.Lat, task.Start.Lon)
+	for i, point := range route {
+		centre := igc.NewPointFromLatLng(point.Lat, point.Lon)
+		distances[i+1] = distances[i] + previous.Distance(centre)
+		previous = centre
+	}
+	return distances
+}
+
+// Index of the end of speed section in route(), goal if there is no ESS
+func (task Task) essIndex() int {
+	return len(task.Turnpoints)
+}
+
+// taskFix is how far a pilot still had to go to ESS at a moment, in km
+type taskFix struct {
+	Time  time.Time
+	ToESS float64
+}
+
+// Follows the track through the task. The last start taken before the first
+// turnpoint counts, fixes after the deadline don't.
+func verifyTask(task Task, track igc.Track) TaskResult {
+	result, _ := followTask(task, track)
+	return result
+}
+
+// Like verifyTask, also giving the distance left to ESS at every fix from
+// the start until ESS was reached
+func followTask(task Task, track igc.Track) (TaskResult, []taskFix) {
+	route := task.route()
+	result := TaskResult{TaskID: task.ID, Turnpoints: make([]TurnpointResult, len(route))}
+	for i, point := range route {
+		result.Turnpoints[i].Name = point.Name
+	}
+	times := fixTimes(track)
+	points := track.Points
+	distances := task.distances()
+	goalIndex, essIndex := len(route)-1, task.essIndex()
+
+	// Distance left to route[to], with route[next] the next point to take
+	left := func(to, next int, fix igc.Point) float64 {
+		if next > to {
+			return 0
+		}
+		return distanceTo(route[next], fix)/1000 + distances[to+1] - distances[next+1]
+	}
+
+	// Where the first leg heads and where the last one comes from, for lines
+	startNext, goalPrevious := route[0], task.Start
+	if len(route) > 1 {
+		goalPrevious = route[len(route)-2]
+	}
+
+	next := 0
+	var start time.Time
+	bestLeft := distances[goalIndex+1]
+	trace := []taskFix{}
+	for i := 1; i < len(points) && next < len(route); i++ {
+		at := times[i]
+		if !task.Deadline.IsZero() && at.After(task.Deadline) {
+			break
+		}
+
+		if next == 0 {
+			started := false
+			if task.Start.Type == taskLine {
+				started = crossesLine(task.Start, task.Start, startNext, points[i-1], points[i])
+			} else {
+				wasIn := distanceTo(task.Start, points[i-1]) <= task.Start.Radius
+				isIn := distanceTo(task.Start, points[i]) <= task.Start.Radius
+				started = (task.StartDirection == startEnter && !wasIn && isIn) ||
+					(task.StartDirection != startEnter && wasIn && !isIn)
+			}
+			inWindow := (task.StartOpen.IsZero() || !at.Before(task.StartOpen)) &&
+				(task.StartClose.IsZero() || !at.After(task.StartClose))
+			if started && inWindow {
+				start = at
+				bestLeft, trace = distances[goalIndex+1], trace[:0]
+			}
+		}
+		if start.IsZero() {
+			continue
+		}
+
+		point := route[next]
+		reached := false
+		if point.Type == taskLine {
+			reached = crossesLine(point, goalPrevious, point, points[i-1], points[i])
+		} else {
+			reached = distanceTo(point, points[i]) <= point.Radius
+		}
+		if reached {
+			tagged := at
+			result.Turnpoints[next].Reached = true
+			result.Turnpoints[next].Time = &tagged
+			next++
+		}
+
+		if toGoal := left(goalIndex, next, points[i]); toGoal < bestLeft {
+			bestLeft = toGoal
+		}
+		if len(trace) == 0 || trace[len(trace)-1].ToESS > 0 {
+			trace = append(trace, taskFix{Time: at, ToESS: left(essIndex, next, points[i])})
+		}
+	}
+
+	if !start.IsZero() {
+		result.Started = true
+		result.StartTime = &start
+		result.Distance = math.Max(0, distances[goalIndex+1]-bestLeft)
+	}
+	goal := result.Turnpoints[goalIndex]
+	ess := result.Turnpoints[essIndex]
+	result.Goal, result.GoalTime = goal.Reached, goal.Time
+	result.ESS, result.ESSTime = ess.Reached, ess.Time
+	if result.ESS {
+		result.SpeedSectionTime = result.ESSTime.Sub(start).Seconds()
+	}
+	if result.Goal {
+		result.Distance = distances[goalIndex+1]
+	}
+	return result, trace
+}
+
+// Verifies a stored track against a task
+func verifyStoredTrack(task Task, trackID string) (TaskResult, error) {
+	content, err := trackDataBase.GetIGC(trackID)
+	if err != nil {
+		return TaskResult{}, err
+	}
+	track, err := parseTrack(content)
+	if err != nil {
+		return TaskResult{}, err
+	}
+	result := verifyTask(task, track)
+	result.TrackID = trackID
+	return result, nil
+}
+
+// Writes value as the JSON response
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		error400(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// POST /paragliding/api/task/ adds a task and answers with its id,
+// GET lists the ids of all tasks
+func taskHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		var task Task
+		if err := json.NewDecoder(r.Body).Decode(&task); err != nil {
+			error400(w)
+			return
+		}
+		if err := task.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		sequence, err := taskDataBase.NextSequence()
+		if err != nil {
+			errorStore(w, err)
+			return
+		}
+		task.ID = fmt.Sprintf("task%d", sequence)
+		task.Tracks = []string{}
+		if err := taskDataBase.Add(task); err != nil {
+			errorStore(w, err)
+			return
+		}
+		writeJSON(w, task.ID)
+	} else if r.Method == "GET" {
+		tasks, err := taskDataBase.List()
+		if err != nil {
+			errorStore(w, err)
+			return
+		}
+		ids := []string{}
+		for _, task := range tasks {
+			ids = append(ids, task.ID)
+		}
+		writeJSON(w, ids)
+	} else {
+		error400(w)
+	}
+}
+
+// GET or DELETE /paragliding/api/task/{id}
+func manageTask(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	id := parts[len(parts)-1]
+
+	task, err := taskDataBase.Get(id)
+	if err != nil {
+		errorStore(w, err)
+		return
+	}
+	if r.Method == "DELETE" {
+		if err := taskDataBase.Delete(id); err != nil {
+			errorStore(w, err)
+			return
+		}
+	} else if r.Method != "GET" {
+		error400(w)
+		return
+	}
+	writeJSON(w, task)
+}
+
+// GET /paragliding/api/task/{id}/verify/{track_id}
+func verifyHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	taskID, trackID := parts[len(parts)-3], parts[len(parts)-1]
+
+	task, err := taskDataBase.Get(taskID)
+	if err != nil {
+		errorStore(w, err)
+		return
+	}
+	result, err := verifyStoredTrack(task, trackID)
+	if err != nil {
+		errorStore(w, err)
+		return
+	}
+	writeJSON(w, result)
+}
+
+// GET /paragliding/api/track/{id}/task verifies a track against the task
+// declared in its own C records
+func declaredTaskHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	id := parts[len(parts)-2]
+
+	content, err := trackDataBase.GetIGC(id)
+	if err != nil {
+		errorStore(w, err)
+		return
+	}
+	track, err := parseTrack(content)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	task, ok := declaredTask(track.Task)
+	if !ok {
+		http.Error(w, "no task declared in the IGC file", http.StatusNotFound)
+		return
+	}
+	result := verifyTask(task, track)
+	result.TrackID = id
+	writeJSON(w, result)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Clock time of the track made by cornersTrack, on its date
+func cornersTime(clock string) time.Time {
+	at, _ := time.Parse("15:04:05", clock)
+	return time.Date(2018, 9, 2, at.Hour(), at.Minute(), at.Second(), 0, time.UTC)
+}
+
+func TestVerifyTask(t *testing.T) {
+	a, b := [2]float64{60, 10}, [2]float64{60, 10.2}
+	track := cornersTrack(a, b)
+	task := Task{
+		Start:      TaskPoint{Name: "Start", Lat: 60, Lon: 10, Radius: 1000},
+		Turnpoints: []TaskPoint{{Name: "TP1", Lat: 60, Lon: 10.1, Radius: 400}},
+		Goal:       TaskPoint{Name: "Goal", Lat: 60, Lon: 10.2, Radius: 500, Type: taskLine},
+	}
+	if err := task.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A fix every 10s and 223m, so the start is at the fifth
+	result := verifyTask(task, track)
+	if !result.Started || !result.StartTime.Equal(cornersTime("10:00:50")) {
+		t.Errorf("started %v at %v", result.Started, result.StartTime)
+	}
+	if !result.Turnpoints[0].Reached || !result.Goal || !result.ESS || !result.GoalTime.Equal(cornersTime("10:08:20")) {
+		t.Errorf("result %+v", result)
+	}
+	if result.SpeedSectionTime != 450 {
+		t.Errorf("speed section took %vs, want 450", result.SpeedSectionTime)
+	}
+
+	ess := TaskPoint{Name: "ESS", Lat: 60, Lon: 10.15, Radius: 400, Type: taskCylinder}
+	withESS := task
+	withESS.ESS = &ess
+	result = verifyTask(withESS, track)
+	if !result.ESS || !result.Goal || len(result.Turnpoints) != 3 || !result.ESSTime.Before(*result.GoalTime) {
+		t.Errorf("with ESS %+v", result)
+	}
+	if result.SpeedSectionTime != result.ESSTime.Sub(*result.StartTime).Seconds() {
+		t.Errorf("speed section ends at %v, not at ESS", result.SpeedSectionTime)
+	}
+
+	late := task
+	late.Deadline = cornersTime("10:05:00")
+	result = verifyTask(late, track)
+	if !result.Turnpoints[0].Reached || result.Goal || result.ESS || result.SpeedSectionTime != 0 {
+		t.Errorf("with deadline %+v", result)
+	}
+	// Half way at 10:04:10, a fix more by 10:05
+	full := task.distances()[2]
+	if result.Distance < full/2 || result.Distance > full*0.6 {
+		t.Errorf("flew %v of %v km by the deadline", result.Distance, full)
+	}
+
+	closed := task
+	closed.StartOpen = cornersTime("10:02:00")
+	if result = verifyTask(closed, track); result.Started || result.Turnpoints[0].Reached {
+		t.Errorf("start taken before it opened %+v", result)
+	}
+
+	// Out of the start, back in and out again: the second start counts
+	restart := cornersTrack(a, [2]float64{60, 10.05}, a, b)
+	task.Turnpoints[0].Lon = 10.15
+	result = verifyTask(task, restart)
+	if !result.Started || !result.StartTime.After(cornersTime("10:16:40")) || !result.Goal {
+		t.Errorf("restart %+v", result)
+	}
+}
+
+func TestTaskValidate(t *testing.T) {
+	start := TaskPoint{Name: "Start", Lat: 60, Lon: 10, Radius: 1000}
+	goal := TaskPoint{Name: "Goal", Lat: 60, Lon: 10.2, Radius: 500}
+	tests := []Task{
+		{Start: start, Goal: TaskPoint{Name: "Goal", Lat: 60, Lon: 10.2}},
+		{Start: start, Goal: goal, StartDirection: "sideways"},
+		{Start: start, Goal: goal, Turnpoints: []TaskPoint{{Name: "TP1", Lat: 60, Lon: 10.1, Radius: 400, Type: taskLine}}},
+		{Start: TaskPoint{Name: "Start", Lat: 95, Lon: 10, Radius: 1000}, Goal: goal},
+		{Start: start, Goal: goal, StartOpen: cornersTime("12:00:00"), StartClose: cornersTime("11:00:00")},
+	}
+	for _, task := range tests {
+		if err := task.validate(); err == nil {
+			t.Errorf("task %+v passed validation", task)
+		}
+	}
+}
+
+func TestTaskHandler(t *testing.T) {
+	setupMemStores(t)
+	trackID := postIGC(t, readTestData(t, "sample.igc"))
+
+	body := `{"name": "Gjøvik", "start": {"name": "Start", "lat": 60.795, "lon": 10.69, "radius": 400},
+		"turnpoints": [{"name": "TP1", "lat": 60.80443, "lon": 10.71265, "radius": 400}],
+		"goal": {"name": "Goal", "lat": 60.8139, "lon": 10.73198, "radius": 400}}`
+	w := httptest.NewRecorder()
+	taskHandler(w, httptest.NewRequest("POST", "/paragliding/api/task/", strings.NewReader(body)))
+	var taskID string
+	if err := json.Unmarshal(w.Body.Bytes(), &taskID); err != nil || taskID != "task1" {
+		t.Fatalf("POST task gave %d %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	manageTask(w, httptest.NewRequest("GET", "/paragliding/api/task/task1", nil))
+	var task Task
+	json.Unmarshal(w.Body.Bytes(), &task)
+	if w.Code != http.StatusOK || task.Name != "Gjøvik" || task.Start.Type != taskCylinder || task.StartDirection != startExit {
+		t.Errorf("GET task gave %d %+v", w.Code, task)
+	}
+
+	w = httptest.NewRecorder()
+	verifyHandler(w, httptest.NewRequest("GET", "/paragliding/api/task/task1/verify/"+trackID, nil))
+	var result TaskResult
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if w.Code != http.StatusOK || !result.Started || !result.Goal || result.TrackID != trackID {
+		t.Errorf("verify gave %d %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	verifyHandler(w, httptest.NewRequest("GET", "/paragliding/api/task/task1/verify/igc99", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("verify of a missing track gave %d, want 404", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	taskHandler(w, httptest.NewRequest("POST", "/paragliding/api/task/", strings.NewReader(`{"start": {}}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("POST of an invalid task gave %d, want 400", w.Code)
+	}
+}
+
+func TestDeclaredTaskHandler(t *testing.T) {
+	setupMemStores(t)
+	content := readTestData(t, "sample.igc")
+	declaration := "C020918120000020918000101Declared test\r\n" +
+		"C6047700N01041400ETakeoff\r\n" +
+		"C6047700N01041400EStart\r\n" +
+		"C6048266N01042759ETP1\r\n" +
+		"C6048832N01043919EGoal\r\n" +
+		"C6048832N01043919ELanding\r\n"
+	declared := bytes.Replace(content, []byte("B110000"), []byte(declaration+"B110000"), 1)
+
+	// C records are not part of the canonical hash, so another pilot
+	other := bytes.Replace(content, []byte("Gerd Gliding"), []byte("Someone Else"), 1)
+	plain := postIGC(t, other)
+	withTask := postIGC(t, declared)
+
+	w := httptest.NewRecorder()
+	declaredTaskHandler(w, httptest.NewRequest("GET", "/paragliding/api/track/"+withTask+"/task", nil))
+	var result TaskResult
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if w.Code != http.StatusOK || !result.Started || len(result.Turnpoints) != 2 || result.Turnpoints[0].Name != "TP1" || !result.Goal {
+		t.Errorf("declared task gave %d %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	declaredTaskHandler(w, httptest.NewRequest("GET", "/paragliding/api/track/"+plain+"/task", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("track without C records gave %d, want 404", w.Code)
+	}
+}
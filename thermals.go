@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/marni/goigc"
+)
+
+// Circling is a turn rate of at least thermalTurnRate degrees per second,
+// averaged over thermalWindow. Only circling that lasts thermalMinDuration
+// and gains height counts as a thermal.
+var (
+	thermalTurnRate    = getEnvFloat("THERMAL_TURN_RATE", 5)
+	thermalWindow      = getEnvDuration("THERMAL_WINDOW", 15*time.Second)
+	thermalMinDuration = getEnvDuration("THERMAL_MIN_DURATION", 20*time.Second)
+)
+
+// Thermal is a stretch of a flight spent circling in lift
+type Thermal struct {
+	Entry     time.Time `json:"entry"`
+	Exit      time.Time `json:"exit"`
+	Lat       float64   `json:"lat"` // centre of the circles
+	Lon       float64   `json:"lon"`
+	Base      int64     `json:"base"` // GNSS altitude in m
+	Top       int64     `json:"top"`
+	Climb     float64   `json:"climb"`     // average, in m/s
+	Direction string    `json:"direction"` // "left" or "right"
+}
+
+// Initial bearing from a to b, in degrees clockwise from north
+func bearing(a, b igc.Point) float64 {
+	lat1, lat2 := a.Lat.Radians(), b.Lat.Radians()
+	dLon := b.Lng.Radians() - a.Lng.Radians()
+	y := math.Sin(dLon) * math.Cos(lat2)
+	x := math.Cos(lat1)*math.Sin(lat2) - math.Sin(lat1)*math.Cos(lat2)*math.Cos(dLon)
+	return math.Atan2(y, x) * 180 / math.Pi
+}
+
+// Cumulative heading change up to each fix, in degrees, turning right
+// counted positive
+func cumulativeTurn(points []igc.Point) []float64 {
+	turns := make([]float64, len(points))
+	heading, known := 0.0, false
+	for i := 1; i < len(points); i++ {
+		turns[i] = turns[i-1]
+		if points[i-1].LatLng == points[i].LatLng {
+			continue
+		}
+		next := bearing(points[i-1], points[i])
+		if known {
+			turns[i] += math.Remainder(next-heading, 360)
+		}
+		heading, known = next, true
+	}
+	return turns
+}
+
+// Finds the thermals of a flight, in the order they were flown
+func detectThermals(track igc.Track) []Thermal {
+	points := track.Points
+	times := fixTimes(track)
+	turns := cumulativeTurn(points)
+	rate := func(i, j int) float64 {
+		return (turns[j] - turns[i]) / times[j].Sub(times[i]).Seconds()
+	}
+
+	// Mark the fixes of every window turning fast enough
+	circling := make([]bool, len(points))
+	for i := range points {
+		j := windowEnd(times, i, thermalWindow)
+		if j < 0 {
+			break
+		}
+		if math.Abs(rate(i, j)) >= thermalTurnRate {
+			for k := i; k <= j; k++ {
+				circling[k] = true
+			}
+		}
+	}
+
+	thermals := []Thermal{}
+	for start := 0; start < len(points); start++ {
+		if !circling[start] {
+			continue
+		}
+		end := start
+		for end+1 < len(points) && circling[end+1] {
+			end++
+		}
+		next := end + 1
+
+		// Windows reach a little into the straight flight around the
+		// circles, trim it off
+		for start < end && math.Abs(rate(start, start+1)) < thermalTurnRate {
+			start++
+		}
+		for end > start && math.Abs(rate(end-1, end)) < thermalTurnRate {
+			end--
+		}
+		if thermal, ok := thermalOf(points[start:end+1], times[start], times[end], turns[end]-turns[start]); ok {
+			thermals = append(thermals, thermal)
+		}
+		start = next
+	}
+	return thermals
+}
+
+// Sums up the circling between two fixes, if it is a thermal
+func thermalOf(points []igc.Point, entry, exit time.Time, turn float64) (Thermal, bool) {
+	duration := exit.Sub(entry)
+	if duration < thermalMinDuration {
+		return Thermal{}, false
+	}
+	climb := float64(points[len(points)-1].GNSSAltitude-points[0].GNSSAltitude) / duration.Seconds()
+	if climb <= 0 {
+		return Thermal{}, false
+	}
+
+	thermal := Thermal{
+		Entry:     entry,
+		Exit:      exit,
+		Base:      points[0].GNSSAltitude,
+		Top:       points[0].GNSSAltitude,
+		Climb:     climb,
+		Direction: "right",
+	}
+	if turn < 0 {
+		thermal.Direction = "left"
+	}
+	for _, point := range points {
+		thermal.Lat += point.Lat.Degrees() / float64(len(points))
+		thermal.Lon += point.Lng.Degrees() / float64(len(points))
+		if point.GNSSAltitude < thermal.Base {
+			thermal.Base = point.GNSSAltitude
+		}
+		if point.GNSSAltitude > thermal.Top {
+			thermal.Top = point.GNSSAltitude
+		}
+	}
+	return thermal, true
+}
+
+// Returns the thermals of a track, found in its stored IGC file
+func thermalsHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	id := parts[len(parts)-2]
+
+	content, err := trackDataBase.GetIGC(id)
+	if err != nil {
+		errorStore(w, err)
+		return
+	}
+	track, err := parseTrack(content)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	thermalsJSON, err := json.Marshal(detectThermals(track))
+	if err != nil {
+		error400(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(thermalsJSON)
+}
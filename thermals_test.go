@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/marni/goigc"
+)
+
+func TestDetectThermals(t *testing.T) {
+	track, err := igc.Parse(string(readTestData(t, "sample.igc")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The sample climbs in four left-hand circles from 11:00:28 to 11:02:28
+	thermals := detectThermals(track)
+	if len(thermals) != 1 {
+		t.Fatalf("found %d thermals, want 1: %+v", len(thermals), thermals)
+	}
+	thermal := thermals[0]
+	entry := time.Date(2018, 9, 2, 11, 0, 28, 0, time.UTC)
+	if math.Abs(thermal.Entry.Sub(entry).Seconds()) > 4 || math.Abs(thermal.Exit.Sub(entry.Add(2*time.Minute)).Seconds()) > 4 {
+		t.Errorf("thermal from %v to %v", thermal.Entry, thermal.Exit)
+	}
+	if thermal.Direction != "left" || math.Abs(thermal.Climb-2) > 0.1 || thermal.Top-thermal.Base < 230 {
+		t.Errorf("thermal %+v", thermal)
+	}
+	if math.Abs(thermal.Lat-60.7956) > 0.001 || math.Abs(thermal.Lon-10.6933) > 0.002 {
+		t.Errorf("thermal centred at %v,%v", thermal.Lat, thermal.Lon)
+	}
+}
+
+func TestThermalsHandler(t *testing.T) {
+	setupMemStores(t)
+	id := postIGC(t, readTestData(t, "sample.igc"))
+
+	w := httptest.NewRecorder()
+	thermalsHandler(w, httptest.NewRequest("GET", "/paragliding/api/track/"+id+"/thermals", nil))
+	var thermals []Thermal
+	if err := json.Unmarshal(w.Body.Bytes(), &thermals); err != nil || w.Code != http.StatusOK || len(thermals) != 1 {
+		t.Errorf("GET thermals gave %d %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	thermalsHandler(w, httptest.NewRequest("GET", "/paragliding/api/track/igc99/thermals", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("GET thermals of a missing track gave %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// Largest archive POST /paragliding/api/track/import accepts, in bytes.
+// Every file in it is limited to maxUploadSize.
+var maxImportSize = int64(getEnvInt("IMPORT_MAX_SIZE", 200<<20))
+
+// Outcome of importing one file of an archive
+const (
+	importAdded     = "added"
+	importDuplicate = "duplicate"
+	importFailed    = "error"
+)
+
+// ImportResult is the outcome for one file of an archive. Line is set for
+// IGC files that could not be parsed, when the line is known.
+type ImportResult struct {
+	File   string `json:"file"`
+	Status string `json:"status"`
+	ID     string `json:"id,omitempty"` // of the new or existing track
+	Error  string `json:"error,omitempty"`
+	Line   int    `json:"line,omitempty"`
+}
+
+// ImportReport is the outcome of an import job
+type ImportReport struct {
+	Added      int            `json:"added"`
+	Duplicates int            `json:"duplicates"`
+	Failed     int            `json:"failed"`
+	Files      []ImportResult `json:"files"`
+}
+
+// Reports whether a file of an archive is a track file worth importing,
+// leaving out folders and the metadata macOS and others put in archives
+func isTrackFile(name string) bool {
+	base := path.Base(name)
+	if strings.HasPrefix(base, ".") || strings.HasPrefix(name, "__MACOSX/") {
+		return false
+	}
+	switch strings.ToLower(path.Ext(base)) {
+	case ".igc", ".gpx", ".fit":
+		return true
+	}
+	return false
+}
+
+// Archive formats, told apart by how the file starts
+const (
+	archiveZip   = "zip"
+	archiveTarGz = "tar.gz"
+)
+
+// The format of the archive, empty if it is neither
+func archiveFormat(archive io.ReaderAt) string {
+	start := make([]byte, 4)
+	n, _ := archive.ReadAt(start, 0)
+	switch {
+	case bytes.HasPrefix(start[:n], []byte("PK\x03\x04")):
+		return archiveZip
+	case bytes.HasPrefix(start[:n], []byte("\x1f\x8b")):
+		return archiveTarGz
+	}
+	return ""
+}
+
+// Calls add for every track file of a ZIP or gzipped tar archive of the
+// given size, in the order they are stored
+func walkArchive(archive io.ReaderAt, size int64, add func(name string, file io.Reader)) error {
+	switch archiveFormat(archive) {
+	case archiveZip:
+		files, err := zip.NewReader(archive, size)
+		if err != nil {
+			return err
+		}
+		for _, file := range files.File {
+			if file.FileInfo().IsDir() || !isTrackFile(file.Name) {
+				continue
+			}
+			reader, err := file.Open()
+			if err != nil {
+				return err
+			}
+			add(file.Name, reader)
+			reader.Close()
+		}
+		return nil
+
+	case archiveTarGz:
+		unzipped, err := gzip.NewReader(io.NewSectionReader(archive, 0, size))
+		if err != nil {
+			return err
+		}
+		files := tar.NewReader(unzipped)
+		for {
+			header, err := files.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if header.Typeflag == tar.TypeReg && isTrackFile(header.Name) {
+				add(header.Name, files)
+			}
+		}
+	}
+	return errors.New("not a ZIP or tar.gz archive")
+}
+
+// Adds one file of an archive the way trackHandler adds an upload
+func importFile(name string, file io.Reader) ImportResult {
+	result := ImportResult{File: name, Status: importFailed}
+	content, err := ioutil.ReadAll(io.LimitReader(file, maxUploadSize+1))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if int64(len(content)) > maxUploadSize {
+		result.Error = "file is larger than the upload limit"
+		return result
+	}
+
+	track, err := parseTrack(content)
+	if err != nil {
+		result.Error = err.Error()
+		var parseErr *lineError
+		if errors.As(err, &parseErr) {
+			result.Line = parseErr.Line
+		}
+		return result
+	}
+	stored, duplicate, err := addTrack(content, track, "")
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.ID, result.Status = stored.ID, importAdded
+	if duplicate {
+		result.Status = importDuplicate
+	}
+	return result
+}
+
+// Copies the body of an import to a temporary file in importDir, which the
+// caller must remove. The status code tells why it failed.
+func spoolArchive(r *http.Request) (string, int, error) {
+	if err := os.MkdirAll(importDir(), 0700); err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	file, err := ioutil.TempFile(importDir(), "import-*")
+	if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	size, err := io.Copy(file, io.LimitReader(r.Body, maxImportSize+1))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	status := http.StatusBadRequest
+	if err == nil && size > maxImportSize {
+		err, status = errors.New("archive is larger than the import limit"), http.StatusRequestEntityTooLarge
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", status, err
+	}
+	return file.Name(), http.StatusOK, nil
+}
+
+// POST /paragliding/api/track/import queues a job adding every IGC, GPX and
+// FIT file of the ZIP or tar.gz archive in the body, which reports on each
+// of them. Webhooks are told about the new tracks once, after the whole
+// archive. The archive waits for the job in a temporary file.
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		error400(w)
+		return
+	}
+	archivePath, status, err := spoolArchive(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	queued := false
+	defer func() {
+		if !queued {
+			os.Remove(archivePath)
+		}
+	}()
+	archive, err := os.Open(archivePath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	format := archiveFormat(archive)
+	archive.Close()
+	if format == "" {
+		http.Error(w, "not a ZIP or tar.gz archive", http.StatusBadRequest)
+		return
+	}
+
+	queued = submitJob(w, func(result *Job) error {
+		defer os.Remove(archivePath)
+		archive, err := os.Open(archivePath)
+		if err != nil {
+			return err
+		}
+		defer archive.Close()
+		info, err := archive.Stat()
+		if err != nil {
+			return err
+		}
+
+		report := &ImportReport{Files: []ImportResult{}}
+		result.Report = report
+		err = walkArchive(archive, info.Size(), func(name string, file io.Reader) {
+			imported := importFile(name, file)
+			switch imported.Status {
+			case importAdded:
+				report.Added++
+			case importDuplicate:
+				report.Duplicates++
+			default:
+				report.Failed++
+			}
+			report.Files = append(report.Files, imported)
+		})
+		if report.Added > 0 {
+			sendWebhook()
+		}
+		// A broken archive may still have given some tracks, which the
+		// report of the failed job lists
+		return err
+	})
+}
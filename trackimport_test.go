@@ -0,0 +1,125 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Files of a test archive, in order: two flights, a duplicate of the
+// first, a broken IGC file and files that are not tracks
+func importFiles(t *testing.T) ([]string, [][]byte) {
+	sample := readTestData(t, "sample.igc")
+	other := bytes.Replace(sample, []byte("Gerd Gliding"), []byte("Anne"), 1)
+	broken := bytes.Replace(sample, []byte("B1100026047700N"), []byte("B1100026047"), 1)
+	names := []string{"2018/first.igc", "2018/second.IGC", "copy/first.igc", "2018/broken.igc", "notes.txt", "__MACOSX/2018/._first.igc"}
+	return names, [][]byte{sample, other, sample, broken, []byte("hello"), []byte("junk")}
+}
+
+func zipArchive(t *testing.T) []byte {
+	var archive bytes.Buffer
+	zipped := zip.NewWriter(&archive)
+	names, contents := importFiles(t)
+	for i, name := range names {
+		file, _ := zipped.Create(name)
+		file.Write(contents[i])
+	}
+	zipped.Close()
+	return archive.Bytes()
+}
+
+func tarArchive(t *testing.T) []byte {
+	var archive bytes.Buffer
+	unzipped := gzip.NewWriter(&archive)
+	files := tar.NewWriter(unzipped)
+	names, contents := importFiles(t)
+	for i, name := range names {
+		files.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents[i])), Typeflag: tar.TypeReg})
+		files.Write(contents[i])
+	}
+	files.Close()
+	unzipped.Close()
+	return archive.Bytes()
+}
+
+func TestParseIGC_Line(t *testing.T) {
+	_, err := parseIGC([]byte("AXXXABC test\r\nHFDTE020918\r\nB1100006047700N01041400EA0038800400\r\nB11000260477\r\n"))
+	var parseErr *lineError
+	if !errors.As(err, &parseErr) || parseErr.Line != 4 {
+		t.Errorf("broken B record gave %v, want an error in line 4", err)
+	}
+}
+
+// Body that fails to be read
+type brokenBody struct{}
+
+func (brokenBody) Read(p []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestImportHandler(t *testing.T) {
+	// The archives wait for their jobs in here
+	spool := t.TempDir()
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", spool)
+
+	for format, archive := range map[string][]byte{"zip": zipArchive(t), "tar.gz": tarArchive(t)} {
+		setupMemStores(t)
+		w := httptest.NewRecorder()
+		importHandler(w, httptest.NewRequest("POST", "/paragliding/api/track/import", bytes.NewReader(archive)))
+		var job Job
+		if err := json.Unmarshal(w.Body.Bytes(), &job); err != nil || w.Code != http.StatusAccepted {
+			t.Fatalf("%v import gave %d %q", format, w.Code, w.Body.String())
+		}
+		job = waitJob(t, job.ID)
+		if job.Status != jobDone || job.Report == nil {
+			t.Fatalf("%v import job ended as %+v", format, job)
+		}
+		report := *job.Report
+		if report.Added != 2 || report.Duplicates != 1 || report.Failed != 1 || len(report.Files) != 4 {
+			t.Fatalf("%v import reported %+v", format, report)
+		}
+		files := report.Files
+		if files[0].Status != importAdded || files[2].Status != importDuplicate || files[2].ID != files[0].ID {
+			t.Errorf("%v import reported %+v", format, files)
+		}
+		if files[3].File != "2018/broken.igc" || files[3].Line != 12 || !strings.Contains(files[3].Error, "line 12") {
+			t.Errorf("%v import reported the broken file as %+v", format, files[3])
+		}
+		if count, _ := trackDataBase.Count(); count != 2 {
+			t.Errorf("%v import stored %d tracks, want 2", format, count)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	importHandler(w, httptest.NewRequest("POST", "/paragliding/api/track/import", strings.NewReader("not an archive")))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("import of a text gave %d, want 400", w.Code)
+	}
+	w = httptest.NewRecorder()
+	importHandler(w, httptest.NewRequest("POST", "/paragliding/api/track/import", brokenBody{}))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("import with a broken body gave %d, want 400", w.Code)
+	}
+
+	defer func(saved int64) { maxImportSize = saved }(maxImportSize)
+	maxImportSize = 100
+	w = httptest.NewRecorder()
+	importHandler(w, httptest.NewRequest("POST", "/paragliding/api/track/import", bytes.NewReader(zipArchive(t))))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("import of a large archive gave %d, want 413", w.Code)
+	}
+
+	if left, _ := ioutil.ReadDir(importDir()); len(left) != 0 {
+		t.Errorf("%d archives left behind", len(left))
+	}
+}
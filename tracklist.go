@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Page sizes of the track listing
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// Sort orders accepted by the track listing, by the name of the field in the API
+var listSortFields = map[string]string{
+	"timestamp":    sortTimeStamp,
+	"H_date":       sortHDate,
+	"track_length": sortTrackLength,
+}
+
+// Cursors are handed out opaque, as base64 encoded JSON
+func encodeCursor(cursor *TrackCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (*TrackCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	cursor := &TrackCursor{}
+	if err := json.Unmarshal(data, cursor); err != nil {
+		return nil, err
+	}
+	if !cursor.TimeStamp.Valid() {
+		return nil, errors.New("invalid cursor")
+	}
+	return cursor, nil
+}
+
+// Dates in the H_date filters are either a day (2018-09-02) or RFC 3339
+func parseListDate(s string, endOfDay bool) (time.Time, error) {
+	if day, err := time.Parse("2006-01-02", s); err == nil {
+		if endOfDay {
+			return day.Add(24*time.Hour - time.Nanosecond), nil
+		}
+		return day, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// Reads the parameters of GET /paragliding/api/track/:
+// limit, after, pilot, glider, glider_id, from, to, min_length, validation
+// and sort, where sort is timestamp (default), H_date or track_length,
+// prefixed with "-" for descending order
+func parseTrackQuery(values url.Values) (TrackQuery, error) {
+	q := TrackQuery{
+		Pilot:    values.Get("pilot"),
+		Glider:   values.Get("glider"),
+		GliderID: values.Get("glider_id"),
+		Limit:    defaultListLimit,
+	}
+	var err error
+
+	if limit := values.Get("limit"); limit != "" {
+		q.Limit, err = strconv.Atoi(limit)
+		if err != nil || q.Limit < 1 || q.Limit > maxListLimit {
+			return q, errors.New("limit must be between 1 and " + strconv.Itoa(maxListLimit))
+		}
+	}
+	if after := values.Get("after"); after != "" {
+		if q.After, err = decodeCursor(after); err != nil {
+			return q, errors.New("invalid cursor")
+		}
+	}
+	if from := values.Get("from"); from != "" {
+		if q.From, err = parseListDate(from, false); err != nil {
+			return q, err
+		}
+	}
+	if to := values.Get("to"); to != "" {
+		if q.To, err = parseListDate(to, true); err != nil {
+			return q, err
+		}
+	}
+	if minLength := values.Get("min_length"); minLength != "" {
+		if q.MinLength, err = strconv.ParseFloat(minLength, 64); err != nil {
+			return q, err
+		}
+	}
+	if validation := values.Get("validation"); validation != "" {
+		known := false
+		for _, status := range validationStatuses {
+			known = known || validation == status
+		}
+		if !known {
+			return q, errors.New("validation must be one of " + strings.Join(validationStatuses, ", "))
+		}
+		q.Validation = validation
+	}
+	if order := values.Get("sort"); order != "" {
+		q.Desc = strings.HasPrefix(order, "-")
+		field, ok := listSortFields[strings.TrimPrefix(order, "-")]
+		if !ok {
+			return q, errors.New("unknown sort order " + order)
+		}
+		q.SortBy = field
+	}
+	return q, nil
+}
+
+// Answers GET /paragliding/api/track/ with a page of track ids. When there
+// may be more, the URL of the next page is given in the Link header.
+func listTracks(w http.ResponseWriter, r *http.Request) {
+	q, err := parseTrackQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tracks, err := trackDataBase.Find(q)
+	if err != nil {
+		errorStore(w, err)
+		return
+	}
+
+	response := []string{}
+	for _, tempTrack := range tracks {
+		response = append(response, tempTrack.ID)
+	}
+
+	if len(tracks) == q.Limit {
+		values := r.URL.Query()
+		values.Set("after", encodeCursor(cursorOf(tracks[len(tracks)-1])))
+		next := url.URL{Path: r.URL.Path, RawQuery: values.Encode()}
+		w.Header().Set("Link", "<"+next.String()+">; rel=\"next\"")
+	}
+
+	IDJSON, err := json.Marshal(response)
+	if err != nil {
+		error400(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(IDJSON)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Validation status of a track's IGC file
+const (
+	validationValid               = "valid"
+	validationInvalid             = "invalid"
+	validationUnsigned            = "unsigned"             // no G records
+	validationUnknownManufacturer = "unknown-manufacturer" // no validator for the logger
+	validationUnvalidated         = "unvalidated"          // GPX and FIT files have no signature
+)
+
+var validationStatuses = []string{validationValid, validationInvalid, validationUnsigned, validationUnknownManufacturer, validationUnvalidated}
+
+// igcValidator checks the security signature of the IGC files of one
+// manufacturer. Validate returns false for files that fail the check and an
+// error when the check itself could not be made.
+type igcValidator interface {
+	Validate(content []byte) (bool, error)
+}
+
+// Validators by the three letter manufacturer code of the A record
+var (
+	validatorsMutex sync.RWMutex
+	validators      = map[string]igcValidator{}
+)
+
+func registerValidator(manufacturer string, validator igcValidator) {
+	validatorsMutex.Lock()
+	defer validatorsMutex.Unlock()
+	validators[strings.ToUpper(manufacturer)] = validator
+}
+
+func validatorFor(manufacturer string) (igcValidator, bool) {
+	validatorsMutex.RLock()
+	defer validatorsMutex.RUnlock()
+	validator, ok := validators[strings.ToUpper(manufacturer)]
+	return validator, ok
+}
+
+// commandValidator runs a manufacturer's VALI program, such as vali-xcs
+// from XCSoar, on the file. The program exits with 0 for valid files.
+type commandValidator struct {
+	Path    string
+	Timeout time.Duration
+}
+
+func (v commandValidator) Validate(content []byte) (bool, error) {
+	file, err := ioutil.TempFile("", "validate-*.igc")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return false, err
+	}
+	if err := file.Close(); err != nil {
+		return false, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), v.Timeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, v.Path, file.Name()).CombinedOutput()
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		log.Printf("%v rejected the file: %s", v.Path, bytes.TrimSpace(output))
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Registers the validators given in IGC_VALIDATORS, a comma separated list
+// such as "XCS=/usr/bin/vali-xcs,LXN=/opt/vali/vali-lxn". Without it the
+// open-source vali-xcs is used for XCSoar files if it is on the PATH.
+func registerValidatorsFromEnv() {
+	timeout := getEnvDuration("IGC_VALIDATOR_TIMEOUT", 30*time.Second)
+	config := os.Getenv("IGC_VALIDATORS")
+	if config == "" {
+		if path, err := exec.LookPath("vali-xcs"); err == nil {
+			config = "XCS=" + path
+		}
+	}
+	for _, entry := range strings.Split(config, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) != 2 || len(parts[0]) != 3 || parts[1] == "" {
+			if entry != "" {
+				log.Printf("ignoring IGC validator %q", entry)
+			}
+			continue
+		}
+		registerValidator(parts[0], commandValidator{Path: parts[1], Timeout: timeout})
+		log.Printf("validating %v files with %v", strings.ToUpper(parts[0]), parts[1])
+	}
+}
+
+// Manufacturer code of the A record, the first line of an IGC file
+func manufacturerCode(content []byte) string {
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 && line[0] == 'A' {
+			if len(line) < 4 {
+				return ""
+			}
+			return strings.ToUpper(string(line[1:4]))
+		}
+	}
+	return ""
+}
+
+// Checks the G record signature of an IGC file
+func validateIGC(content []byte) string {
+	if sourceFormat(content) != formatIGC {
+		return validationUnvalidated
+	}
+	signed := false
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		if len(line) > 0 && line[0] == 'G' {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return validationUnsigned
+	}
+
+	manufacturer := manufacturerCode(content)
+	validator, ok := validatorFor(manufacturer)
+	if !ok {
+		return validationUnknownManufacturer
+	}
+	valid, err := validator.Validate(content)
+	if err != nil {
+		log.Printf("could not validate %v file: %v", manufacturer, err)
+		return validationUnknownManufacturer
+	}
+	if !valid {
+		return validationInvalid
+	}
+	return validationValid
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Accepts files whose G record reads GOOD
+type stubValidator struct {
+	err error
+}
+
+func (v stubValidator) Validate(content []byte) (bool, error) {
+	return bytes.Contains(content, []byte("\nGGOOD")), v.err
+}
+
+func TestValidateIGC(t *testing.T) {
+	defer delete(validators, "XXX")
+	content := readTestData(t, "sample.igc")
+	signed := func(g string) []byte {
+		return append(append([]byte(nil), content...), []byte(g+"\r\n")...)
+	}
+
+	if status := validateIGC(content); status != validationUnsigned {
+		t.Errorf("file without G records is %v, want %v", status, validationUnsigned)
+	}
+	if status := validateIGC(signed("GGOOD")); status != validationUnknownManufacturer {
+		t.Errorf("file without a validator is %v, want %v", status, validationUnknownManufacturer)
+	}
+
+	registerValidator("xxx", stubValidator{})
+	tests := map[string]string{
+		"GGOOD": validationValid,
+		"GBAD":  validationInvalid,
+	}
+	for g, want := range tests {
+		if status := validateIGC(signed(g)); status != want {
+			t.Errorf("file signed %v is %v, want %v", g, status, want)
+		}
+	}
+
+	registerValidator("XXX", stubValidator{errors.New("no such program")})
+	if status := validateIGC(signed("GGOOD")); status != validationUnknownManufacturer {
+		t.Errorf("file with a broken validator is %v, want %v", status, validationUnknownManufacturer)
+	}
+}
+
+func TestCommandValidator(t *testing.T) {
+	valid, err := commandValidator{Path: "true", Timeout: time.Second}.Validate([]byte("AXXX\r\n"))
+	if !valid || err != nil {
+		t.Errorf("true gave %v, %v", valid, err)
+	}
+	valid, err = commandValidator{Path: "false", Timeout: time.Second}.Validate([]byte("AXXX\r\n"))
+	if valid || err != nil {
+		t.Errorf("false gave %v, %v", valid, err)
+	}
+	if _, err = (commandValidator{Path: "/no/such/vali", Timeout: time.Second}).Validate(nil); err == nil {
+		t.Error("missing program gave no error")
+	}
+}
+
+func TestTrackHandler_Validation(t *testing.T) {
+	setupMemStores(t)
+	registerValidator("XXX", stubValidator{})
+	defer delete(validators, "XXX")
+	content := readTestData(t, "sample.igc")
+
+	unsigned := postIGC(t, content)
+	// G records do not count for duplicates, so change the pilot too
+	edited := bytes.Replace(content, []byte("Gerd Gliding"), []byte("Anne"), 1)
+	signed := postIGC(t, append(edited, []byte("GGOOD\r\n")...))
+
+	for id, want := range map[string]string{unsigned: validationUnsigned, signed: validationValid} {
+		track, err := trackDataBase.Get(id)
+		if err != nil || track.Validation != want {
+			t.Errorf("track %v is %q, want %q", id, track.Validation, want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	trackHandler(w, httptest.NewRequest("GET", "/paragliding/api/track/?validation=valid", nil))
+	if w.Body.String() != `["`+signed+`"]` {
+		t.Errorf("listing valid tracks gave %v", w.Body.String())
+	}
+}
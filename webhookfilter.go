@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/marni/goigc"
+)
+
+// BoundingBox is an area of latitudes and longitudes, in degrees
+type BoundingBox struct {
+	MinLat float64 `json:"min_lat"`
+	MinLon float64 `json:"min_lon"`
+	MaxLat float64 `json:"max_lat"`
+	MaxLon float64 `json:"max_lon"`
+}
+
+// TakeoffSite is the area within Radius m of a point
+type TakeoffSite struct {
+	Lat    float64 `json:"lat"`
+	Lon    float64 `json:"lon"`
+	Radius float64 `json:"radius"` // RECORD_SITE_RADIUS if 0
+}
+
+// WebhookFilter selects the tracks a webhook is told about. Every criterion
+// that is set must match; names are compared ignoring case. Tracks without
+// a takeoff, stored before statistics were computed, match no area or site.
+type WebhookFilter struct {
+	Pilots     []string     `json:"pilots,omitempty"` // any of them
+	Glider     string       `json:"glider,omitempty"`
+	Area       *BoundingBox `json:"area,omitempty"` // of the takeoff
+	Site       *TakeoffSite `json:"site,omitempty"`
+	MinLength  float64      `json:"min_track_length,omitempty"` // km
+	MinXCScore float64      `json:"min_xc_score,omitempty"`     // points of the best XC score
+}
+
+// Checks a filter sent by a client, filling in the defaults
+func (f *WebhookFilter) validate() error {
+	if f.MinLength < 0 || f.MinXCScore < 0 {
+		return errors.New("minimum track length and XC score can't be negative")
+	}
+	if area := f.Area; area != nil {
+		if area.MinLat > area.MaxLat || area.MinLon > area.MaxLon ||
+			area.MinLat < -90 || area.MaxLat > 90 || area.MinLon < -180 || area.MaxLon > 180 {
+			return errors.New("area must have min_lat <= max_lat and min_lon <= max_lon, in degrees")
+		}
+	}
+	if site := f.Site; site != nil {
+		if site.Lat < -90 || site.Lat > 90 || site.Lon < -180 || site.Lon > 180 || site.Radius < 0 {
+			return errors.New("site must be a position in degrees with a radius in m")
+		}
+		if site.Radius == 0 {
+			site.Radius = siteRadius
+		}
+	}
+	return nil
+}
+
+// Reports whether the track passes the filter
+func (f WebhookFilter) match(track Track) bool {
+	if len(f.Pilots) > 0 {
+		found := false
+		for _, pilot := range f.Pilots {
+			found = found || strings.EqualFold(strings.TrimSpace(pilot), strings.TrimSpace(track.Pilot))
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.Glider != "" && !strings.EqualFold(strings.TrimSpace(f.Glider), strings.TrimSpace(track.Glider)) {
+		return false
+	}
+	if track.TrackLength < f.MinLength {
+		return false
+	}
+	if f.MinXCScore > 0 && (len(track.XC) == 0 || track.XC[0].Points < f.MinXCScore) {
+		return false
+	}
+
+	takeoff := track.Stats.Takeoff
+	if (f.Area != nil || f.Site != nil) && takeoff.Time.IsZero() {
+		return false
+	}
+	if area := f.Area; area != nil {
+		if takeoff.Lat < area.MinLat || takeoff.Lat > area.MaxLat || takeoff.Lon < area.MinLon || takeoff.Lon > area.MaxLon {
+			return false
+		}
+	}
+	if site := f.Site; site != nil {
+		centre := igc.NewPointFromLatLng(site.Lat, site.Lon)
+		if centre.Distance(igc.NewPointFromLatLng(takeoff.Lat, takeoff.Lon))*1000 > site.Radius {
+			return false
+		}
+	}
+	return true
+}
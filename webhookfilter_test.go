@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestWebhookFilterMatch(t *testing.T) {
+	track := Track{
+		Pilot:       "Gerd Gliding",
+		Glider:      "Ozone Rush 5",
+		TrackLength: 42,
+		XC:          []XCScore{{Type: "free_distance", Points: 30}},
+		Stats:       FlightStats{Takeoff: Fix{Time: time.Date(2018, 9, 2, 11, 0, 0, 0, time.UTC), Lat: 60.795, Lon: 10.69}},
+	}
+	tests := []struct {
+		filter WebhookFilter
+		match  bool
+	}{
+		{WebhookFilter{}, true},
+		{WebhookFilter{Pilots: []string{"Anna", "gerd gliding"}}, true},
+		{WebhookFilter{Pilots: []string{"Anna"}}, false},
+		{WebhookFilter{Glider: "ozone rush 5"}, true},
+		{WebhookFilter{Glider: "Ozone Enzo 3"}, false},
+		{WebhookFilter{MinLength: 42}, true},
+		{WebhookFilter{MinLength: 50}, false},
+		{WebhookFilter{MinXCScore: 30}, true},
+		{WebhookFilter{MinXCScore: 31}, false},
+		{WebhookFilter{Area: &BoundingBox{60, 10, 61, 11}}, true},
+		{WebhookFilter{Area: &BoundingBox{46, 7, 47, 9}}, false},
+		{WebhookFilter{Site: &TakeoffSite{60.7955, 10.69, 100}}, true},
+		{WebhookFilter{Site: &TakeoffSite{60.8, 10.69, 100}}, false},
+		{WebhookFilter{Pilots: []string{"Gerd Gliding"}, MinLength: 100}, false},
+	}
+	for _, test := range tests {
+		if test.filter.match(track) != test.match {
+			t.Errorf("%+v matched %v", test.filter, !test.match)
+		}
+	}
+
+	// Tracks stored before statistics have no takeoff
+	if (WebhookFilter{Area: &BoundingBox{-90, -180, 90, 180}}).match(Track{}) {
+		t.Error("track without takeoff matched an area")
+	}
+}
+
+func TestWebhookFilterValidate(t *testing.T) {
+	filter := WebhookFilter{Site: &TakeoffSite{Lat: 60.795, Lon: 10.69}}
+	if err := filter.validate(); err != nil || filter.Site.Radius != siteRadius {
+		t.Errorf("site without radius gave %v, %+v", err, filter.Site)
+	}
+	for _, bad := range []WebhookFilter{
+		{MinLength: -1},
+		{MinXCScore: -1},
+		{Area: &BoundingBox{61, 10, 60, 11}},
+		{Area: &BoundingBox{60, 10, 95, 11}},
+		{Site: &TakeoffSite{Lat: 100}},
+		{Site: &TakeoffSite{Radius: -5}},
+	} {
+		if err := bad.validate(); err == nil {
+			t.Errorf("%+v passed validation", bad)
+		}
+	}
+}
+
+func TestFilteredWebhooks(t *testing.T) {
+	setupMemStores(t)
+	if w := postWebhook(t, `{"webhookURL": "http://example.com/a", "filter": {"area": {"min_lat": 1, "max_lat": 0}}}`); w.Code != http.StatusBadRequest {
+		t.Errorf("bad filter gave %d, want 400", w.Code)
+	}
+	gerd := postWebhook(t, `{"webhookURL": "http://example.com/a", "filter": {"pilots": ["gerd gliding"]}}`).Body.String()
+	anna := postWebhook(t, `{"webhookURL": "http://example.com/b", "filter": {"pilots": ["Anna"]}}`).Body.String()
+	xcTeam := postWebhook(t, `{"webhookURL": "http://example.com/c", "events": ["track.created"], "filter": {"min_track_length": 1000}}`).Body.String()
+	local := postWebhook(t, `{"webhookURL": "http://example.com/d", "events": ["track.created"], "filter": {"site": {"lat": 60.795, "lon": 10.69, "radius": 5000}}}`).Body.String()
+
+	postIGC(t, readTestData(t, "sample.igc"))
+	for hook, want := range map[string]int{gerd: 1, anna: 0, xcTeam: 0, local: 1} {
+		if deliveries, _ := webhookDataBase.FindDeliveries(hook, ""); len(deliveries) != want {
+			t.Errorf("webhook %v got %d deliveries, want %d", hook, len(deliveries), want)
+		}
+	}
+
+	// The track is not announced again, nor counted for the other
+	sendWebhook()
+	for hook, want := range map[string]int{gerd: 1, anna: 0} {
+		if deliveries, _ := webhookDataBase.FindDeliveries(hook, ""); len(deliveries) != want {
+			t.Errorf("webhook %v got %d deliveries later, want %d", hook, len(deliveries), want)
+		}
+	}
+}
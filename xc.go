@@ -0,0 +1,214 @@
+package main
+
+import (
+	"math"
+	"sort"
+
+	"github.com/marni/goigc"
+)
+
+// Kinds of cross-country flights, scored the way OLC and XContest do
+const (
+	xcFreeDistance = "free_distance"
+	xcFlatTriangle = "flat_triangle"
+	xcFAITriangle  = "fai_triangle"
+)
+
+// Points per km of each kind of flight
+var xcMultipliers = map[string]float64{
+	xcFreeDistance: 1.0,
+	xcFlatTriangle: 1.2,
+	xcFAITriangle:  1.4,
+}
+
+// The optimizer works on at most xcMaxPoints fixes of a track, and
+// triangles are closed when start and finish are no further apart than
+// xcClosingRatio of the perimeter
+var (
+	xcMaxPoints    = getEnvInt("XC_MAX_POINTS", 300)
+	xcClosingRatio = 0.2
+)
+
+// In an FAI triangle no leg is shorter than this share of the perimeter
+const faiMinLeg = 0.28
+
+// XCScore is the best flight of one kind found in a track. Distance is in
+// km, for triangles the perimeter less the closing distance.
+type XCScore struct {
+	Type       string  `json:"type"`
+	Distance   float64 `json:"distance"`
+	Multiplier float64 `json:"multiplier"`
+	Points     float64 `json:"points"`
+	Start      Fix     `json:"start"`
+	Turnpoints []Fix   `json:"turnpoints"`
+	Finish     Fix     `json:"finish"`
+}
+
+// Picks evenly spread fixes of the track, keeping the first and last
+func xcSample(n int) []int {
+	if xcMaxPoints < 2 || n <= xcMaxPoints {
+		indexes := make([]int, n)
+		for i := range indexes {
+			indexes[i] = i
+		}
+		return indexes
+	}
+	indexes := make([]int, xcMaxPoints)
+	for i := range indexes {
+		indexes[i] = i * (n - 1) / (xcMaxPoints - 1)
+	}
+	return indexes
+}
+
+// Scores a track as free distance, flat triangle and FAI triangle. The
+// result holds the kinds that could be flown, best first.
+func scoreXC(track igc.Track) []XCScore {
+	scores := []XCScore{}
+	if len(track.Points) < 2 {
+		return scores
+	}
+	times := fixTimes(track)
+	sample := xcSample(len(track.Points))
+	n := len(sample)
+
+	dist := make([][]float64, n)
+	for i := range dist {
+		dist[i] = make([]float64, n)
+		for j := 0; j < i; j++ {
+			dist[i][j] = track.Points[sample[i]].Distance(track.Points[sample[j]])
+			dist[j][i] = dist[i][j]
+		}
+	}
+	score := func(kind string, distance float64, route ...int) XCScore {
+		fixes := make([]Fix, len(route))
+		for i, k := range route {
+			fixes[i] = fixOf(track.Points[sample[k]], times[sample[k]])
+		}
+		return XCScore{
+			Type:       kind,
+			Distance:   distance,
+			Multiplier: xcMultipliers[kind],
+			Points:     distance * xcMultipliers[kind],
+			Start:      fixes[0],
+			Turnpoints: fixes[1 : len(fixes)-1],
+			Finish:     fixes[len(fixes)-1],
+		}
+	}
+
+	scores = append(scores, freeDistance(dist, score))
+	if flat, fai, ok := triangles(dist, score); ok {
+		scores = append(scores, flat)
+		if fai.Type != "" {
+			scores = append(scores, fai)
+		}
+	}
+	sort.SliceStable(scores, func(i, j int) bool {
+		return scores[i].Points > scores[j].Points
+	})
+	return scores
+}
+
+// Longest route from start to finish through up to three turnpoints
+func freeDistance(dist [][]float64, score func(string, float64, ...int) XCScore) XCScore {
+	const legs = 4
+	n := len(dist)
+
+	// best[k][i] is the longest route of k legs ending at fix i, from[k][i]
+	// where its last leg starts
+	best := make([][]float64, legs+1)
+	from := make([][]int, legs+1)
+	for k := range best {
+		best[k] = make([]float64, n)
+		from[k] = make([]int, n)
+	}
+	for k := 1; k <= legs; k++ {
+		for i := 0; i < n; i++ {
+			from[k][i] = i
+			best[k][i] = best[k-1][i]
+			for j := 0; j < i; j++ {
+				if d := best[k-1][j] + dist[j][i]; d > best[k][i] {
+					best[k][i], from[k][i] = d, j
+				}
+			}
+		}
+	}
+
+	finish := 0
+	for i := range best[legs] {
+		if best[legs][i] > best[legs][finish] {
+			finish = i
+		}
+	}
+	route := []int{finish}
+	for k, i := legs, finish; k > 0; k-- {
+		if from[k][i] != i {
+			i = from[k][i]
+			route = append([]int{i}, route...)
+		}
+	}
+	if len(route) == 1 {
+		route = append(route, finish)
+	}
+	return score(xcFreeDistance, best[legs][finish], route...)
+}
+
+// Best flat and FAI triangles, if any triangle was closed. Start and
+// finish are the closest fixes before the first and after the last
+// turnpoint.
+func triangles(dist [][]float64, score func(string, float64, ...int) XCScore) (XCScore, XCScore, bool) {
+	n := len(dist)
+
+	// closing[a][c] is the shortest distance between a fix up to a and a
+	// fix from c on, start and finish the fixes giving it
+	closing := make([][]float64, n)
+	start := make([][]int, n)
+	finish := make([][]int, n)
+	for a := range closing {
+		closing[a] = make([]float64, n)
+		start[a] = make([]int, n)
+		finish[a] = make([]int, n)
+	}
+	for a := 0; a < n; a++ {
+		for c := n - 1; c >= a; c-- {
+			closing[a][c], start[a][c], finish[a][c] = dist[a][c], a, c
+			if a > 0 && closing[a-1][c] < closing[a][c] {
+				closing[a][c], start[a][c], finish[a][c] = closing[a-1][c], start[a-1][c], finish[a-1][c]
+			}
+			if c < n-1 && closing[a][c+1] < closing[a][c] {
+				closing[a][c], start[a][c], finish[a][c] = closing[a][c+1], start[a][c+1], finish[a][c+1]
+			}
+		}
+	}
+
+	var flat, fai XCScore
+	bestFlat, bestFAI := 0.0, 0.0
+	for a := 0; a < n; a++ {
+		for c := a + 2; c < n; c++ {
+			for b := a + 1; b < c; b++ {
+				perimeter := dist[a][b] + dist[b][c] + dist[c][a]
+				if perimeter == 0 || closing[a][c] > xcClosingRatio*perimeter {
+					continue
+				}
+				distance := perimeter - closing[a][c]
+				shortest := math.Min(dist[a][b], math.Min(dist[b][c], dist[c][a]))
+				if shortest >= faiMinLeg*perimeter {
+					if distance > bestFAI {
+						bestFAI = distance
+						fai = score(xcFAITriangle, distance, start[a][c], a, b, c, finish[a][c])
+					}
+				} else if distance > bestFlat {
+					bestFlat = distance
+					flat = score(xcFlatTriangle, distance, start[a][c], a, b, c, finish[a][c])
+				}
+			}
+		}
+	}
+
+	// An FAI triangle also counts as a flat one
+	if bestFAI > bestFlat {
+		flat = fai
+		flat.Type, flat.Multiplier = xcFlatTriangle, xcMultipliers[xcFlatTriangle]
+		flat.Points = flat.Distance * flat.Multiplier
+	}
+	return flat, fai, flat.Type != ""
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/marni/goigc"
+)
+
+// A track flown in straight lines between the corners, a fix every 10s
+func cornersTrack(corners ...[2]float64) igc.Track {
+	track := igc.NewTrack()
+	track.Date = time.Date(2018, 9, 2, 0, 0, 0, 0, time.UTC)
+	clock := time.Date(0, 1, 1, 10, 0, 0, 0, time.UTC)
+	for i := 0; i+1 < len(corners); i++ {
+		from, to := corners[i], corners[i+1]
+		for step := 0; step < 50; step++ {
+			f := float64(step) / 50
+			point := igc.NewPointFromLatLng(from[0]+f*(to[0]-from[0]), from[1]+f*(to[1]-from[1]))
+			point.Time = clock
+			track.Points = append(track.Points, point)
+			clock = clock.Add(10 * time.Second)
+		}
+	}
+	last := corners[len(corners)-1]
+	point := igc.NewPointFromLatLng(last[0], last[1])
+	point.Time = clock
+	track.Points = append(track.Points, point)
+	return track
+}
+
+func TestScoreXC(t *testing.T) {
+	a, b, c := [2]float64{60, 10}, [2]float64{60, 10.2}, [2]float64{60.0965, 10.1}
+	legs := func(corners ...[2]float64) float64 {
+		total := 0.0
+		for i := 0; i+1 < len(corners); i++ {
+			p, q := igc.NewPointFromLatLng(corners[i][0], corners[i][1]), igc.NewPointFromLatLng(corners[i+1][0], corners[i+1][1])
+			total += p.Distance(q)
+		}
+		return total
+	}
+
+	tests := []struct {
+		name     string
+		track    igc.Track
+		best     string
+		distance float64
+	}{
+		{"straight", cornersTrack(a, b), xcFreeDistance, legs(a, b)},
+		// An out and return is a flat triangle with a very short leg
+		{"out and return", cornersTrack(a, b, a), xcFlatTriangle, 2 * legs(a, b)},
+		{"equilateral", cornersTrack(a, b, c, a), xcFAITriangle, legs(a, b, c, a)},
+		{"flat", cornersTrack(a, [2]float64{60, 10.3}, [2]float64{60.02, 10.15}, a), xcFlatTriangle, 0},
+	}
+	for _, test := range tests {
+		scores := scoreXC(test.track)
+		if len(scores) == 0 || scores[0].Type != test.best {
+			t.Errorf("%v: best flight %+v, want %v", test.name, scores, test.best)
+			continue
+		}
+		best := scores[0]
+		if test.distance > 0 && math.Abs(best.Distance-test.distance) > 0.1 {
+			t.Errorf("%v: distance %v, want %v", test.name, best.Distance, test.distance)
+		}
+		if best.Points != best.Distance*xcMultipliers[test.best] {
+			t.Errorf("%v: %v points for %v km", test.name, best.Points, best.Distance)
+		}
+	}
+
+	// The sample flies away from takeoff, free distance is all there is
+	track, _ := igc.Parse(string(readTestData(t, "sample.igc")))
+	stats := computeStats(track)
+	scores := scoreXC(track)
+	if scores[0].Type != xcFreeDistance || scores[0].Distance < stats.StraightDistance || scores[0].Distance > calculateTotalDistance(track) {
+		t.Errorf("sample scored %+v", scores[0])
+	}
+	if len(scores[0].Turnpoints) > 3 {
+		t.Errorf("free distance through %d turnpoints", len(scores[0].Turnpoints))
+	}
+}